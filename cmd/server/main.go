@@ -2,58 +2,113 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/go-redis/redis/v9"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"github.com/kgantsov/redproxy/pkg/config"
+	"github.com/kgantsov/redproxy/pkg/consistent_hashing"
 	"github.com/kgantsov/redproxy/pkg/proto"
 )
 
 var (
-	logLevel string
-	hostsStr string
-	port     int
+	configPath      string
+	logLevel        string
+	metricsListen   string
+	adminToken      string
+	hostsStr        string
+	port            int
+	passthrough     bool
+	maxBulkLen      int64
+	maxMultibulkLen int64
+	routing         string
+	slotsStr        string
+	hashTag         string
+	hashName        string
+	reshardFromStr  string
 )
 
 func main() {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339Nano})
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnixNano
 
-	flag.StringVar(&logLevel, "log_level", "debug", "Log level")
-	flag.StringVar(&hostsStr, "hosts", "localhost:6379,localhost:6380,localhost:6381", "Redis hosts")
+	flag.StringVar(&configPath, "config", "", "YAML config file of the pools, the flags given on the command line override it")
+	flag.StringVar(&logLevel, "log_level", config.DefaultLogLevel, "Log level")
+	flag.StringVar(&metricsListen, "metrics_listen", config.DefaultMetricsListen, "Address of the metrics and the admin API")
+	flag.StringVar(
+		&adminToken, "admin_token", "", "Token of the admin API and PROXY AUTH, nodes and migrations can't be changed without one",
+	)
+	flag.StringVar(
+		&hostsStr, "hosts", "localhost:6379,localhost:6380,localhost:6381", "Redis hosts with optional names and weights like shard1=redis-a:6379=2,redis-b:6379",
+	)
 	flag.IntVar(&port, "port", 46379, "Redis Port")
+	flag.BoolVar(&passthrough, "passthrough", false, "Forward the single-shard commands with a handler, like GET, as is too")
+	flag.Int64Var(&maxBulkLen, "proto_max_bulk_len", proto.DefaultMaxBulkLen, "Max size of a request argument in bytes")
+	flag.Int64Var(&maxMultibulkLen, "max_multibulk_len", proto.DefaultMaxMultibulkLen, "Max number of arguments of a request")
+	flag.StringVar(
+		&routing, "routing", consistent_hashing.RoutingRing, "Key routing: ring, ketama, jump, rendezvous, maglev or slots (Redis Cluster hash slots)",
+	)
+	flag.StringVar(
+		&slotsStr, "slots", "", "Slot table for slots routing like 0-8191=host:6379,8192-16383=host:6380, split evenly across hosts by default",
+	)
+	flag.StringVar(&hashTag, "hash_tag", consistent_hashing.DefaultHashTag, "Hash tag delimiters, keys are routed by the part between them, empty to disable")
+	flag.StringVar(
+		&hashName, "hash", consistent_hashing.HashMD5, "Hash of the ring routing: md5 (compatible with existing data), fnv1a or xxhash",
+	)
+	flag.StringVar(
+		&reshardFromStr, "reshard_from", "", "Hosts the keys were routed to before changing -hosts, they are looked up there until migrated with PROXY MIGRATION START",
+	)
 	flag.Parse()
 
-	hosts := strings.Split(hostsStr, ",")
+	cfg := loadConfig()
 
-	logLevel, err := zerolog.ParseLevel(logLevel)
+	level, err := zerolog.ParseLevel(cfg.LogLevel)
 	if err != nil {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	} else {
-		zerolog.SetGlobalLevel(logLevel)
+		zerolog.SetGlobalLevel(level)
 	}
 
-	redises := map[string]proto.RedisClient{}
-
-	for _, host := range hosts {
-		log.Info().Msgf("Connecting to Redis at %s", host)
-		client := redis.NewClient(&redis.Options{
-			Addr:     host,
-			Password: "",
-			DB:       0,
-		})
-		redises[host] = client
+	if reshardFromStr != "" && len(cfg.Pools) != 1 {
+		log.Fatal().Msgf("Invalid config: -reshard_from needs a single pool, %d are configured", len(cfg.Pools))
 	}
 
-	proxy := proto.NewRedisProxy(redises)
+	metricsServer := proto.NewMetricsServer(cfg.MetricsListen)
+	metricsServer.AdminToken = cfg.AdminToken
+	servers := []*proto.Server{}
+
+	for _, name := range cfg.PoolNames() {
+		pool := cfg.Pools[name]
+		proxy := newPoolProxy(pool)
 
-	srv := proto.NewServer(proxy, port)
+		metrics, err := metricsServer.AddPool(name, proxy)
+		if err != nil {
+			log.Fatal().Msgf("Invalid config: %v", err)
+		}
+
+		proto.NewHealthChecker(proxy, proto.HealthCheckConfig{
+			Interval:     pool.HealthCheckInterval,
+			AutoEject:    pool.AutoEjectHosts,
+			FailureLimit: pool.ServerFailureLimit,
+			RetryTimeout: pool.ServerRetryTimeout,
+		}, metrics).Start()
+
+		srv := proto.NewPoolServer(name, proxy, pool.Listen, metrics)
+		srv.Passthrough = pool.Passthrough
+		srv.AdminToken = cfg.AdminToken
+		srv.MaxBulkLen = pool.MaxBulkLen
+		srv.MaxMultibulkLen = pool.MaxMultibulkLen
+
+		servers = append(servers, srv)
+	}
 
 	sigs := make(chan os.Signal, 1)
 
@@ -68,5 +123,223 @@ func main() {
 		os.Exit(0)
 	}()
 
-	srv.ListenAndServe()
+	go func() {
+		if err := metricsServer.ListenAndServe(); err != nil {
+			log.Error().Msgf("Fatal error: %s", err.Error())
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	for _, srv := range servers {
+		wg.Add(1)
+
+		go func(srv *proto.Server) {
+			defer wg.Done()
+			srv.ListenAndServe()
+		}(srv)
+	}
+
+	wg.Wait()
+}
+
+// loadConfig reads the config file if one is given and applies the flags to
+// it, without a file the config is made of the flags and their defaults
+func loadConfig() *config.Config {
+	cfg := config.Default()
+	visit := flag.VisitAll
+
+	if configPath != "" {
+		var err error
+
+		cfg, err = config.Load(configPath)
+		if err != nil {
+			log.Fatal().Msgf("Invalid config: %v", err)
+		}
+
+		visit = flag.Visit
+	}
+
+	visit(func(f *flag.Flag) {
+		applyFlag(cfg, f.Name)
+	})
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatal().Msgf("Invalid config: %v", err)
+	}
+
+	return cfg
+}
+
+// applyFlag overrides the setting of a flag. The pool settings can only be
+// given for a config of a single pool, the pools of a config with more of
+// them are set in the config file.
+func applyFlag(cfg *config.Config, name string) {
+	switch name {
+	case "log_level":
+		cfg.LogLevel = logLevel
+		return
+	case "metrics_listen":
+		cfg.MetricsListen = metricsListen
+		return
+	case "admin_token":
+		cfg.AdminToken = adminToken
+		return
+	case "config", "reshard_from":
+		return
+	}
+
+	if len(cfg.Pools) > 1 {
+		log.Fatal().Msgf(
+			"Invalid config: -%s would apply to all the %d pools of the config, set it in the config file instead",
+			name, len(cfg.Pools),
+		)
+	}
+
+	for _, pool := range cfg.Pools {
+		switch name {
+		case "hosts":
+			pool.Servers = strings.Split(hostsStr, ",")
+		case "port":
+			pool.Listen = fmt.Sprintf(":%d", port)
+		case "passthrough":
+			pool.Passthrough = passthrough
+		case "proto_max_bulk_len":
+			pool.MaxBulkLen = maxBulkLen
+		case "max_multibulk_len":
+			pool.MaxMultibulkLen = maxMultibulkLen
+		case "routing":
+			pool.Distribution = routing
+		case "slots":
+			pool.Slots = slotsStr
+		case "hash_tag":
+			tag := hashTag
+			pool.HashTag = &tag
+		case "hash":
+			pool.Hash = hashName
+		}
+	}
+}
+
+// newPoolProxy connects to the servers of a pool and returns its proxy. With
+// -reshard_from it starts resharding from the hosts listed there.
+func newPoolProxy(pool *config.Pool) *proto.RedisProxy {
+	newClient := func(addr string) proto.RedisClient {
+		return proto.NewBackendClient(pool.RedisOptions(addr))
+	}
+
+	previousNodes := []consistent_hashing.Node{}
+
+	if reshardFromStr != "" {
+		var err error
+
+		previousNodes, err = consistent_hashing.ParseNodes(reshardFromStr)
+		if err != nil {
+			log.Fatal().Msgf("Invalid hosts to reshard from: %v", err)
+		}
+	}
+
+	redises := map[string]proto.RedisClient{}
+
+	for _, node := range append(append([]consistent_hashing.Node{}, pool.Nodes...), previousNodes...) {
+		if _, ok := redises[node.Name]; ok {
+			continue
+		}
+
+		log.Info().Msgf("Connecting to Redis at %s for %s of pool %s", node.Addr, node.Name, pool.Name)
+		redises[node.Name] = newClient(node.Addr)
+	}
+
+	routerConfig, err := pool.RouterConfig()
+	if err != nil {
+		log.Fatal().Msgf("Invalid routing: %v", err)
+	}
+
+	router, err := consistent_hashing.NewRouterFromConfig(routerConfig)
+	if err != nil {
+		log.Fatal().Msgf("Invalid routing: %v", err)
+	}
+
+	var proxy *proto.RedisProxy
+
+	if len(previousNodes) > 0 {
+		previousConfig := previousRouterConfig(routerConfig, previousNodes)
+
+		previousRouter, err := consistent_hashing.NewRouterFromConfig(previousConfig)
+		if err != nil {
+			log.Fatal().Msgf("Invalid routing: %v", err)
+		}
+
+		proxy = newRedisProxy(redises, previousRouter)
+
+		if _, err := proxy.Reshard(router, nil); err != nil {
+			log.Fatal().Msgf("Invalid resharding: %v", err)
+		}
+
+		log.Info().Msg("Resharding, run PROXY MIGRATION START to move the keys to their new nodes")
+	} else {
+		proxy = newRedisProxy(redises, router)
+	}
+
+	proto.NewMembership(proxy, routerConfig, pool.Nodes, newClient)
+
+	if err := proxy.SetHashTag(*pool.HashTag); err != nil {
+		log.Fatal().Msgf("Invalid hash tag: %v", err)
+	}
+
+	return proxy
+}
+
+// previousRouterConfig describes the router of the nodes keys are resharded
+// from. A slot table is kept, the nodes that are not in both lists are
+// assumed to be the only ones whose slots moved.
+func previousRouterConfig(cfg consistent_hashing.RouterConfig, nodes []consistent_hashing.Node) consistent_hashing.RouterConfig {
+	cfg.Nodes, cfg.Weights = consistent_hashing.NodeNames(nodes)
+
+	if cfg.Slots == nil {
+		return cfg
+	}
+
+	owners := map[string]bool{}
+	for _, r := range cfg.Slots {
+		owners[r.Node] = true
+	}
+
+	added := []string{}
+	previous := map[string]bool{}
+
+	for _, node := range cfg.Nodes {
+		previous[node] = true
+
+		if !owners[node] {
+			added = append(added, node)
+		}
+	}
+
+	removed := []string{}
+	for owner := range owners {
+		if !previous[owner] {
+			removed = append(removed, owner)
+		}
+	}
+
+	sort.Strings(removed)
+
+	slots, err := consistent_hashing.MoveSlots(cfg.Slots, added, removed, cfg.Weights)
+	if err != nil {
+		log.Fatal().Msgf("Invalid hosts to reshard from: %v", err)
+	}
+
+	cfg.Slots = slots
+
+	return cfg
+}
+
+func newRedisProxy(redises map[string]proto.RedisClient, router consistent_hashing.Router) *proto.RedisProxy {
+	proxy, err := proto.NewRedisProxyWithRouter(redises, router)
+	if err != nil {
+		log.Fatal().Msgf("Invalid routing: %v", err)
+	}
+
+	return proxy
 }
@@ -0,0 +1,408 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"gopkg.in/yaml.v3"
+
+	"github.com/kgantsov/redproxy/pkg/consistent_hashing"
+)
+
+// Defaults of the settings left out of a config file
+const (
+	DefaultPoolName      = "default"
+	DefaultListen        = ":46379"
+	DefaultMetricsListen = ":9090"
+	DefaultLogLevel      = "debug"
+)
+
+// poolNameRe matches the pool names, they are used in metric labels and in
+// the paths of the admin API
+var poolNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Config describes the pools a proxy serves, like twemproxy's nutcracker.yml:
+//
+//	log_level: info
+//	metrics_listen: ":9090"
+//	pools:
+//	  sessions:
+//	    listen: ":46379"
+//	    distribution: ketama
+//	    servers:
+//	      - shard1=10.0.0.1:6379=2
+//	      - shard2=10.0.0.2:6379
+type Config struct {
+	LogLevel      string `yaml:"log_level"`
+	MetricsListen string `yaml:"metrics_listen"`
+	// AdminToken enables the admin changes, adding and removing nodes and
+	// running migrations. The admin API wants it as a bearer token and the
+	// Redis clients of the pools send it with PROXY AUTH.
+	AdminToken string           `yaml:"admin_token"`
+	Pools      map[string]*Pool `yaml:"pools"`
+}
+
+// Pool is a set of backends served on a listen address
+type Pool struct {
+	Name string `yaml:"-"`
+
+	Listen string `yaml:"listen"`
+	// Servers are listed like the -hosts flag entries, [name=]host:port[=weight]
+	Servers []string `yaml:"servers"`
+
+	// Distribution is the key routing: ring, ketama, jump, rendezvous, maglev
+	// or slots
+	Distribution string `yaml:"distribution"`
+	// Hash is the key hash of the ring distribution, the others ignore it
+	Hash string `yaml:"hash"`
+	// HashTag is "{}" unless set, an empty one disables hash tags
+	HashTag *string `yaml:"hash_tag"`
+	// Slots is the slot table of the slots distribution, split evenly across
+	// the servers unless set. Adding or removing a server at runtime only
+	// moves the slots it takes or gives up.
+	Slots string `yaml:"slots"`
+
+	Passthrough     bool  `yaml:"passthrough"`
+	MaxBulkLen      int64 `yaml:"max_bulk_len"`
+	MaxMultibulkLen int64 `yaml:"max_multibulk_len"`
+
+	// Timeouts of the backend connections, the go-redis defaults when not set
+	DialTimeout  time.Duration `yaml:"dial_timeout"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+
+	// HealthCheckInterval is the time between two PINGs of a backend, 1s
+	// unless set
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"`
+	// AutoEjectHosts takes a backend out of routing after ServerFailureLimit
+	// failed checks in a row, 2 unless set, its keys go to the other backends
+	// until it answers a check again. It is checked again after
+	// ServerRetryTimeout, 30s unless set.
+	AutoEjectHosts     bool          `yaml:"auto_eject_hosts"`
+	ServerFailureLimit int           `yaml:"server_failure_limit"`
+	ServerRetryTimeout time.Duration `yaml:"server_retry_timeout"`
+
+	RedisAuth string     `yaml:"redis_auth"`
+	RedisDB   int        `yaml:"redis_db"`
+	TLS       *TLSConfig `yaml:"tls"`
+
+	// Nodes are the parsed servers, set by Validate
+	Nodes []consistent_hashing.Node `yaml:"-"`
+
+	tlsConfig *tls.Config
+}
+
+// TLSConfig enables TLS to the backends of a pool
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// Default returns the config of a single pool with the default settings and
+// no servers
+func Default() *Config {
+	cfg := &Config{Pools: map[string]*Pool{DefaultPoolName: {}}}
+	cfg.setDefaults()
+
+	return cfg
+}
+
+// Load reads and validates a config file
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// Parse decodes and validates a YAML config, unknown settings are rejected
+func Parse(data []byte) (*Config, error) {
+	cfg := &Config{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, err
+	}
+
+	cfg.setDefaults()
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) setDefaults() {
+	if c.LogLevel == "" {
+		c.LogLevel = DefaultLogLevel
+	}
+
+	if c.MetricsListen == "" {
+		c.MetricsListen = DefaultMetricsListen
+	}
+
+	for name, pool := range c.Pools {
+		if pool == nil {
+			pool = &Pool{}
+			c.Pools[name] = pool
+		}
+
+		pool.Name = name
+
+		if pool.Listen == "" {
+			pool.Listen = DefaultListen
+		}
+
+		if pool.Distribution == "" {
+			pool.Distribution = consistent_hashing.RoutingRing
+		}
+
+		if pool.Hash == "" {
+			pool.Hash = consistent_hashing.HashMD5
+		}
+
+		if pool.HashTag == nil {
+			tag := consistent_hashing.DefaultHashTag
+			pool.HashTag = &tag
+		}
+	}
+}
+
+// PoolNames returns the names of the pools sorted
+func (c *Config) PoolNames() []string {
+	names := make([]string, 0, len(c.Pools))
+
+	for name := range c.Pools {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Validate checks every setting and parses the servers of the pools, it is
+// run again after overriding settings of a loaded config
+func (c *Config) Validate() error {
+	if len(c.Pools) == 0 {
+		return errors.New("no pools are configured")
+	}
+
+	if err := validateAddr(c.MetricsListen); err != nil {
+		return fmt.Errorf("invalid metrics_listen: %w", err)
+	}
+
+	listeners := map[string]string{}
+
+	for _, name := range c.PoolNames() {
+		pool := c.Pools[name]
+
+		if !poolNameRe.MatchString(name) {
+			return fmt.Errorf("invalid pool name '%s', expected letters, digits, '-' or '_'", name)
+		}
+
+		if err := pool.validate(); err != nil {
+			return fmt.Errorf("pool '%s': %w", name, err)
+		}
+
+		if other, ok := listeners[pool.Listen]; ok {
+			return fmt.Errorf("pools '%s' and '%s' both listen on %s", other, name, pool.Listen)
+		}
+
+		if pool.Listen == c.MetricsListen {
+			return fmt.Errorf("pool '%s' listens on the metrics address %s", name, pool.Listen)
+		}
+
+		listeners[pool.Listen] = name
+	}
+
+	return nil
+}
+
+func (p *Pool) validate() error {
+	if err := validateAddr(p.Listen); err != nil {
+		return fmt.Errorf("invalid listen: %w", err)
+	}
+
+	if len(p.Servers) == 0 {
+		return errors.New("no servers are configured")
+	}
+
+	nodes := []consistent_hashing.Node{}
+	names := map[string]bool{}
+
+	for _, server := range p.Servers {
+		parsed, err := consistent_hashing.ParseNodes(server)
+		if err != nil {
+			return err
+		}
+
+		if len(parsed) != 1 {
+			return fmt.Errorf("invalid node '%s', expected one server per entry", server)
+		}
+
+		if names[parsed[0].Name] {
+			return fmt.Errorf("node '%s' is listed more than once", parsed[0].Name)
+		}
+
+		names[parsed[0].Name] = true
+		nodes = append(nodes, parsed[0])
+	}
+
+	p.Nodes = nodes
+
+	if err := consistent_hashing.ValidateHashTag(*p.HashTag); err != nil {
+		return err
+	}
+
+	if p.MaxBulkLen < 0 || p.MaxMultibulkLen < 0 {
+		return errors.New("max_bulk_len and max_multibulk_len can't be negative")
+	}
+
+	if p.DialTimeout < 0 || p.ReadTimeout < 0 || p.WriteTimeout < 0 {
+		return errors.New("timeouts can't be negative")
+	}
+
+	if p.HealthCheckInterval < 0 || p.ServerRetryTimeout < 0 {
+		return errors.New("health_check_interval and server_retry_timeout can't be negative")
+	}
+
+	if p.ServerFailureLimit < 0 {
+		return errors.New("server_failure_limit can't be negative")
+	}
+
+	if _, err := p.Router(); err != nil {
+		return err
+	}
+
+	tlsConfig, err := p.TLS.load()
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+
+	p.tlsConfig = tlsConfig
+
+	return nil
+}
+
+// RouterConfig describes the router of the pool, with its slot table if one
+// is set
+func (p *Pool) RouterConfig() (consistent_hashing.RouterConfig, error) {
+	nodes, weights := consistent_hashing.NodeNames(p.Nodes)
+
+	cfg := consistent_hashing.RouterConfig{
+		Routing: p.Distribution,
+		Nodes:   nodes,
+		Weights: weights,
+		Hash:    p.Hash,
+	}
+
+	if p.Distribution == consistent_hashing.RoutingSlots && p.Slots != "" {
+		ranges, err := consistent_hashing.ParseSlotRanges(p.Slots)
+		if err != nil {
+			return cfg, err
+		}
+
+		cfg.Slots = ranges
+	}
+
+	return cfg, nil
+}
+
+// Router builds the router of the pool
+func (p *Pool) Router() (consistent_hashing.Router, error) {
+	cfg, err := p.RouterConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return consistent_hashing.NewRouterFromConfig(cfg)
+}
+
+// RedisOptions returns the options of a client of a backend of the pool
+func (p *Pool) RedisOptions(addr string) *redis.Options {
+	return &redis.Options{
+		Addr:         addr,
+		Password:     p.RedisAuth,
+		DB:           p.RedisDB,
+		DialTimeout:  p.DialTimeout,
+		ReadTimeout:  p.ReadTimeout,
+		WriteTimeout: p.WriteTimeout,
+		TLSConfig:    p.tlsConfig,
+	}
+}
+
+func (t *TLSConfig) load() (*tls.Config, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if t.CAFile != "" {
+		ca, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+		}
+	}
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, errors.New("cert_file and key_file have to be set together")
+	}
+
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// validateAddr checks a listen address like ":9090" or "127.0.0.1:46379"
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kgantsov/redproxy/pkg/consistent_hashing"
+)
+
+func TestConfigParse(t *testing.T) {
+	cfg, err := Parse([]byte(`
+log_level: info
+metrics_listen: "127.0.0.1:9100"
+admin_token: token
+pools:
+  sessions:
+    listen: ":6000"
+    distribution: slots
+    slots: 0-100=shard1,101-16383=shard2
+    hash_tag: ""
+    passthrough: true
+    max_bulk_len: 1048576
+    read_timeout: 250ms
+    redis_auth: secret
+    redis_db: 2
+    auto_eject_hosts: true
+    server_failure_limit: 3
+    server_retry_timeout: 10s
+    servers:
+      - shard1=10.0.0.1:6379=2
+      - shard2=10.0.0.2:6379
+`))
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, "info", cfg.LogLevel)
+	assert.Equal(t, "127.0.0.1:9100", cfg.MetricsListen)
+	assert.Equal(t, "token", cfg.AdminToken)
+	assert.Equal(t, []string{"sessions"}, cfg.PoolNames())
+
+	pool := cfg.Pools["sessions"]
+	assert.Equal(t, "sessions", pool.Name)
+	assert.Equal(t, ":6000", pool.Listen)
+	assert.Equal(t, "", *pool.HashTag)
+	assert.Equal(t, consistent_hashing.HashMD5, pool.Hash)
+	assert.True(t, pool.Passthrough)
+	assert.Equal(t, int64(1048576), pool.MaxBulkLen)
+	assert.True(t, pool.AutoEjectHosts)
+	assert.Equal(t, 3, pool.ServerFailureLimit)
+	assert.Equal(t, 10*time.Second, pool.ServerRetryTimeout)
+	assert.Equal(t, []consistent_hashing.Node{
+		{Name: "shard1", Addr: "10.0.0.1:6379", Weight: 2},
+		{Name: "shard2", Addr: "10.0.0.2:6379", Weight: 1},
+	}, pool.Nodes)
+
+	router, err := pool.Router()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"shard1", "shard2"}, router.Nodes())
+
+	// the slot table is kept for membership changes
+	routerConfig, err := pool.RouterConfig()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []consistent_hashing.SlotRange{
+		{Start: 0, End: 100, Node: "shard1"},
+		{Start: 101, End: 16383, Node: "shard2"},
+	}, routerConfig.Slots)
+
+	options := pool.RedisOptions("10.0.0.1:6379")
+	assert.Equal(t, "10.0.0.1:6379", options.Addr)
+	assert.Equal(t, "secret", options.Password)
+	assert.Equal(t, 2, options.DB)
+	assert.Equal(t, 250*time.Millisecond, options.ReadTimeout)
+	assert.Equal(t, time.Duration(0), options.WriteTimeout)
+}
+
+func TestConfigDefaults(t *testing.T) {
+	cfg, err := Parse([]byte(`
+pools:
+  cache:
+    servers: [redis-1:6379]
+`))
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, DefaultLogLevel, cfg.LogLevel)
+	assert.Equal(t, DefaultMetricsListen, cfg.MetricsListen)
+
+	pool := cfg.Pools["cache"]
+	assert.Equal(t, DefaultListen, pool.Listen)
+	assert.Equal(t, consistent_hashing.RoutingRing, pool.Distribution)
+	assert.Equal(t, consistent_hashing.DefaultHashTag, *pool.HashTag)
+
+	cfg = Default()
+	assert.EqualError(t, cfg.Validate(), "pool 'default': no servers are configured")
+
+	cfg.Pools[DefaultPoolName].Servers = []string{"redis-1:6379"}
+	assert.Equal(t, nil, cfg.Validate())
+}
+
+func TestConfigExampleFile(t *testing.T) {
+	cfg, err := Load("../../conf/redproxy.yml")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"page_cache", "sessions"}, cfg.PoolNames())
+	assert.Equal(t, 3, len(cfg.Pools["sessions"].Nodes))
+
+	_, err = Load("missing.yml")
+	assert.EqualError(t, err, "open missing.yml: no such file or directory")
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{config: `log_level: info`, want: "no pools are configured"},
+		{config: "pools:\n  a/b:\n    servers: [r:1]", want: "invalid pool name 'a/b', expected letters, digits, '-' or '_'"},
+		{
+			config: "pools:\n  a:\n    servers: [redis:6379]\n    timeout: 1s",
+			want:   "yaml: unmarshal errors:\n  line 4: field timeout not found in type config.Pool",
+		},
+		{config: "pools:\n  a:\n    listen: localhost\n    servers: [redis:6379]", want: "pool 'a': invalid listen: address localhost: missing port in address"},
+		{config: "pools:\n  a:\n    servers: []", want: "pool 'a': no servers are configured"},
+		{config: "pools:\n  a:\n    servers: ['a=b=c=d']", want: "pool 'a': invalid node 'a=b=c=d', expected [name=]host:port[=weight]"},
+		{config: "pools:\n  a:\n    servers: ['r:1,r:2']", want: "pool 'a': invalid node 'r:1,r:2', expected one server per entry"},
+		{config: "pools:\n  a:\n    servers: [r:1, r:1]", want: "pool 'a': node 'r:1' is listed more than once"},
+		{config: "pools:\n  a:\n    servers: [r:1]\n    distribution: modula", want: "pool 'a': unknown routing 'modula'"},
+		{config: "pools:\n  a:\n    servers: [r:1]\n    hash: crc32", want: "pool 'a': unknown hash 'crc32'"},
+		{config: "pools:\n  a:\n    servers: [r:1]\n    hash_tag: '{'", want: "pool 'a': invalid hash tag '{', expected two delimiters like {}"},
+		{
+			config: "pools:\n  a:\n    servers: [r:1]\n    distribution: slots\n    slots: 0-10=r:1",
+			want:   "pool 'a': slot 11 is not assigned to any node",
+		},
+		{config: "pools:\n  a:\n    servers: [r:1]\n    read_timeout: -1s", want: "pool 'a': timeouts can't be negative"},
+		{
+			config: "pools:\n  a:\n    servers: [r:1]\n    server_retry_timeout: -1s",
+			want:   "pool 'a': health_check_interval and server_retry_timeout can't be negative",
+		},
+		{config: "pools:\n  a:\n    servers: [r:1]\n    server_failure_limit: -1", want: "pool 'a': server_failure_limit can't be negative"},
+		{
+			config: "pools:\n  a:\n    servers: [r:1]\n    tls:\n      cert_file: client.pem",
+			want:   "pool 'a': tls: cert_file and key_file have to be set together",
+		},
+		{
+			config: "pools:\n  a:\n    servers: [r:1]\n    tls:\n      ca_file: missing.pem",
+			want:   "pool 'a': tls: open missing.pem: no such file or directory",
+		},
+		{
+			config: "pools:\n  a:\n    servers: [r:1]\n  b:\n    servers: [r:2]",
+			want:   "pools 'a' and 'b' both listen on :46379",
+		},
+		{
+			config: "metrics_listen: ':46379'\npools:\n  a:\n    servers: [r:1]",
+			want:   "pool 'a' listens on the metrics address :46379",
+		},
+	}
+
+	for _, tc := range tests {
+		_, err := Parse([]byte(tc.config))
+		assert.EqualError(t, err, tc.want, tc.config)
+	}
+}
@@ -7,35 +7,53 @@ import (
 	"sort"
 )
 
+// ringPoint is a point of the ring owned by a node
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
 type ConsistentHashing struct {
-	nodeMap        map[string]string
-	nodes          []string
-	nodePartitions []string
-	partitions     int
+	nodes      []string
+	points     []ringPoint
+	partitions int
+	hash       HashFunc
+	weights    map[string]int
 }
 
 func NewConsistentHashing(nodes []string, partitions int) *ConsistentHashing {
-	var nodePartitions []string
+	return NewWeightedConsistentHashing(nodes, nil, partitions)
+}
 
-	nodeMap := make(map[string]string)
+// NewWeightedConsistentHashing gives every node partitions times its weight
+// points on the ring, nodes without a weight count as 1
+func NewWeightedConsistentHashing(nodes []string, weights map[string]int, partitions int) *ConsistentHashing {
+	return NewConsistentHashingWithHash(nodes, weights, partitions, md5Hash64)
+}
 
-	for partition := 0; partition < partitions; partition++ {
-		for _, node := range nodes {
-			hash := GetMD5Hash(fmt.Sprintf("%d-%s", partition, node))
-			nodePartitions = append(nodePartitions, hash)
-			nodeMap[hash] = node
+// NewConsistentHashingWithHash builds a ring placing the points and the keys
+// with the given hash function
+func NewConsistentHashingWithHash(
+	nodes []string, weights map[string]int, partitions int, hash HashFunc,
+) *ConsistentHashing {
+	var points []ringPoint
+
+	for _, node := range nodes {
+		for partition := 0; partition < partitions*weightOf(weights, node); partition++ {
+			points = append(points, ringPoint{hash: hash(fmt.Sprintf("%d-%s", partition, node)), node: node})
 		}
 	}
 
-	sort.Slice(nodePartitions, func(i, j int) bool {
-		return nodePartitions[i] < nodePartitions[j]
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
 	})
 
 	ch := &ConsistentHashing{
-		nodes:          nodes,
-		partitions:     partitions,
-		nodePartitions: nodePartitions,
-		nodeMap:        nodeMap,
+		nodes:      nodes,
+		partitions: partitions,
+		points:     points,
+		hash:       hash,
+		weights:    weights,
 	}
 
 	return ch
@@ -49,18 +67,31 @@ func GetMD5Hash(text string) string {
 }
 
 func (ch *ConsistentHashing) GetNode(key string) string {
-	keyHash := GetMD5Hash(key)
-
-	partitionIndex := sort.Search(
-		len(ch.nodePartitions),
-		func(i int) bool { return ch.nodePartitions[i] >= keyHash },
-	)
-	if partitionIndex == len(ch.nodePartitions) {
-		partitionIndex = 0
+	keyHash := ch.hash(key)
+
+	// the first point at or after the key, wrapping around the ring
+	lo, hi := 0, len(ch.points)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+
+		if ch.points[mid].hash < keyHash {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	if lo == len(ch.points) {
+		lo = 0
 	}
 
-	nodePartition := ch.nodePartitions[partitionIndex]
-	node := ch.nodeMap[nodePartition]
+	return ch.points[lo].node
+}
+
+func (ch *ConsistentHashing) Weight(node string) int {
+	return weightOf(ch.weights, node)
+}
 
-	return node
+func (ch *ConsistentHashing) Nodes() []string {
+	return ch.nodes
 }
@@ -2,6 +2,7 @@ package consistent_hashing
 
 import (
 	"fmt"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -31,3 +32,113 @@ func BenchmarkConsistentHashing(b *testing.B) {
 		ch.GetNode(fmt.Sprintf("key_%d", i))
 	}
 }
+
+// legacyRing is the ring as it was before integer points, comparing hex
+// encoded MD5 digests, kept to check placement compatibility and to compare
+// the lookup cost
+type legacyRing struct {
+	nodeMap        map[string]string
+	nodePartitions []string
+}
+
+func newLegacyRing(nodes []string, partitions int) *legacyRing {
+	r := &legacyRing{nodeMap: map[string]string{}}
+
+	for partition := 0; partition < partitions; partition++ {
+		for _, node := range nodes {
+			hash := GetMD5Hash(fmt.Sprintf("%d-%s", partition, node))
+			r.nodePartitions = append(r.nodePartitions, hash)
+			r.nodeMap[hash] = node
+		}
+	}
+
+	sort.Strings(r.nodePartitions)
+
+	return r
+}
+
+func (r *legacyRing) GetNode(key string) string {
+	keyHash := GetMD5Hash(key)
+
+	i := sort.Search(len(r.nodePartitions), func(i int) bool { return r.nodePartitions[i] >= keyHash })
+	if i == len(r.nodePartitions) {
+		i = 0
+	}
+
+	return r.nodeMap[r.nodePartitions[i]]
+}
+
+func TestConsistentHashingMD5Compatibility(t *testing.T) {
+	nodes := []string{"redis-1:6379", "redis-2:6380", "redis-3:6381", "redis-4:6382"}
+
+	for _, partitions := range []int{10, 160} {
+		legacy := newLegacyRing(nodes, partitions)
+		ch := NewConsistentHashing(nodes, partitions)
+
+		for i := 0; i < 100000; i++ {
+			key := fmt.Sprintf("key_%d", i)
+
+			if legacy.GetNode(key) != ch.GetNode(key) {
+				assert.Fail(t, "placement differs from the MD5 hex ring", key)
+				break
+			}
+		}
+	}
+}
+
+func TestConsistentHashingWithHash(t *testing.T) {
+	nodes := []string{"host-0", "host-1", "host-2"}
+
+	for _, name := range []string{HashMD5, HashFNV1a, HashXXHash} {
+		hash, err := NewHashFunc(name)
+		assert.Equal(t, nil, err)
+
+		ch := NewConsistentHashingWithHash(nodes, nil, 160, hash)
+
+		counts := map[string]int{}
+		for i := 0; i < 30000; i++ {
+			counts[ch.GetNode(fmt.Sprintf("key_%d", i))]++
+		}
+
+		for _, node := range nodes {
+			assert.InDelta(t, 10000, counts[node], 1500, fmt.Sprintf("%s keys of %s", name, node))
+		}
+	}
+
+	_, err := NewHashFunc("crc32")
+	assert.EqualError(t, err, "unknown hash 'crc32'")
+}
+
+func BenchmarkConsistentHashingLookup(b *testing.B) {
+	nodes := []string{"redis-1:6379", "redis-2:6380", "redis-3:6381", "redis-4:6382"}
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%d:profile", i)
+	}
+
+	routers := []struct {
+		name   string
+		router interface{ GetNode(string) string }
+	}{
+		{name: "md5-hex-legacy", router: newLegacyRing(nodes, 160)},
+	}
+
+	for _, name := range []string{HashMD5, HashFNV1a, HashXXHash} {
+		hash, _ := NewHashFunc(name)
+		routers = append(routers, struct {
+			name   string
+			router interface{ GetNode(string) string }
+		}{name: name, router: NewConsistentHashingWithHash(nodes, nil, 160, hash)})
+	}
+
+	for _, r := range routers {
+		b.Run(r.name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				r.router.GetNode(keys[i%len(keys)])
+			}
+		})
+	}
+}
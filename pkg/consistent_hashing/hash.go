@@ -0,0 +1,74 @@
+package consistent_hashing
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Hash functions of the ring accepted by NewHashFunc
+const (
+	// HashMD5 places nodes and keys like the original ring did with hex
+	// encoded MD5 digests, so existing data stays where it is
+	HashMD5 = "md5"
+	// HashFNV1a is the 64 bit FNV-1a hash followed by the murmur3 finalizer,
+	// as the high bits of plain FNV cluster similar keys on the ring
+	HashFNV1a = "fnv1a"
+	// HashXXHash is the 64 bit xxHash, the fastest of them
+	HashXXHash = "xxhash"
+)
+
+// HashFunc hashes a key or the name of a ring point to 64 bits
+type HashFunc func(key string) uint64
+
+// NewHashFunc returns the hash function of the given name, MD5 if empty
+func NewHashFunc(name string) (HashFunc, error) {
+	switch name {
+	case HashMD5, "":
+		return md5Hash64, nil
+	case HashFNV1a:
+		return mixedHash64, nil
+	case HashXXHash:
+		return xxhash.Sum64String, nil
+	default:
+		return nil, fmt.Errorf("unknown hash '%s'", name)
+	}
+}
+
+// md5Hash64 returns the first 64 bits of the MD5 digest of a key. They sort
+// like the hex encoded digest as long as two digests don't share them.
+func md5Hash64(key string) uint64 {
+	digest := md5.Sum([]byte(key))
+
+	return binary.BigEndian.Uint64(digest[:8])
+}
+
+// hash64 is the 64 bit FNV-1a hash of a string
+func hash64(s string) uint64 {
+	h := uint64(14695981039346656037)
+
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+
+	return h
+}
+
+func mixedHash64(s string) uint64 {
+	return mix64(hash64(s))
+}
+
+// mix64 is the murmur3 finalizer, spreading the bits of a FNV hash that is
+// used as a score or a random seed
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
@@ -0,0 +1,338 @@
+package consistent_hashing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SlotCount is the number of hash slots of a Redis Cluster
+const SlotCount = 16384
+
+// SlotRange assigns the slots from Start to End, both included, to a node
+type SlotRange struct {
+	Start int
+	End   int
+	Node  string
+}
+
+// HashSlots routes keys the way Redis Cluster does: a key belongs to the
+// slot CRC16(key) mod 16384 and every slot is assigned to a node, so keys
+// land on the same node as with any cluster aware client.
+type HashSlots struct {
+	nodes []string
+	slots [SlotCount]uint16
+}
+
+// NewHashSlots splits the slots into contiguous ranges of the same size, one
+// per node in the given order, like redis-cli --cluster create does
+func NewHashSlots(nodes []string) *HashSlots {
+	return NewWeightedHashSlots(nodes, nil)
+}
+
+// NewWeightedHashSlots splits the slots into contiguous ranges with sizes
+// proportional to the weights of the nodes
+func NewWeightedHashSlots(nodes []string, weights map[string]int) *HashSlots {
+	totalWeight := 0
+	for _, node := range nodes {
+		totalWeight += weightOf(weights, node)
+	}
+
+	ranges := make([]SlotRange, 0, len(nodes))
+	slotsPerWeight := float64(SlotCount) / float64(totalWeight)
+	start := 0
+	cumulativeWeight := 0
+
+	for i, node := range nodes {
+		cumulativeWeight += weightOf(weights, node)
+
+		end := int(math.Round(float64(cumulativeWeight)*slotsPerWeight - 1))
+		if i == len(nodes)-1 {
+			end = SlotCount - 1
+		}
+
+		ranges = append(ranges, SlotRange{Start: start, End: end, Node: node})
+		start = end + 1
+	}
+
+	hs, _ := NewHashSlotsFromRanges(ranges)
+
+	return hs
+}
+
+// NewHashSlotsFromRanges builds a slot table from explicit ranges, every slot
+// must be assigned to exactly one node
+func NewHashSlotsFromRanges(ranges []SlotRange) (*HashSlots, error) {
+	hs := &HashSlots{}
+
+	var assigned [SlotCount]bool
+
+	nodeIndexes := map[string]uint16{}
+
+	for _, r := range ranges {
+		if r.Start < 0 || r.End >= SlotCount || r.Start > r.End {
+			return nil, fmt.Errorf("invalid slot range %d-%d", r.Start, r.End)
+		}
+
+		index, ok := nodeIndexes[r.Node]
+		if !ok {
+			index = uint16(len(hs.nodes))
+			nodeIndexes[r.Node] = index
+			hs.nodes = append(hs.nodes, r.Node)
+		}
+
+		for slot := r.Start; slot <= r.End; slot++ {
+			if assigned[slot] {
+				return nil, fmt.Errorf("slot %d is assigned more than once", slot)
+			}
+
+			assigned[slot] = true
+			hs.slots[slot] = index
+		}
+	}
+
+	for slot, ok := range assigned {
+		if !ok {
+			return nil, fmt.Errorf("slot %d is not assigned to any node", slot)
+		}
+	}
+
+	return hs, nil
+}
+
+// MoveSlots changes the nodes of a slot table moving as few slots as possible.
+// The slots of the removed nodes are shared between the remaining ones by
+// weight, then the added nodes take their share by weight from the others in
+// proportion to the slots each one has. No other slot changes its node.
+func MoveSlots(ranges []SlotRange, added, removed []string, weights map[string]int) ([]SlotRange, error) {
+	hs, err := NewHashSlotsFromRanges(ranges)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make([]string, SlotCount)
+	for slot, index := range hs.slots {
+		owners[slot] = hs.nodes[index]
+	}
+
+	isRemoved := map[string]bool{}
+	for _, node := range removed {
+		isRemoved[node] = true
+	}
+
+	remaining := []string{}
+	orphans := []int{}
+
+	for _, node := range hs.nodes {
+		if !isRemoved[node] {
+			remaining = append(remaining, node)
+		}
+	}
+
+	for slot, owner := range owners {
+		if isRemoved[owner] {
+			orphans = append(orphans, slot)
+		}
+	}
+
+	// without remaining nodes the added ones take every slot
+	if len(remaining) == 0 {
+		remaining, added = added, nil
+	}
+
+	if len(remaining) == 0 {
+		return nil, errors.New("no node is left to own the slots")
+	}
+
+	assignSlots(owners, orphans, remaining, weightsOf(remaining, weights))
+
+	if len(added) > 0 {
+		counts := map[string]int{}
+		for _, owner := range owners {
+			counts[owner]++
+		}
+
+		slotCounts := []int{}
+		totalWeight := 0
+
+		for _, node := range remaining {
+			slotCounts = append(slotCounts, counts[node])
+			totalWeight += weightOf(weights, node)
+		}
+
+		addedWeight := 0
+		for _, node := range added {
+			addedWeight += weightOf(weights, node)
+		}
+
+		wanted := int(math.Round(float64(SlotCount*addedWeight) / float64(totalWeight+addedWeight)))
+		taken := []int{}
+
+		// every node gives up its last slots
+		for i, share := range shares(wanted, slotCounts) {
+			for slot := SlotCount - 1; slot >= 0 && share > 0; slot-- {
+				if owners[slot] == remaining[i] {
+					taken = append(taken, slot)
+					share--
+				}
+			}
+		}
+
+		sort.Ints(taken)
+		assignSlots(owners, taken, added, weightsOf(added, weights))
+	}
+
+	return rangesOf(owners), nil
+}
+
+// assignSlots gives the nodes contiguous runs of the slots sized by weight
+func assignSlots(owners []string, slots []int, nodes []string, weights []int) {
+	for i, share := range shares(len(slots), weights) {
+		for _, slot := range slots[:share] {
+			owners[slot] = nodes[i]
+		}
+
+		slots = slots[share:]
+	}
+}
+
+// shares splits a total in proportion to the weights, the shares add up to it
+func shares(total int, weights []int) []int {
+	sum := 0
+	for _, weight := range weights {
+		sum += weight
+	}
+
+	result := make([]int, len(weights))
+	cumulative := 0
+	given := 0
+
+	for i, weight := range weights {
+		cumulative += weight
+		end := int(math.Round(float64(total) * float64(cumulative) / float64(sum)))
+		result[i] = end - given
+		given = end
+	}
+
+	return result
+}
+
+func weightsOf(nodes []string, weights map[string]int) []int {
+	result := make([]int, len(nodes))
+	for i, node := range nodes {
+		result[i] = weightOf(weights, node)
+	}
+
+	return result
+}
+
+// rangesOf merges the consecutive slots of a node into ranges
+func rangesOf(owners []string) []SlotRange {
+	ranges := []SlotRange{}
+
+	for slot, owner := range owners {
+		if len(ranges) > 0 && ranges[len(ranges)-1].Node == owner {
+			ranges[len(ranges)-1].End = slot
+			continue
+		}
+
+		ranges = append(ranges, SlotRange{Start: slot, End: slot, Node: owner})
+	}
+
+	return ranges
+}
+
+// ParseSlotRanges parses a slot table like "0-8191=host-0:6379,8192-16383=host-1:6379",
+// a range may also be a single slot
+func ParseSlotRanges(table string) ([]SlotRange, error) {
+	ranges := []SlotRange{}
+
+	for _, entry := range strings.Split(table, ",") {
+		slots, node, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || node == "" {
+			return nil, fmt.Errorf("invalid slot range '%s', expected start-end=node", entry)
+		}
+
+		startStr, endStr, isRange := strings.Cut(slots, "-")
+		if !isRange {
+			endStr = startStr
+		}
+
+		start, err := strconv.Atoi(startStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid slot range '%s': %w", entry, err)
+		}
+
+		end, err := strconv.Atoi(endStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid slot range '%s': %w", entry, err)
+		}
+
+		ranges = append(ranges, SlotRange{Start: start, End: end, Node: node})
+	}
+
+	return ranges, nil
+}
+
+// Weight returns the number of slots of a node, which is what its share of
+// the keys is proportional to
+func (hs *HashSlots) Weight(node string) int {
+	weight := 0
+
+	for _, index := range hs.slots {
+		if hs.nodes[index] == node {
+			weight++
+		}
+	}
+
+	return weight
+}
+
+// Nodes returns the nodes owning at least one slot
+func (hs *HashSlots) Nodes() []string {
+	return hs.nodes
+}
+
+func (hs *HashSlots) GetNode(key string) string {
+	return hs.nodes[hs.slots[KeySlot(key)]]
+}
+
+// KeySlot returns the Redis Cluster hash slot of a key
+func KeySlot(key string) int {
+	return int(crc16(key) % SlotCount)
+}
+
+// crc16Table is the lookup table of the CRC16-CCITT (XMODEM) polynomial used
+// by Redis Cluster
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+
+	for i := range table {
+		crc := uint16(i) << 8
+
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+
+		table[i] = crc
+	}
+
+	return table
+}()
+
+func crc16(key string) uint16 {
+	var crc uint16
+
+	for i := 0; i < len(key); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^key[i]]
+	}
+
+	return crc
+}
@@ -0,0 +1,156 @@
+package consistent_hashing
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		// CLUSTER KEYSLOT replies of a real Redis
+		{key: "123456789", want: 12739},
+		{key: "foo", want: 12182},
+		{key: "bar", want: 5061},
+		{key: "hello", want: 866},
+		{key: "somekey", want: 11058},
+		{key: "", want: 0},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, KeySlot(tc.key), tc.key)
+	}
+}
+
+func TestHashSlotsGetNode(t *testing.T) {
+	hs := NewHashSlots([]string{"host-0", "host-1", "host-2"})
+
+	// the ranges of redis-cli --cluster create for three masters
+	assert.Equal(t, "host-0", hs.nodes[hs.slots[0]], "they should be equal")
+	assert.Equal(t, "host-0", hs.nodes[hs.slots[5460]], "they should be equal")
+	assert.Equal(t, "host-1", hs.nodes[hs.slots[5461]], "they should be equal")
+	assert.Equal(t, "host-1", hs.nodes[hs.slots[10922]], "they should be equal")
+	assert.Equal(t, "host-2", hs.nodes[hs.slots[10923]], "they should be equal")
+	assert.Equal(t, "host-2", hs.nodes[hs.slots[16383]], "they should be equal")
+
+	assert.Equal(t, "host-0", hs.GetNode("hello"), "they should be equal")
+	assert.Equal(t, "host-0", hs.GetNode("bar"), "they should be equal")
+	assert.Equal(t, "host-2", hs.GetNode("foo"), "they should be equal")
+	assert.Equal(t, "host-2", hs.GetNode("somekey"), "they should be equal")
+}
+
+func TestHashSlotsFromRanges(t *testing.T) {
+	ranges, err := ParseSlotRanges("0-999=host-1:6379, 1000=host-0:6379,1001-16383=host-1:6379")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []SlotRange{
+		{Start: 0, End: 999, Node: "host-1:6379"},
+		{Start: 1000, End: 1000, Node: "host-0:6379"},
+		{Start: 1001, End: 16383, Node: "host-1:6379"},
+	}, ranges)
+
+	hs, err := NewHashSlotsFromRanges(ranges)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"host-1:6379", "host-0:6379"}, hs.Nodes())
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key_%d", i)
+
+		want := "host-1:6379"
+		if KeySlot(key) == 1000 {
+			want = "host-0:6379"
+		}
+
+		assert.Equal(t, want, hs.GetNode(key), key)
+	}
+}
+
+func TestHashSlotsInvalidRanges(t *testing.T) {
+	tests := []struct {
+		table string
+		want  string
+	}{
+		{table: "0-16383", want: "invalid slot range '0-16383', expected start-end=node"},
+		{table: "a-16383=host", want: "invalid slot range 'a-16383=host': strconv.Atoi: parsing \"a\": invalid syntax"},
+		{table: "0-16384=host", want: "invalid slot range 0-16384"},
+		{table: "10-5=host", want: "invalid slot range 10-5"},
+		{table: "0-100=a,100-16383=b", want: "slot 100 is assigned more than once"},
+		{table: "0-100=a,102-16383=b", want: "slot 101 is not assigned to any node"},
+	}
+
+	for _, tc := range tests {
+		ranges, err := ParseSlotRanges(tc.table)
+		if err == nil {
+			_, err = NewHashSlotsFromRanges(ranges)
+		}
+
+		assert.EqualError(t, err, tc.want, tc.table)
+	}
+}
+
+func TestMoveSlots(t *testing.T) {
+	tests := []struct {
+		table   string
+		added   []string
+		removed []string
+		weights map[string]int
+		want    string
+	}{
+		{
+			// the new node takes a third of the slots, half of them from each node
+			table: "0-8191=a,8192-16383=b",
+			added: []string{"c"},
+			want:  "0-5460=a,5461-8191=c,8192-13653=b,13654-16383=c",
+		},
+		{
+			// and in proportion to the slots of the nodes when they differ
+			table:   "0-999=a,1000-16383=b",
+			added:   []string{"c"},
+			weights: map[string]int{"c": 2},
+			want:    "0-499=a,500-999=c,1000-8691=b,8692-16383=c",
+		},
+		{
+			table:   "0-999=a,1000-9999=b,10000-16383=c",
+			removed: []string{"a"},
+			want:    "0-499=b,500-999=c,1000-9999=b,10000-16383=c",
+		},
+		{
+			table:   "0-999=a,1000-9999=b,10000-16383=c",
+			removed: []string{"a", "c"},
+			want:    "0-16383=b",
+		},
+		{
+			table:   "0-999=a,1000-16383=b",
+			added:   []string{"c", "d"},
+			removed: []string{"a", "b"},
+			want:    "0-8191=c,8192-16383=d",
+		},
+	}
+
+	for _, tc := range tests {
+		ranges, err := ParseSlotRanges(tc.table)
+		assert.Equal(t, nil, err)
+
+		want, err := ParseSlotRanges(tc.want)
+		assert.Equal(t, nil, err)
+
+		moved, err := MoveSlots(ranges, tc.added, tc.removed, tc.weights)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, want, moved, tc.table)
+	}
+
+	ranges, _ := ParseSlotRanges("0-16383=a")
+	_, err := MoveSlots(ranges, nil, []string{"a"}, nil)
+	assert.EqualError(t, err, "no node is left to own the slots")
+}
+
+func BenchmarkHashSlots(b *testing.B) {
+	hs := NewHashSlots([]string{"host-0", "host-1", "host-2"})
+
+	for i := 0; i < b.N; i++ {
+		hs.GetNode(fmt.Sprintf("key_%d", i))
+	}
+}
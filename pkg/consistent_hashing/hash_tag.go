@@ -0,0 +1,41 @@
+package consistent_hashing
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultHashTag is the hash tag of Redis Cluster, {user1000}.following and
+// {user1000}.followers are routed by user1000 only and so land on one node
+const DefaultHashTag = "{}"
+
+// ValidateHashTag checks a hash tag is either empty, disabling hash tags, or
+// made of an opening and a closing delimiter like twemproxy's hash_tag
+func ValidateHashTag(tag string) error {
+	if tag != "" && len(tag) != 2 {
+		return fmt.Errorf("invalid hash tag '%s', expected two delimiters like {}", tag)
+	}
+
+	return nil
+}
+
+// HashTagKey returns the part of the key that is hashed: the content between
+// the first opening delimiter and the next closing one, or the whole key when
+// there is no such non empty part
+func HashTagKey(key string, tag string) string {
+	if tag == "" {
+		return key
+	}
+
+	start := strings.IndexByte(key, tag[0])
+	if start < 0 {
+		return key
+	}
+
+	end := strings.IndexByte(key[start+1:], tag[1])
+	if end <= 0 {
+		return key
+	}
+
+	return key[start+1 : start+1+end]
+}
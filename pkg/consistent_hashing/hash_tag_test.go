@@ -0,0 +1,55 @@
+package consistent_hashing
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashTagKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		tag  string
+		want string
+	}{
+		{key: "user:{42}:profile", tag: "{}", want: "42"},
+		{key: "{user1000}.following", tag: "{}", want: "user1000"},
+		{key: "foo{}{bar}", tag: "{}", want: "foo{}{bar}"},
+		{key: "foo{{bar}}zap", tag: "{}", want: "{bar"},
+		{key: "foo{bar}{zap}", tag: "{}", want: "bar"},
+		{key: "foo{bar", tag: "{}", want: "foo{bar"},
+		{key: "foo}bar{", tag: "{}", want: "foo}bar{"},
+		{key: "plain", tag: "{}", want: "plain"},
+		{key: "user:{42}:profile", tag: "", want: "user:{42}:profile"},
+		{key: "user:[42]:profile", tag: "[]", want: "42"},
+		{key: "user:{42}:profile", tag: "[]", want: "user:{42}:profile"},
+		{key: "user:$42$:profile", tag: "$$", want: "42"},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, HashTagKey(tc.key, tc.tag), fmt.Sprintf("%s with %s", tc.key, tc.tag))
+	}
+}
+
+func TestValidateHashTag(t *testing.T) {
+	assert.Equal(t, nil, ValidateHashTag("{}"))
+	assert.Equal(t, nil, ValidateHashTag(""))
+	assert.EqualError(t, ValidateHashTag("{"), "invalid hash tag '{', expected two delimiters like {}")
+}
+
+func TestHashTagColocation(t *testing.T) {
+	ch := NewConsistentHashing([]string{"host-0", "host-1", "host-2"}, 10)
+	hs := NewHashSlots([]string{"host-0", "host-1", "host-2"})
+
+	for i := 0; i < 100; i++ {
+		profile := HashTagKey(fmt.Sprintf("user:{%d}:profile", i), DefaultHashTag)
+		sessions := HashTagKey(fmt.Sprintf("user:{%d}:sessions", i), DefaultHashTag)
+
+		assert.Equal(t, ch.GetNode(profile), ch.GetNode(sessions), "they should be equal")
+		assert.Equal(t, hs.GetNode(profile), hs.GetNode(sessions), "they should be equal")
+	}
+
+	// same slot as CLUSTER KEYSLOT {user1000}.following on a real Redis
+	assert.Equal(t, 3443, KeySlot(HashTagKey("{user1000}.following", DefaultHashTag)))
+}
@@ -0,0 +1,53 @@
+package consistent_hashing
+
+// JumpHash is the jump consistent hash of Lamping and Veach. It needs no
+// memory and balances perfectly, but nodes are numbered: only adding or
+// removing the last node moves the minimum of keys.
+type JumpHash struct {
+	nodes []string
+	// buckets lists every node as many times as its weight
+	buckets []string
+	weights map[string]int
+}
+
+func NewJumpHash(nodes []string) *JumpHash {
+	return NewWeightedJumpHash(nodes, nil)
+}
+
+// NewWeightedJumpHash gives each node as many buckets as its weight
+func NewWeightedJumpHash(nodes []string, weights map[string]int) *JumpHash {
+	j := &JumpHash{nodes: nodes, weights: weights}
+
+	for _, node := range nodes {
+		for i := 0; i < weightOf(weights, node); i++ {
+			j.buckets = append(j.buckets, node)
+		}
+	}
+
+	return j
+}
+
+func (j *JumpHash) Weight(node string) int {
+	return weightOf(j.weights, node)
+}
+
+func (j *JumpHash) Nodes() []string {
+	return j.nodes
+}
+
+func (j *JumpHash) GetNode(key string) string {
+	return j.buckets[jumpHash(mix64(hash64(key)), len(j.buckets))]
+}
+
+// jumpHash returns the bucket in [0, buckets) of a 64 bit key
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
@@ -0,0 +1,92 @@
+package consistent_hashing
+
+import (
+	"crypto/md5"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// ketamaPointsPerNode is the number of ring points of a node, as in
+	// libmemcached and twemproxy
+	ketamaPointsPerNode = 160
+	// ketamaPointsPerHash is the number of points taken from one MD5 digest
+	ketamaPointsPerHash = 4
+)
+
+type ketamaPoint struct {
+	value uint32
+	node  string
+}
+
+// Ketama is a consistent hashing ring placing nodes and keys like libmemcached
+// ketama with md5 key hashing. Keys are always hashed with MD5, so it matches
+// twemproxy only for pools configured with hash: md5, twemproxy hashes keys
+// with fnv1a_64 by default.
+type Ketama struct {
+	nodes   []string
+	points  []ketamaPoint
+	weights map[string]int
+}
+
+func NewKetama(nodes []string) *Ketama {
+	return NewWeightedKetama(nodes, nil)
+}
+
+// NewWeightedKetama shares the points between the nodes in proportion to
+// their weights, with the same rounding as twemproxy
+func NewWeightedKetama(nodes []string, weights map[string]int) *Ketama {
+	k := &Ketama{nodes: nodes, points: make([]ketamaPoint, 0, len(nodes)*ketamaPointsPerNode), weights: weights}
+
+	totalWeight := 0
+	for _, node := range nodes {
+		totalWeight += weightOf(weights, node)
+	}
+
+	for _, node := range nodes {
+		share := float64(weightOf(weights, node)) / float64(totalWeight)
+		hashes := int(math.Floor(share*ketamaPointsPerNode/ketamaPointsPerHash*float64(len(nodes)) + 0.0000000001))
+
+		for i := 0; i < hashes; i++ {
+			digest := md5.Sum([]byte(fmt.Sprintf("%s-%d", node, i)))
+
+			for j := 0; j < ketamaPointsPerHash; j++ {
+				k.points = append(k.points, ketamaPoint{value: ketamaHash(digest, j), node: node})
+			}
+		}
+	}
+
+	sort.Slice(k.points, func(i, j int) bool {
+		return k.points[i].value < k.points[j].value
+	})
+
+	return k
+}
+
+// ketamaHash reads the nth little endian 32 bit word of an MD5 digest
+func ketamaHash(digest [md5.Size]byte, n int) uint32 {
+	return uint32(digest[3+n*4])<<24 |
+		uint32(digest[2+n*4])<<16 |
+		uint32(digest[1+n*4])<<8 |
+		uint32(digest[n*4])
+}
+
+func (k *Ketama) Weight(node string) int {
+	return weightOf(k.weights, node)
+}
+
+func (k *Ketama) Nodes() []string {
+	return k.nodes
+}
+
+func (k *Ketama) GetNode(key string) string {
+	hash := ketamaHash(md5.Sum([]byte(key)), 0)
+
+	i := sort.Search(len(k.points), func(i int) bool { return k.points[i].value >= hash })
+	if i == len(k.points) {
+		i = 0
+	}
+
+	return k.points[i].node
+}
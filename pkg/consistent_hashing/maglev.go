@@ -0,0 +1,75 @@
+package consistent_hashing
+
+// DefaultMaglevTableSize is the size of the Maglev lookup table, a prime much
+// bigger than the number of nodes
+const DefaultMaglevTableSize = 65537
+
+// Maglev is the lookup table hashing of Google's Maglev load balancer. Each
+// node fills the table following its own permutation of the entries, which
+// balances nearly perfectly and makes lookups a single index.
+type Maglev struct {
+	nodes   []string
+	table   []int
+	weights map[string]int
+}
+
+func NewMaglev(nodes []string, tableSize int) *Maglev {
+	return NewWeightedMaglev(nodes, nil, tableSize)
+}
+
+// NewWeightedMaglev lets every node take as many entries as its weight on each
+// round of filling the table
+func NewWeightedMaglev(nodes []string, weights map[string]int, tableSize int) *Maglev {
+	m := &Maglev{nodes: nodes, table: make([]int, tableSize), weights: weights}
+
+	if len(nodes) == 0 {
+		return m
+	}
+
+	offsets := make([]uint64, len(nodes))
+	skips := make([]uint64, len(nodes))
+	next := make([]uint64, len(nodes))
+
+	for i, node := range nodes {
+		h := hash64(node)
+		offsets[i] = h % uint64(tableSize)
+		skips[i] = mix64(h)%uint64(tableSize-1) + 1
+	}
+
+	for i := range m.table {
+		m.table[i] = -1
+	}
+
+	for filled := 0; ; {
+		for i, node := range nodes {
+			for turn := 0; turn < weightOf(weights, node); turn++ {
+				entry := (offsets[i] + next[i]*skips[i]) % uint64(tableSize)
+
+				for m.table[entry] >= 0 {
+					next[i]++
+					entry = (offsets[i] + next[i]*skips[i]) % uint64(tableSize)
+				}
+
+				m.table[entry] = i
+				next[i]++
+				filled++
+
+				if filled == tableSize {
+					return m
+				}
+			}
+		}
+	}
+}
+
+func (m *Maglev) Weight(node string) int {
+	return weightOf(m.weights, node)
+}
+
+func (m *Maglev) Nodes() []string {
+	return m.nodes
+}
+
+func (m *Maglev) GetNode(key string) string {
+	return m.nodes[m.table[mix64(hash64(key))%uint64(len(m.table))]]
+}
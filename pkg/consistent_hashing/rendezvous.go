@@ -0,0 +1,65 @@
+package consistent_hashing
+
+import "math"
+
+// Rendezvous is highest random weight hashing: every node scores the key and
+// the highest score wins. Only the keys of a removed node move, at the cost of
+// scoring every node on each lookup.
+type Rendezvous struct {
+	nodes   []string
+	seeds   []uint64
+	weights []float64
+}
+
+func NewRendezvous(nodes []string) *Rendezvous {
+	return NewWeightedRendezvous(nodes, nil)
+}
+
+// NewWeightedRendezvous scales the scores with the logarithmic method, so a
+// node gets a share of the keys proportional to its weight
+func NewWeightedRendezvous(nodes []string, weights map[string]int) *Rendezvous {
+	r := &Rendezvous{
+		nodes:   nodes,
+		seeds:   make([]uint64, 0, len(nodes)),
+		weights: make([]float64, 0, len(nodes)),
+	}
+
+	for _, node := range nodes {
+		r.seeds = append(r.seeds, hash64(node))
+		r.weights = append(r.weights, float64(weightOf(weights, node)))
+	}
+
+	return r
+}
+
+func (r *Rendezvous) Weight(node string) int {
+	for i, name := range r.nodes {
+		if name == node {
+			return int(r.weights[i])
+		}
+	}
+
+	return 1
+}
+
+func (r *Rendezvous) Nodes() []string {
+	return r.nodes
+}
+
+func (r *Rendezvous) GetNode(key string) string {
+	keyHash := hash64(key)
+
+	best := 0
+	bestScore := math.Inf(-1)
+
+	for i, seed := range r.seeds {
+		// a uniform value in (0, 1) from the top 53 bits of the hash
+		u := (float64(mix64(keyHash^seed)>>11) + 0.5) / (1 << 53)
+
+		if score := -r.weights[i] / math.Log(u); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	return r.nodes[best]
+}
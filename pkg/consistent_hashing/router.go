@@ -0,0 +1,191 @@
+package consistent_hashing
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Router maps a key to the node owning it
+type Router interface {
+	GetNode(key string) string
+	// Nodes returns the nodes keys can be routed to
+	Nodes() []string
+}
+
+// Weighted is implemented by the routers that know the weights of their
+// nodes, routers sharing their keys like them can be built from it
+type Weighted interface {
+	// Weight returns the weight of a node, 1 unless set
+	Weight(node string) int
+}
+
+// Routing strategies accepted by NewRouter
+const (
+	// RoutingRing is the original MD5 ring with 10 points per node
+	RoutingRing = "ring"
+	// RoutingKetama places keys like libmemcached ketama with md5 key hashing
+	RoutingKetama = "ketama"
+	// RoutingJump is Google's jump consistent hash
+	RoutingJump = "jump"
+	// RoutingRendezvous is highest random weight hashing
+	RoutingRendezvous = "rendezvous"
+	// RoutingMaglev is Google's Maglev lookup table hashing
+	RoutingMaglev = "maglev"
+	// RoutingSlots is Redis Cluster hash slots split evenly across nodes
+	RoutingSlots = "slots"
+)
+
+// RouterConfig describes a router, the zero values of the optional fields
+// give the defaults
+type RouterConfig struct {
+	Routing string
+	Nodes   []string
+	// Weights scale the share of keys of the nodes, 1 when not set
+	Weights map[string]int
+	// Hash is the hash function of the ring routing, MD5 by default to keep
+	// the placement of the original ring. The other routings ignore it.
+	Hash string
+	// Slots is the slot table of the slots routing, the slots are split
+	// between the nodes when not set
+	Slots []SlotRange
+}
+
+// NewRouter returns a router of the given strategy. The nodes are sorted first
+// so the placement doesn't depend on the order they are listed in.
+func NewRouter(routing string, nodes []string) (Router, error) {
+	return NewRouterFromConfig(RouterConfig{Routing: routing, Nodes: nodes})
+}
+
+// NewWeightedRouter returns a router of the given strategy sending each node a
+// share of the keys proportional to its weight, nodes without one count as 1
+func NewWeightedRouter(routing string, nodes []string, weights map[string]int) (Router, error) {
+	return NewRouterFromConfig(RouterConfig{Routing: routing, Nodes: nodes, Weights: weights})
+}
+
+func NewRouterFromConfig(cfg RouterConfig) (Router, error) {
+	nodes := append([]string{}, cfg.Nodes...)
+	sort.Strings(nodes)
+
+	weights := cfg.Weights
+
+	switch cfg.Routing {
+	case RoutingRing:
+		hash, err := NewHashFunc(cfg.Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewConsistentHashingWithHash(nodes, weights, 10, hash), nil
+	case RoutingKetama:
+		return NewWeightedKetama(nodes, weights), nil
+	case RoutingJump:
+		return NewWeightedJumpHash(nodes, weights), nil
+	case RoutingRendezvous:
+		return NewWeightedRendezvous(nodes, weights), nil
+	case RoutingMaglev:
+		return NewWeightedMaglev(nodes, weights, DefaultMaglevTableSize), nil
+	case RoutingSlots:
+		if cfg.Slots != nil {
+			return NewHashSlotsFromRanges(cfg.Slots)
+		}
+
+		return NewWeightedHashSlots(nodes, weights), nil
+	default:
+		return nil, fmt.Errorf("unknown routing '%s'", cfg.Routing)
+	}
+}
+
+// Node is a backend of a pool
+type Node struct {
+	// Name identifies the node to the routers, so its address can change
+	// without moving its keys. It is the address unless set.
+	Name   string `json:"name"`
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"`
+}
+
+// ParseNodes parses a comma separated list of nodes like
+// "shard1=10.0.0.5:6379=2,redis-b:6379", each made of an optional name, an
+// address and an optional weight
+func ParseNodes(list string) ([]Node, error) {
+	nodes := []Node{}
+	names := map[string]bool{}
+
+	for _, entry := range strings.Split(list, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), "=")
+
+		node := Node{Weight: 1}
+
+		var weightStr string
+
+		switch {
+		case len(parts) == 1:
+			node.Addr = parts[0]
+		case len(parts) == 2 && isNumber(parts[1]):
+			node.Addr, weightStr = parts[0], parts[1]
+		case len(parts) == 2:
+			node.Name, node.Addr = parts[0], parts[1]
+		case len(parts) == 3:
+			node.Name, node.Addr, weightStr = parts[0], parts[1], parts[2]
+		default:
+			return nil, fmt.Errorf("invalid node '%s', expected [name=]host:port[=weight]", entry)
+		}
+
+		if node.Name == "" {
+			node.Name = node.Addr
+		}
+
+		if node.Addr == "" {
+			return nil, fmt.Errorf("invalid node '%s', expected [name=]host:port[=weight]", entry)
+		}
+
+		if weightStr != "" {
+			weight, err := strconv.Atoi(weightStr)
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("invalid weight of node '%s', expected a positive integer", entry)
+			}
+
+			node.Weight = weight
+		}
+
+		if names[node.Name] {
+			return nil, fmt.Errorf("node '%s' is listed more than once", node.Name)
+		}
+
+		names[node.Name] = true
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
+
+// NodeNames returns the names of the nodes and their weights, what routers
+// are built from
+func NodeNames(nodes []Node) ([]string, map[string]int) {
+	names := make([]string, 0, len(nodes))
+	weights := make(map[string]int, len(nodes))
+
+	for _, node := range nodes {
+		names = append(names, node.Name)
+		weights[node.Name] = node.Weight
+	}
+
+	return names, weights
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.Atoi(s)
+
+	return err == nil
+}
+
+// weightOf returns the weight of a node, 1 unless set
+func weightOf(weights map[string]int, node string) int {
+	if weight, ok := weights[node]; ok && weight > 0 {
+		return weight
+	}
+
+	return 1
+}
@@ -0,0 +1,293 @@
+package consistent_hashing
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var routings = []string{RoutingRing, RoutingKetama, RoutingJump, RoutingRendezvous, RoutingMaglev, RoutingSlots}
+
+func testNodes(n int) []string {
+	nodes := make([]string, 0, n)
+
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, fmt.Sprintf("10.0.0.%d:6379", i+1))
+	}
+
+	return nodes
+}
+
+func testKeys(n int) []string {
+	keys := make([]string, 0, n)
+
+	for i := 0; i < n; i++ {
+		keys = append(keys, fmt.Sprintf("key_%d", i))
+	}
+
+	return keys
+}
+
+// imbalance returns how far the most loaded node is above the average
+func imbalance(router Router, keys []string) float64 {
+	counts := map[string]int{}
+
+	for _, key := range keys {
+		counts[router.GetNode(key)]++
+	}
+
+	avg := float64(len(keys)) / float64(len(router.Nodes()))
+	highest := 0
+
+	for _, count := range counts {
+		highest = max(highest, count)
+	}
+
+	return float64(highest)/avg - 1
+}
+
+// remapped returns the share of keys routed to another node by the new router
+func remapped(before, after Router, keys []string) float64 {
+	moved := 0
+
+	for _, key := range keys {
+		if before.GetNode(key) != after.GetNode(key) {
+			moved++
+		}
+	}
+
+	return float64(moved) / float64(len(keys))
+}
+
+func TestRouterDistribution(t *testing.T) {
+	keys := testKeys(100000)
+
+	// the highest acceptable imbalance and share of moved keys on top of the
+	// 1/6 that has to move when going from 5 to 6 nodes
+	tests := []struct {
+		routing      string
+		maxImbalance float64
+		maxExtraMove float64
+	}{
+		{routing: RoutingRing, maxImbalance: 1, maxExtraMove: 0.2},
+		{routing: RoutingKetama, maxImbalance: 0.15, maxExtraMove: 0.05},
+		{routing: RoutingJump, maxImbalance: 0.05, maxExtraMove: 0.01},
+		{routing: RoutingRendezvous, maxImbalance: 0.05, maxExtraMove: 0.01},
+		{routing: RoutingMaglev, maxImbalance: 0.05, maxExtraMove: 0.03},
+	}
+
+	for _, tc := range tests {
+		router, err := NewRouter(tc.routing, testNodes(5))
+		assert.Equal(t, nil, err)
+
+		grown, err := NewRouter(tc.routing, testNodes(6))
+		assert.Equal(t, nil, err)
+
+		balance := imbalance(router, keys)
+		added := remapped(router, grown, keys)
+		removed := remapped(grown, router, keys)
+
+		t.Logf(
+			"%-10s imbalance %5.1f%%, remapped %5.1f%% adding a node, %5.1f%% removing it",
+			tc.routing, balance*100, added*100, removed*100,
+		)
+
+		assert.LessOrEqual(t, balance, tc.maxImbalance, tc.routing)
+		assert.LessOrEqual(t, added, 1.0/6+tc.maxExtraMove, tc.routing)
+		assert.Equal(t, added, removed, tc.routing)
+	}
+}
+
+func TestRouterRemoveNode(t *testing.T) {
+	keys := testKeys(100000)
+	nodes := testNodes(5)
+	withoutSecond := append([]string{nodes[0]}, nodes[2:]...)
+
+	// only the keys of the removed node move, except for jump hash which can
+	// only drop the last node
+	for _, routing := range []string{RoutingKetama, RoutingRendezvous, RoutingMaglev} {
+		router, _ := NewRouter(routing, nodes)
+		shrunk, _ := NewRouter(routing, withoutSecond)
+
+		moved := 0
+
+		for _, key := range keys {
+			node := router.GetNode(key)
+			if node != nodes[1] && node != shrunk.GetNode(key) {
+				moved++
+			}
+		}
+
+		t.Logf("%-10s %.2f%% of the keys of other nodes remapped", routing, float64(moved)*100/float64(len(keys)))
+
+		assert.LessOrEqual(t, float64(moved)/float64(len(keys)), 0.02, routing)
+	}
+}
+
+func TestRouterNodeOrder(t *testing.T) {
+	nodes := testNodes(5)
+	reversed := make([]string, 0, len(nodes))
+
+	for i := len(nodes) - 1; i >= 0; i-- {
+		reversed = append(reversed, nodes[i])
+	}
+
+	for _, routing := range routings {
+		router, _ := NewRouter(routing, nodes)
+		other, _ := NewRouter(routing, reversed)
+
+		assert.Equal(t, 0.0, remapped(router, other, testKeys(1000)), routing)
+	}
+
+	_, err := NewRouter("modulo", nodes)
+	assert.EqualError(t, err, "unknown routing 'modulo'")
+}
+
+func TestJumpHash(t *testing.T) {
+	for i := uint64(0); i < 1000; i++ {
+		key := mix64(i)
+
+		assert.Equal(t, 0, jumpHash(key, 1))
+
+		// growing the buckets one by one a key either stays or moves to the new one
+		for buckets := 2; buckets < 50; buckets++ {
+			bucket := jumpHash(key, buckets)
+			previous := jumpHash(key, buckets-1)
+
+			assert.True(t, bucket == previous || bucket == buckets-1, fmt.Sprintf("%d in %d buckets", key, buckets))
+		}
+	}
+
+	assert.Equal(t, 0, jumpHash(math.MaxUint64, 1))
+}
+
+func BenchmarkRouters(b *testing.B) {
+	keys := testKeys(1024)
+
+	for _, routing := range routings {
+		router, _ := NewRouter(routing, testNodes(10))
+
+		b.Run(routing, func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				router.GetNode(keys[i%len(keys)])
+			}
+		})
+	}
+}
+
+func TestRouterWeights(t *testing.T) {
+	keys := testKeys(100000)
+	nodes := testNodes(3)
+	weights := map[string]int{nodes[0]: 3, nodes[1]: 2, nodes[2]: 1}
+
+	routers := map[string]Router{
+		// 10 points per weight are too few to follow the weights closely
+		RoutingRing: NewWeightedConsistentHashing(nodes, weights, 100),
+	}
+
+	for _, routing := range routings[1:] {
+		routers[routing], _ = NewWeightedRouter(routing, nodes, weights)
+	}
+
+	for routing, router := range routers {
+		counts := map[string]int{}
+
+		for _, key := range keys {
+			counts[router.GetNode(key)]++
+		}
+
+		for _, node := range nodes {
+			share := float64(counts[node]) / float64(len(keys))
+			want := float64(weights[node]) / 6
+
+			assert.InDelta(t, want, share, 0.03, fmt.Sprintf("%s share of %s", routing, node))
+		}
+
+		// the weights reported are in the same proportion
+		weighted, ok := router.(Weighted)
+		assert.True(t, ok, routing)
+
+		total := 0
+		for _, node := range nodes {
+			total += weighted.Weight(node)
+		}
+
+		for _, node := range nodes {
+			share := float64(weighted.Weight(node)) / float64(total)
+			want := float64(weights[node]) / 6
+
+			assert.InDelta(t, want, share, 0.001, fmt.Sprintf("%s weight of %s", routing, node))
+		}
+	}
+}
+
+func TestKetamaWeightedPoints(t *testing.T) {
+	nodes := testNodes(3)
+
+	k := NewWeightedKetama(nodes, map[string]int{nodes[0]: 2})
+
+	counts := map[string]int{}
+	for _, point := range k.points {
+		counts[point.node]++
+	}
+
+	// twemproxy rounds the points of each node down to a multiple of 4
+	assert.Equal(t, map[string]int{nodes[0]: 240, nodes[1]: 120, nodes[2]: 120}, counts)
+}
+
+func TestParseNodes(t *testing.T) {
+	nodes, err := ParseNodes("redis-a:6379=2, redis-b:6379,shard1=10.0.0.5:6379,shard2=10.0.0.6:6379=3")
+
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []Node{
+		{Name: "redis-a:6379", Addr: "redis-a:6379", Weight: 2},
+		{Name: "redis-b:6379", Addr: "redis-b:6379", Weight: 1},
+		{Name: "shard1", Addr: "10.0.0.5:6379", Weight: 1},
+		{Name: "shard2", Addr: "10.0.0.6:6379", Weight: 3},
+	}, nodes)
+
+	names, weights := NodeNames(nodes)
+	assert.Equal(t, []string{"redis-a:6379", "redis-b:6379", "shard1", "shard2"}, names)
+	assert.Equal(t, map[string]int{"redis-a:6379": 2, "redis-b:6379": 1, "shard1": 1, "shard2": 3}, weights)
+
+	tests := []struct {
+		list string
+		want string
+	}{
+		{list: "redis-a:6379=0", want: "invalid weight of node 'redis-a:6379=0', expected a positive integer"},
+		{list: "shard1=redis-a:6379=x", want: "invalid weight of node 'shard1=redis-a:6379=x', expected a positive integer"},
+		{list: "redis-a:6379,,", want: "invalid node '', expected [name=]host:port[=weight]"},
+		{list: "shard1=", want: "invalid node 'shard1=', expected [name=]host:port[=weight]"},
+		{list: "a=b=c=d", want: "invalid node 'a=b=c=d', expected [name=]host:port[=weight]"},
+		{list: "redis-a:6379,redis-a:6379=2", want: "node 'redis-a:6379' is listed more than once"},
+		{list: "shard1=10.0.0.5:6379,shard1=10.0.0.6:6379", want: "node 'shard1' is listed more than once"},
+	}
+
+	for _, tc := range tests {
+		_, err := ParseNodes(tc.list)
+
+		assert.EqualError(t, err, tc.want, tc.list)
+	}
+}
+
+func TestRouterNamedNodes(t *testing.T) {
+	keys := testKeys(1000)
+
+	for _, routing := range routings {
+		before, _ := ParseNodes("shard1=10.0.0.5:6379,shard2=10.0.0.6:6379,shard3=10.0.0.7:6379")
+		after, _ := ParseNodes("shard1=10.0.0.5:6379,shard2=10.0.1.42:6380,shard3=10.0.0.7:6379")
+
+		beforeNames, _ := NodeNames(before)
+		afterNames, _ := NodeNames(after)
+
+		router, _ := NewRouter(routing, beforeNames)
+		moved, _ := NewRouter(routing, afterNames)
+
+		// placement only depends on the names, not on the addresses
+		assert.Equal(t, 0.0, remapped(router, moved, keys), routing)
+	}
+}
@@ -0,0 +1,159 @@
+package proto
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/kgantsov/redproxy/pkg/consistent_hashing"
+)
+
+var (
+	errAdminDisabled = errors.New("admin changes are disabled, no admin token is set")
+	errAdminToken    = redisError("NOPERM admin changes need the admin token")
+)
+
+// validAdminToken tells if a token given by a client is the admin token,
+// nothing is when there is no admin token
+func validAdminToken(adminToken, token string) bool {
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(adminToken), []byte(token)) == 1
+}
+
+// requireAdminToken lets through the requests with the admin token in a
+// bearer authorization header
+func requireAdminToken(adminToken func() string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if adminToken() == "" {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": errAdminDisabled.Error()})
+		}
+
+		token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if !ok || !validAdminToken(adminToken(), token) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": errAdminToken.Error()})
+		}
+
+		return c.Next()
+	}
+}
+
+// registerAdminRoutes exposes the nodes and the migration of a proxy on the
+// HTTP router, the same operations as the PROXY command. The routes making
+// changes need the admin token, see requireAdminToken.
+func registerAdminRoutes(router fiber.Router, proxy *RedisProxy, metrics *PrometheusMetrics, adminToken func() string) {
+	admin := router.Group("/admin")
+	authorize := requireAdminToken(adminToken)
+
+	admin.Get("/nodes", func(c *fiber.Ctx) error {
+		membership := proxy.membership.Load()
+		if membership == nil {
+			return sendAdminError(c, errMembershipDisabled)
+		}
+
+		return c.JSON(membership.Nodes())
+	})
+
+	admin.Post("/nodes", authorize, func(c *fiber.Ctx) error {
+		membership := proxy.membership.Load()
+		if membership == nil {
+			return sendAdminError(c, errMembershipDisabled)
+		}
+
+		var node consistent_hashing.Node
+
+		if err := c.BodyParser(&node); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		migration, err := membership.Add(node)
+		if err != nil {
+			return sendAdminError(c, err)
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(migration.Status())
+	})
+
+	// a node is drained unless ?drain=false asks to drop it with its keys
+	admin.Delete("/nodes/:name", authorize, func(c *fiber.Ctx) error {
+		membership := proxy.membership.Load()
+		if membership == nil {
+			return sendAdminError(c, errMembershipDisabled)
+		}
+
+		if c.Query("drain") == "false" {
+			if err := membership.Remove(c.Params("name")); err != nil {
+				return sendAdminError(c, err)
+			}
+
+			return c.SendStatus(fiber.StatusNoContent)
+		}
+
+		migration, err := membership.Drain(c.Params("name"))
+		if err != nil {
+			return sendAdminError(c, err)
+		}
+
+		return c.Status(fiber.StatusAccepted).JSON(migration.Status())
+	})
+
+	admin.Get("/health", func(c *fiber.Ctx) error {
+		health := proxy.health.Load()
+		if health == nil {
+			return sendAdminError(c, errHealthCheckDisabled)
+		}
+
+		return c.JSON(health.Nodes())
+	})
+
+	admin.Get("/migration", func(c *fiber.Ctx) error {
+		migration := proxy.Migration()
+		if migration == nil {
+			return sendAdminError(c, errNotResharding)
+		}
+
+		return c.JSON(migration.Status())
+	})
+
+	admin.Post("/migration/:action", authorize, func(c *fiber.Ctx) error {
+		migration := proxy.Migration()
+		if migration == nil {
+			return sendAdminError(c, errNotResharding)
+		}
+
+		var err error
+
+		switch c.Params("action") {
+		case "start":
+			err = migration.Start(metrics)
+		case "pause":
+			err = migration.Pause()
+		case "abort":
+			err = migration.Abort()
+		default:
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "unknown migration action"})
+		}
+
+		if err != nil {
+			return sendAdminError(c, err)
+		}
+
+		return c.JSON(migration.Status())
+	})
+}
+
+// sendAdminError replies with the error and a status code matching its cause
+func sendAdminError(c *fiber.Ctx, err error) error {
+	status := fiber.StatusBadRequest
+
+	switch {
+	case errors.Is(err, errMembershipDisabled), errors.Is(err, errNotResharding),
+		errors.Is(err, errHealthCheckDisabled):
+		status = fiber.StatusNotFound
+	case errors.Is(err, errAlreadyReshard), errors.Is(err, errMigrationRunning),
+		errors.Is(err, errMigrationStopped), errors.Is(err, errMigrationDone):
+		status = fiber.StatusConflict
+	}
+
+	return c.Status(status).JSON(fiber.Map{"error": err.Error()})
+}
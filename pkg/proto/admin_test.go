@@ -0,0 +1,226 @@
+package proto
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// testAdminToken is the admin token of the admin tests
+const testAdminToken = "secret"
+
+func testAdminTokenFunc() string {
+	return testAdminToken
+}
+
+// adminRequest sends a request with the admin token
+func adminRequest(t *testing.T, app *fiber.App, method, url, body string) (int, string) {
+	return adminRequestWithToken(t, app, method, url, body, testAdminToken)
+}
+
+func adminRequestWithToken(t *testing.T, app *fiber.App, method, url, body, token string) (int, string) {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := app.Test(req)
+	assert.Equal(t, nil, err)
+
+	data, err := io.ReadAll(resp.Body)
+	assert.Equal(t, nil, err)
+
+	return resp.StatusCode, string(data)
+}
+
+func TestAdminRoutes(t *testing.T) {
+	proxy, _, factory := setupMembership(t, 2)
+
+	app := fiber.New()
+	registerAdminRoutes(app, proxy, NewPrometheusMetrics(prometheus.NewRegistry(), "redproxy", "redproxy"), testAdminTokenFunc)
+
+	tests := []struct {
+		method string
+		url    string
+		body   string
+		status int
+		want   string
+	}{
+		{
+			method: "GET", url: "/admin/migration", status: 404,
+			want: `{"error":"no resharding in progress"}`,
+		},
+		{
+			method: "POST", url: "/admin/nodes", body: `{"name":"shard3","addr":"redis-3:6379"}`, status: 201,
+			want: `{"state":"idle","nodes":2,"nodes_done":0,"keys_scanned":0,"keys_moved":0,"errors":0}`,
+		},
+		{
+			method: "POST", url: "/admin/nodes", body: `{"name":"shard4"}`, status: 400,
+			want: `{"error":"invalid node 'shard4', expected an address"}`,
+		},
+		{
+			method: "POST", url: "/admin/nodes", body: `{"addr":"redis-4:6379"}`, status: 409,
+			want: `{"error":"resharding is already in progress"}`,
+		},
+		{
+			method: "GET", url: "/admin/nodes", status: 200,
+			want: `[{"name":"shard1","addr":"redis-1:6379","weight":1},` +
+				`{"name":"shard2","addr":"redis-2:6379","weight":1},` +
+				`{"name":"shard3","addr":"redis-3:6379","weight":1}]`,
+		},
+		{
+			method: "POST", url: "/admin/migration/pause", status: 409,
+			want: `{"error":"migration is not running"}`,
+		},
+		{
+			method: "POST", url: "/admin/migration/resume", status: 404,
+			want: `{"error":"unknown migration action"}`,
+		},
+		{
+			method: "DELETE", url: "/admin/nodes/shard1", status: 409,
+			want: `{"error":"resharding is already in progress"}`,
+		},
+	}
+
+	for _, tc := range tests {
+		status, body := adminRequest(t, app, tc.method, tc.url, tc.body)
+
+		assert.Equal(t, tc.status, status, tc.method+" "+tc.url)
+		assert.Equal(t, tc.want, body, tc.method+" "+tc.url)
+	}
+
+	status, _ := adminRequest(t, app, "POST", "/admin/migration/start", "")
+	assert.Equal(t, 200, status)
+	assert.Eventually(t, func() bool {
+		return proxy.Migration().Status().State == MigrationDone
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assertKeys(t, proxy)
+	assert.NotEmpty(t, factory.clients["redis-3:6379"].strings)
+
+	status, _ = adminRequest(t, app, "DELETE", "/admin/nodes/shard1?drain=false", "")
+	assert.Equal(t, 204, status)
+
+	status, body := adminRequest(t, app, "DELETE", "/admin/nodes/shard9", "")
+	assert.Equal(t, 400, status)
+	assert.Equal(t, `{"error":"unknown node 'shard9'"}`, body)
+
+	status, body = adminRequest(t, app, "DELETE", "/admin/nodes/shard2", "")
+	assert.Equal(t, 202, status)
+	assert.Equal(t, `{"state":"idle","nodes":2,"nodes_done":0,"keys_scanned":0,"keys_moved":0,"errors":0}`, body)
+}
+
+func TestAdminToken(t *testing.T) {
+	proxy, membership, _ := setupMembership(t, 2)
+	metrics := NewPrometheusMetrics(prometheus.NewRegistry(), "redproxy", "redproxy")
+
+	app := fiber.New()
+	registerAdminRoutes(app, proxy, metrics, testAdminTokenFunc)
+
+	disabled := fiber.New()
+	registerAdminRoutes(disabled, proxy, metrics, func() string { return "" })
+
+	node := `{"name":"shard3","addr":"redis-3:6379"}`
+
+	tests := []struct {
+		app    *fiber.App
+		method string
+		url    string
+		token  string
+		status int
+		want   string
+	}{
+		{
+			app: disabled, method: "POST", url: "/admin/nodes", token: testAdminToken, status: 403,
+			want: `{"error":"admin changes are disabled, no admin token is set"}`,
+		},
+		{
+			app: app, method: "POST", url: "/admin/nodes", status: 401,
+			want: `{"error":"NOPERM admin changes need the admin token"}`,
+		},
+		{
+			app: app, method: "DELETE", url: "/admin/nodes/shard1", token: "wrong", status: 401,
+			want: `{"error":"NOPERM admin changes need the admin token"}`,
+		},
+		{
+			app: app, method: "POST", url: "/admin/migration/start", token: "wrong", status: 401,
+			want: `{"error":"NOPERM admin changes need the admin token"}`,
+		},
+		{
+			// reading needs no token
+			app: disabled, method: "GET", url: "/admin/nodes", status: 200,
+			want: `[{"name":"shard1","addr":"redis-1:6379","weight":1},{"name":"shard2","addr":"redis-2:6379","weight":1}]`,
+		},
+	}
+
+	for _, tc := range tests {
+		status, body := adminRequestWithToken(t, tc.app, tc.method, tc.url, node, tc.token)
+
+		assert.Equal(t, tc.status, status, tc.method+" "+tc.url)
+		assert.Equal(t, tc.want, body, tc.method+" "+tc.url)
+	}
+
+	assert.Equal(t, 2, len(membership.Nodes()))
+}
+
+func TestProxyAuth(t *testing.T) {
+	proxy, membership, _ := setupMembership(t, 2)
+
+	tests := []struct {
+		adminToken string
+		commands   []string
+		want       string
+	}{
+		{
+			commands: []string{
+				encodeCommand("PROXY", "AUTH", testAdminToken),
+				encodeCommand("PROXY", "NODE", "DRAIN", "shard2"),
+			},
+			want: "-ERR admin changes are disabled, no admin token is set\r\n" +
+				"-ERR admin changes are disabled, no admin token is set\r\n",
+		},
+		{
+			adminToken: testAdminToken,
+			commands: []string{
+				encodeCommand("PROXY", "NODE", "DRAIN", "shard2"),
+				encodeCommand("PROXY", "MIGRATION", "START"),
+				encodeCommand("PROXY", "AUTH", "wrong"),
+				encodeCommand("PROXY", "NODE", "REMOVE", "shard2"),
+				// reading needs no token
+				encodeCommand("PROXY", "MIGRATION", "STATUS"),
+			},
+			want: "-NOPERM admin changes need the admin token\r\n" +
+				"-NOPERM admin changes need the admin token\r\n" +
+				"-WRONGPASS invalid admin token\r\n" +
+				"-NOPERM admin changes need the admin token\r\n" +
+				"-ERR no resharding in progress\r\n",
+		},
+		{
+			adminToken: testAdminToken,
+			commands: []string{
+				encodeCommand("PROXY", "AUTH", testAdminToken),
+				encodeCommand("PROXY", "NODE", "REMOVE", "shard2"),
+			},
+			want: "+OK\r\n+OK\r\n",
+		},
+	}
+
+	for _, tc := range tests {
+		p, buf := newTestProto(proxy, tc.commands...)
+		p.adminToken = tc.adminToken
+		handleAll(p)
+
+		assert.Equal(t, tc.want, buf.String(), fmt.Sprintf("%q", tc.commands))
+	}
+
+	assert.Equal(t, 1, len(membership.Nodes()))
+}
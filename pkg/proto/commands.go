@@ -0,0 +1,290 @@
+package proto
+
+import (
+	"context"
+	"strings"
+)
+
+// routing describes how a command is dispatched to the backends
+type routing int
+
+const (
+	// routeSingleKey sends the command to the node owning its keys, all of
+	// which must belong to the same node
+	routeSingleKey routing = iota
+	// routeMultiKey splits the keys per node and merges the replies
+	routeMultiKey
+	// routeAllShards sends the command to every node
+	routeAllShards
+	// routeLocal is answered by the proxy itself
+	routeLocal
+	// routeUnsupported is a known Redis command the proxy refuses to run
+	routeUnsupported
+)
+
+type commandFlags int
+
+const (
+	flagRead commandFlags = 1 << iota
+	flagWrite
+	// flagStatusReply marks commands replying with +OK on success, go-redis
+	// decodes it as a plain string so it has to be restored for the clients
+	// that don't relay replies
+	flagStatusReply
+	// flagSetReply marks commands replying with a set, go-redis decodes RESP3
+	// sets as arrays so the type has to be restored for RESP3 clients when the
+	// reply isn't relayed
+	flagSetReply
+)
+
+// commandSpec describes a command the same way Redis `COMMAND INFO` does:
+// arity counts the command name and is negative when it is a minimum, key
+// positions are indexes into the argv with lastKey -1 meaning the last one.
+type commandSpec struct {
+	name     string
+	arity    int
+	firstKey int
+	lastKey  int
+	step     int
+	flags    commandFlags
+	route    routing
+
+	// handler runs the command, single-key commands without a handler are
+	// forwarded as is
+	handler func(p *Proto, ctx context.Context, cmd *Command)
+}
+
+// checkArity reports whether argc, including the command name, is valid
+func (s *commandSpec) checkArity(argc int) bool {
+	if s.arity < 0 {
+		return argc >= -s.arity
+	}
+
+	return argc == s.arity
+}
+
+// keys returns the key arguments of a command with the given args
+func (s *commandSpec) keys(args []string) []string {
+	if s.firstKey == 0 {
+		return nil
+	}
+
+	first, last := s.keyRange(len(args) + 1)
+	keys := make([]string, 0, max(0, (last-first)/s.step+1))
+
+	for i := first; i <= last; i += s.step {
+		keys = append(keys, args[i-1])
+	}
+
+	return keys
+}
+
+// commandKeys returns the key arguments of a command, converting only those
+// to strings when it was parsed in zero-copy mode
+func (s *commandSpec) commandKeys(cmd *Command) []string {
+	if cmd.Argv == nil {
+		return s.keys(cmd.Args)
+	}
+
+	if s.firstKey == 0 {
+		return nil
+	}
+
+	first, last := s.keyRange(len(cmd.Argv))
+	keys := make([]string, 0, max(0, (last-first)/s.step+1))
+
+	for i := first; i <= last; i += s.step {
+		keys = append(keys, string(cmd.Argv[i]))
+	}
+
+	return keys
+}
+
+// keyRange returns the positions of the first and last key of a command with
+// argc arguments, counting the command name
+func (s *commandSpec) keyRange(argc int) (int, int) {
+	last := s.lastKey
+	if last < 0 {
+		last += argc
+	}
+
+	return s.firstKey, min(last, argc-1)
+}
+
+var commandTable = map[string]*commandSpec{}
+
+func registerCommands(specs ...commandSpec) {
+	for i := range specs {
+		spec := specs[i]
+		commandTable[strings.ToUpper(spec.name)] = &spec
+	}
+}
+
+func lookupCommand(name string) (*commandSpec, bool) {
+	spec, ok := commandTable[name]
+
+	return spec, ok
+}
+
+func init() {
+	registerCommands(
+		// connection
+		commandSpec{name: "hello", arity: -1, route: routeLocal, handler: (*Proto).handleHello},
+		commandSpec{name: "ping", arity: -1, route: routeLocal, handler: (*Proto).handlePing},
+		commandSpec{name: "client", arity: -2, route: routeLocal, handler: (*Proto).handleClientCommand},
+		commandSpec{name: "cluster", arity: -2, route: routeLocal, handler: (*Proto).handleClusterCommand},
+		commandSpec{name: "proxy", arity: -2, route: routeLocal, handler: (*Proto).handleProxyCommand},
+
+		// keyspace
+		commandSpec{name: "del", arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: flagWrite, route: routeMultiKey, handler: (*Proto).handleDel},
+		commandSpec{name: "exists", arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: flagRead, route: routeMultiKey, handler: (*Proto).handleExists},
+		commandSpec{name: "unlink", arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: flagWrite, route: routeMultiKey, handler: (*Proto).handleUnlink},
+		commandSpec{name: "touch", arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: flagRead, route: routeMultiKey, handler: (*Proto).handleTouch},
+		commandSpec{name: "keys", arity: 2, flags: flagRead, route: routeAllShards, handler: (*Proto).handleKeys},
+		commandSpec{name: "scan", arity: -2, flags: flagRead, route: routeAllShards, handler: (*Proto).handleScan},
+		commandSpec{name: "ttl", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead, handler: (*Proto).handleTTL},
+		commandSpec{name: "pttl", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "expire", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "pexpire", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "expireat", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "pexpireat", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "persist", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "type", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "dump", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "restore", arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite | flagStatusReply},
+		commandSpec{name: "rename", arity: 3, firstKey: 1, lastKey: 2, step: 1, flags: flagWrite | flagStatusReply},
+		commandSpec{name: "renamenx", arity: 3, firstKey: 1, lastKey: 2, step: 1, flags: flagWrite},
+
+		// strings
+		commandSpec{name: "get", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead, handler: (*Proto).handleGet},
+		commandSpec{name: "set", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite | flagStatusReply},
+		commandSpec{name: "setnx", arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "setex", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite | flagStatusReply},
+		commandSpec{name: "psetex", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite | flagStatusReply},
+		commandSpec{name: "mget", arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: flagRead, route: routeMultiKey, handler: (*Proto).handleMGet},
+		commandSpec{name: "mset", arity: -3, firstKey: 1, lastKey: -1, step: 2, flags: flagWrite, route: routeMultiKey, handler: (*Proto).handleMSet},
+		// msetnx is all or nothing, so its keys have to be on a single node
+		commandSpec{name: "msetnx", arity: -3, firstKey: 1, lastKey: -1, step: 2, flags: flagWrite},
+		commandSpec{name: "getset", arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "getdel", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "getex", arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "strlen", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "getrange", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "setrange", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "append", arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite, handler: (*Proto).handleAppend},
+		commandSpec{name: "incr", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite, handler: (*Proto).handleIncr},
+		commandSpec{name: "incrby", arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite, handler: (*Proto).handleIncrBy},
+		commandSpec{name: "incrbyfloat", arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "decr", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite, handler: (*Proto).handleDecr},
+		commandSpec{name: "decrby", arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite, handler: (*Proto).handleDecrBy},
+		commandSpec{name: "setbit", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "getbit", arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "bitcount", arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "bitpos", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+
+		// hashes
+		commandSpec{name: "hget", arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: flagRead, handler: (*Proto).handleHGet},
+		commandSpec{name: "hset", arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite, handler: (*Proto).handleHSet},
+		commandSpec{name: "hsetnx", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "hmset", arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite | flagStatusReply},
+		commandSpec{name: "hmget", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "hdel", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "hexists", arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "hgetall", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "hkeys", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "hvals", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "hlen", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "hstrlen", arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "hincrby", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "hincrbyfloat", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "hrandfield", arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+
+		// lists
+		commandSpec{name: "lpush", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "rpush", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "lpushx", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "rpushx", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "lpop", arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "rpop", arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "llen", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "lrange", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "lindex", arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "lset", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite | flagStatusReply},
+		commandSpec{name: "lrem", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "ltrim", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite | flagStatusReply},
+		commandSpec{name: "linsert", arity: 5, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "lpos", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "rpoplpush", arity: 3, firstKey: 1, lastKey: 2, step: 1, flags: flagWrite},
+		commandSpec{name: "lmove", arity: 5, firstKey: 1, lastKey: 2, step: 1, flags: flagWrite},
+
+		// sets
+		commandSpec{name: "sadd", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite, handler: (*Proto).handleSAdd},
+		commandSpec{name: "srem", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite, handler: (*Proto).handleSRem},
+		commandSpec{name: "smembers", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead | flagSetReply, handler: (*Proto).handleSMembers},
+		commandSpec{name: "scard", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "sismember", arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "smismember", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "spop", arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "srandmember", arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "smove", arity: 4, firstKey: 1, lastKey: 2, step: 1, flags: flagWrite},
+		commandSpec{name: "sinter", arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: flagRead | flagSetReply},
+		commandSpec{name: "sunion", arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: flagRead | flagSetReply},
+		commandSpec{name: "sdiff", arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: flagRead | flagSetReply},
+		commandSpec{name: "sinterstore", arity: -3, firstKey: 1, lastKey: -1, step: 1, flags: flagWrite},
+		commandSpec{name: "sunionstore", arity: -3, firstKey: 1, lastKey: -1, step: 1, flags: flagWrite},
+		commandSpec{name: "sdiffstore", arity: -3, firstKey: 1, lastKey: -1, step: 1, flags: flagWrite},
+
+		// sorted sets
+		commandSpec{name: "zadd", arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "zrem", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "zcard", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "zscore", arity: 3, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "zmscore", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "zincrby", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "zrank", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "zrevrank", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "zcount", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "zrange", arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "zrevrange", arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "zrangebyscore", arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "zrevrangebyscore", arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "zremrangebyrank", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "zremrangebyscore", arity: 4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "zpopmin", arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "zpopmax", arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+
+		// streams
+		commandSpec{name: "xadd", arity: -5, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "xlen", arity: 2, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "xrange", arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "xrevrange", arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: flagRead},
+		commandSpec{name: "xdel", arity: -3, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "xtrim", arity: -4, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+
+		// hyperloglog
+		commandSpec{name: "pfadd", arity: -2, firstKey: 1, lastKey: 1, step: 1, flags: flagWrite},
+		commandSpec{name: "pfcount", arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: flagRead},
+		commandSpec{name: "pfmerge", arity: -2, firstKey: 1, lastKey: -1, step: 1, flags: flagWrite | flagStatusReply},
+
+		// not supported through the proxy
+		commandSpec{name: "randomkey", arity: 1, flags: flagRead, route: routeUnsupported},
+		commandSpec{name: "flushall", arity: -1, flags: flagWrite, route: routeUnsupported},
+		commandSpec{name: "flushdb", arity: -1, flags: flagWrite, route: routeUnsupported},
+		commandSpec{name: "select", arity: 2, route: routeUnsupported},
+		commandSpec{name: "multi", arity: 1, route: routeUnsupported},
+		commandSpec{name: "exec", arity: 1, route: routeUnsupported},
+		commandSpec{name: "discard", arity: 1, route: routeUnsupported},
+		commandSpec{name: "watch", arity: -2, firstKey: 1, lastKey: -1, step: 1, route: routeUnsupported},
+		commandSpec{name: "unwatch", arity: 1, route: routeUnsupported},
+		commandSpec{name: "subscribe", arity: -2, route: routeUnsupported},
+		commandSpec{name: "psubscribe", arity: -2, route: routeUnsupported},
+		commandSpec{name: "unsubscribe", arity: -1, route: routeUnsupported},
+		commandSpec{name: "punsubscribe", arity: -1, route: routeUnsupported},
+		commandSpec{name: "publish", arity: 3, route: routeUnsupported},
+		commandSpec{name: "monitor", arity: 1, route: routeUnsupported},
+		commandSpec{name: "blpop", arity: -3, firstKey: 1, lastKey: -2, step: 1, flags: flagWrite, route: routeUnsupported},
+		commandSpec{name: "brpop", arity: -3, firstKey: 1, lastKey: -2, step: 1, flags: flagWrite, route: routeUnsupported},
+		commandSpec{name: "eval", arity: -3, route: routeUnsupported},
+		commandSpec{name: "evalsha", arity: -3, route: routeUnsupported},
+	)
+}
@@ -0,0 +1,56 @@
+package proto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandSpecCheckArity(t *testing.T) {
+	tests := []struct {
+		name string
+		argc int
+		want bool
+	}{
+		{name: "GET", argc: 1, want: false},
+		{name: "GET", argc: 2, want: true},
+		{name: "GET", argc: 3, want: false},
+		{name: "SET", argc: 2, want: false},
+		{name: "SET", argc: 3, want: true},
+		{name: "SET", argc: 5, want: true},
+		{name: "HSET", argc: 3, want: false},
+		{name: "HSET", argc: 4, want: true},
+		{name: "PING", argc: 1, want: true},
+		{name: "DEL", argc: 1, want: false},
+	}
+
+	for _, tc := range tests {
+		spec, ok := lookupCommand(tc.name)
+
+		assert.True(t, ok, tc.name)
+		assert.Equal(t, tc.want, spec.checkArity(tc.argc), tc.name)
+	}
+}
+
+func TestCommandSpecKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{name: "GET", args: []string{"k1"}, want: []string{"k1"}},
+		{name: "SET", args: []string{"k1", "v1", "EX", "10"}, want: []string{"k1"}},
+		{name: "DEL", args: []string{"k1", "k2", "k3"}, want: []string{"k1", "k2", "k3"}},
+		{name: "MSET", args: []string{"k1", "v1", "k2", "v2"}, want: []string{"k1", "k2"}},
+		{name: "SMOVE", args: []string{"src", "dst", "member"}, want: []string{"src", "dst"}},
+		{name: "BLPOP", args: []string{"l1", "l2", "0"}, want: []string{"l1", "l2"}},
+		{name: "KEYS", args: []string{"*"}, want: nil},
+	}
+
+	for _, tc := range tests {
+		spec, ok := lookupCommand(tc.name)
+
+		assert.True(t, ok, tc.name)
+		assert.Equal(t, tc.want, spec.keys(tc.args), tc.name)
+	}
+}
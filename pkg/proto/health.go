@@ -0,0 +1,384 @@
+package proto
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/kgantsov/redproxy/pkg/consistent_hashing"
+)
+
+// Defaults of the health checks, the failure limit and the retry timeout are
+// the ones of twemproxy
+const (
+	DefaultHealthCheckInterval = time.Second
+	DefaultServerFailureLimit  = 2
+	DefaultServerRetryTimeout  = 30 * time.Second
+)
+
+var errHealthCheckDisabled = errors.New("health checks are not enabled")
+
+// NodeState is the health of a node as seen by the health checks
+type NodeState string
+
+const (
+	// NodeUp answered the last check
+	NodeUp NodeState = "up"
+	// NodeFailing failed the last checks, fewer times than the failure limit
+	NodeFailing NodeState = "failing"
+	// NodeDown failed the failure limit checks in a row, it is kept in
+	// routing as ejection is not enabled
+	NodeDown NodeState = "down"
+	// NodeEjected failed the failure limit checks in a row, its keys are
+	// routed to the other nodes until it answers again
+	NodeEjected NodeState = "ejected"
+)
+
+// HealthCheckConfig sets how backends are checked, like the auto_eject_hosts,
+// server_failure_limit and server_retry_timeout settings of twemproxy
+type HealthCheckConfig struct {
+	// Interval is the time between two PINGs of a node and their timeout
+	Interval time.Duration
+	// AutoEject takes a node out of routing once it is down
+	AutoEject bool
+	// FailureLimit is the number of failed checks in a row a node is down after
+	FailureLimit int
+	// RetryTimeout is the time an ejected node is left alone before it is
+	// checked again
+	RetryTimeout time.Duration
+}
+
+// NodeHealth is the health of a node
+type NodeHealth struct {
+	Name      string    `json:"name"`
+	State     NodeState `json:"state"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type nodeHealth struct {
+	NodeHealth
+
+	// retryAt is when an ejected node is checked again
+	retryAt time.Time
+}
+
+// HealthChecker PINGs the nodes of a proxy and ejects the ones that keep
+// failing from routing. The keys of an ejected node go to the other nodes,
+// which suits caches: they are back on their node, without the values
+// written meanwhile, once it is readmitted.
+type HealthChecker struct {
+	proxy   *RedisProxy
+	config  HealthCheckConfig
+	metrics *PrometheusMetrics
+
+	mu    sync.Mutex
+	nodes map[string]*nodeHealth
+	stop  chan struct{}
+}
+
+// NewHealthChecker enables the health checks of a proxy, the zero values of
+// the config give the defaults. Checks run once started.
+func NewHealthChecker(proxy *RedisProxy, config HealthCheckConfig, metrics *PrometheusMetrics) *HealthChecker {
+	if config.Interval <= 0 {
+		config.Interval = DefaultHealthCheckInterval
+	}
+
+	if config.FailureLimit <= 0 {
+		config.FailureLimit = DefaultServerFailureLimit
+	}
+
+	if config.RetryTimeout <= 0 {
+		config.RetryTimeout = DefaultServerRetryTimeout
+	}
+
+	h := &HealthChecker{
+		proxy:   proxy,
+		config:  config,
+		metrics: metrics,
+		nodes:   map[string]*nodeHealth{},
+	}
+
+	proxy.health.Store(h)
+
+	return h
+}
+
+// Start checks the nodes on every interval until stopped
+func (h *HealthChecker) Start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.stop != nil {
+		return
+	}
+
+	h.stop = make(chan struct{})
+
+	go h.run(h.stop)
+}
+
+// Stop ends the checks, ejected nodes stay ejected
+func (h *HealthChecker) Stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+}
+
+func (h *HealthChecker) run(stop chan struct{}) {
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.check(time.Now())
+		}
+	}
+}
+
+// check PINGs the nodes concurrently, except the ejected ones waiting for
+// their retry timeout
+func (h *HealthChecker) check(now time.Time) {
+	t := h.proxy.topology.Load()
+
+	h.forget(t)
+
+	var wg sync.WaitGroup
+
+	for node, client := range t.clients {
+		if !h.due(node, now) {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(node string, client RedisClient) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), h.config.Interval)
+			defer cancel()
+
+			h.record(node, client.Do(ctx, "PING").Err(), now)
+		}(node, client)
+	}
+
+	wg.Wait()
+}
+
+// due reports whether a node is to be checked
+func (h *HealthChecker) due(node string, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	health, ok := h.nodes[node]
+
+	return !ok || health.State != NodeEjected || !now.Before(health.retryAt)
+}
+
+// forget drops the nodes that are not in the topology anymore
+func (h *HealthChecker) forget(t *topology) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for node := range h.nodes {
+		if _, ok := t.clients[node]; !ok {
+			delete(h.nodes, node)
+			h.proxy.readmit(node)
+			h.metrics.NodeUp.Delete(prometheus.Labels{"node": node})
+			h.metrics.NodeEjected.Delete(prometheus.Labels{"node": node})
+		}
+	}
+}
+
+// record updates the state of a node with the result of its check
+func (h *HealthChecker) record(node string, err error, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	health, ok := h.nodes[node]
+	if !ok {
+		health = &nodeHealth{NodeHealth: NodeHealth{Name: node, State: NodeUp}}
+		h.nodes[node] = health
+	}
+
+	if err == nil {
+		if health.State == NodeEjected {
+			h.proxy.readmit(node)
+			log.Info().Msgf("Node %s is back, readmitted it to routing", node)
+		} else if health.State == NodeDown {
+			log.Info().Msgf("Node %s is back", node)
+		}
+
+		health.State = NodeUp
+		health.Failures = 0
+		health.LastError = ""
+	} else {
+		health.Failures++
+		health.LastError = err.Error()
+
+		switch {
+		case health.State == NodeEjected:
+			health.retryAt = now.Add(h.config.RetryTimeout)
+		case health.Failures < h.config.FailureLimit:
+			health.State = NodeFailing
+		case h.config.AutoEject:
+			health.State = NodeEjected
+			health.retryAt = now.Add(h.config.RetryTimeout)
+			h.proxy.eject(node)
+			log.Error().Msgf("Node %s failed %d checks in a row, ejected it from routing: %v", node, health.Failures, err)
+		default:
+			if health.State != NodeDown {
+				log.Error().Msgf("Node %s failed %d checks in a row: %v", node, health.Failures, err)
+			}
+
+			health.State = NodeDown
+		}
+	}
+
+	up, ejected := 0.0, 0.0
+	if health.State == NodeUp || health.State == NodeFailing {
+		up = 1
+	}
+
+	if health.State == NodeEjected {
+		ejected = 1
+	}
+
+	h.metrics.NodeUp.With(prometheus.Labels{"node": node}).Set(up)
+	h.metrics.NodeEjected.With(prometheus.Labels{"node": node}).Set(ejected)
+}
+
+// Nodes returns the health of the checked nodes sorted by name
+func (h *HealthChecker) Nodes() []NodeHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	nodes := make([]NodeHealth, 0, len(h.nodes))
+	for _, health := range h.nodes {
+		nodes = append(nodes, health.NodeHealth)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+
+	return nodes
+}
+
+// eject routes the keys of a node to the other nodes
+func (c *RedisProxy) eject(node string) {
+	c.setEjected(node, true)
+}
+
+// readmit routes the keys of an ejected node to it again
+func (c *RedisProxy) readmit(node string) {
+	c.setEjected(node, false)
+}
+
+// isEjected reports whether a node is taken out of routing
+func (c *RedisProxy) isEjected(node string) bool {
+	ejected := c.ejected.Load()
+
+	return ejected != nil && ejected.nodes[node]
+}
+
+// anyEjected reports whether any node is taken out of routing
+func (c *RedisProxy) anyEjected() bool {
+	ejected := c.ejected.Load()
+
+	return ejected != nil && len(ejected.nodes) > 0
+}
+
+func (c *RedisProxy) setEjected(node string, ejected bool) {
+	for {
+		current := c.ejected.Load()
+
+		next := map[string]bool{}
+		if current != nil {
+			for name := range current.nodes {
+				next[name] = true
+			}
+		}
+
+		if ejected {
+			next[node] = true
+		} else {
+			delete(next, node)
+		}
+
+		if c.ejected.CompareAndSwap(current, newEjection(next, c.topology.Load())) {
+			return
+		}
+	}
+}
+
+// ejection is a set of ejected nodes with the router of the keys of the
+// ejected nodes, built once for a topology
+type ejection struct {
+	nodes    map[string]bool
+	topology *topology
+	// live routes to the nodes of the topology that are not ejected, it is
+	// nil when they all are
+	live consistent_hashing.Router
+}
+
+// newEjection builds the router of the nodes of a topology that are not
+// ejected, rendezvous hashing spreads the keys of the ejected nodes in
+// proportion to the weights of the live nodes
+func newEjection(nodes map[string]bool, t *topology) *ejection {
+	e := &ejection{nodes: nodes, topology: t}
+
+	live := []string{}
+	weights := map[string]int{}
+	weighted, _ := t.router.(consistent_hashing.Weighted)
+
+	for _, node := range t.router.Nodes() {
+		if nodes[node] {
+			continue
+		}
+
+		live = append(live, node)
+
+		if weighted != nil {
+			weights[node] = weighted.Weight(node)
+		}
+	}
+
+	if len(live) > 0 {
+		e.live = consistent_hashing.NewWeightedRendezvous(live, weights)
+	}
+
+	return e
+}
+
+// liveNode picks the node of a key owned by an ejected node among the nodes
+// that are not ejected. With every node ejected, the owner is kept. The live
+// router is rebuilt on the first lookup after a change of the topology.
+func (c *RedisProxy) liveNode(t *topology, ejected *ejection, hashKey, owner string) string {
+	if ejected.topology != t {
+		rebuilt := newEjection(ejected.nodes, t)
+
+		// a lookup on an older topology must not replace a newer router
+		if t == c.topology.Load() {
+			c.ejected.CompareAndSwap(ejected, rebuilt)
+		}
+
+		ejected = rebuilt
+	}
+
+	if ejected.live == nil {
+		return owner
+	}
+
+	return ejected.live.GetNode(hashKey)
+}
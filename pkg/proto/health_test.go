@@ -0,0 +1,182 @@
+package proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kgantsov/redproxy/pkg/consistent_hashing"
+)
+
+func TestHealthCheckEjection(t *testing.T) {
+	proxy, _, factory := setupMembership(t, 3)
+	metrics := NewPrometheusMetrics(prometheus.NewRegistry(), "redproxy", "redproxy")
+
+	health := NewHealthChecker(proxy, HealthCheckConfig{
+		AutoEject: true, FailureLimit: 2, RetryTimeout: time.Minute,
+	}, metrics)
+
+	failing := factory.clients["redis-2:6379"]
+	keys := len(failing.strings)
+	assert.NotEqual(t, 0, keys)
+
+	now := time.Now()
+	health.check(now)
+
+	assert.Equal(t, []NodeHealth{
+		{Name: "shard1", State: NodeUp}, {Name: "shard2", State: NodeUp}, {Name: "shard3", State: NodeUp},
+	}, health.Nodes())
+
+	failing.replies["PING"] = errors.New("dial tcp: connection refused")
+
+	// a node is kept in routing until it reaches the failure limit
+	health.check(now)
+	assert.Equal(t, NodeHealth{Name: "shard2", State: NodeFailing, Failures: 1, LastError: "dial tcp: connection refused"}, health.Nodes()[1])
+	assertKeys(t, proxy)
+
+	health.check(now)
+	assert.Equal(t, NodeEjected, health.Nodes()[1].State)
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.NodeUp.With(prometheus.Labels{"node": "shard2"})))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.NodeEjected.With(prometheus.Labels{"node": "shard2"})))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.NodeUp.With(prometheus.Labels{"node": "shard1"})))
+
+	assert.Equal(
+		t,
+		"*3\r\n"+
+			"*3\r\n$6\r\nshard1\r\n$2\r\nup\r\n:0\r\n"+
+			"*3\r\n$6\r\nshard2\r\n$7\r\nejected\r\n:2\r\n"+
+			"*3\r\n$6\r\nshard3\r\n$2\r\nup\r\n:0\r\n",
+		runCommands(proxy, encodeCommand("PROXY", "HEALTH")),
+	)
+
+	// the keys of the ejected node are served by the other nodes meanwhile
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%d", i)
+
+		if _, ok := failing.strings[key]; ok {
+			assert.Equal(t, "", proxy.Get(context.Background(), key).Val(), key)
+			assert.Equal(t, nil, proxy.Set(context.Background(), key, "new", 0).Err(), key)
+			assert.Equal(t, "new", proxy.Get(context.Background(), key).Val(), key)
+		}
+	}
+
+	assert.Equal(t, keys, len(failing.strings))
+	for _, value := range failing.strings {
+		assert.NotEqual(t, "new", value)
+	}
+
+	// an ejected node is left alone until its retry timeout
+	health.check(now.Add(30 * time.Second))
+	assert.Equal(t, 2, health.Nodes()[1].Failures)
+
+	health.check(now.Add(time.Minute))
+	assert.Equal(t, NodeHealth{Name: "shard2", State: NodeEjected, Failures: 3, LastError: "dial tcp: connection refused"}, health.Nodes()[1])
+
+	delete(failing.replies, "PING")
+
+	health.check(now.Add(time.Minute))
+	assert.Equal(t, NodeEjected, health.Nodes()[1].State, "the retry timeout restarts after a failed retry")
+
+	health.check(now.Add(2 * time.Minute))
+	assert.Equal(t, NodeHealth{Name: "shard2", State: NodeUp}, health.Nodes()[1])
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.NodeEjected.With(prometheus.Labels{"node": "shard2"})))
+
+	assertKeys(t, proxy)
+}
+
+func TestEjectionLiveRouter(t *testing.T) {
+	proxy, membership, _ := setupMembership(t, 3)
+	proxy.eject("shard2")
+
+	ejected := proxy.ejected.Load()
+	assert.Equal(t, []string{"shard1", "shard3"}, ejected.live.Nodes())
+
+	// the live router is built once and reused by the lookups
+	for i := 0; i < 100; i++ {
+		assert.NotEqual(t, "shard2", proxy.locate(proxy.topology.Load(), fmt.Sprintf("key_%d", i)))
+	}
+
+	assert.Same(t, ejected, proxy.ejected.Load())
+
+	// and rebuilt on the first lookup after a change of the topology
+	assert.Equal(t, nil, membership.Remove("shard3"))
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, "shard1", proxy.locate(proxy.topology.Load(), fmt.Sprintf("key_%d", i)))
+	}
+
+	assert.Same(t, proxy.topology.Load(), proxy.ejected.Load().topology)
+	assert.Equal(t, []string{"shard1"}, proxy.ejected.Load().live.Nodes())
+}
+
+func TestEjectionWeights(t *testing.T) {
+	clients := setupFakeClients(3)
+
+	router, err := consistent_hashing.NewWeightedRouter(
+		consistent_hashing.RoutingKetama,
+		[]string{"redis-1:6379", "redis-2:6380", "redis-3:6381"},
+		map[string]int{"redis-2:6380": 3},
+	)
+	assert.Equal(t, nil, err)
+
+	proxy, err := NewRedisProxyWithRouter(clients, router)
+	assert.Equal(t, nil, err)
+
+	proxy.eject("redis-1:6379")
+
+	// the keys of the ejected node are spread like the live nodes weigh
+	counts := map[string]int{}
+
+	for i := 0; i < 10000; i++ {
+		counts[proxy.ejected.Load().live.GetNode(fmt.Sprintf("key_%d", i))]++
+	}
+
+	assert.InDelta(t, 0.75, float64(counts["redis-2:6380"])/10000, 0.03)
+	assert.InDelta(t, 0.25, float64(counts["redis-3:6381"])/10000, 0.03)
+}
+
+func TestHealthCheckWithoutEjection(t *testing.T) {
+	proxy, membership, factory := setupMembership(t, 2)
+	metrics := NewPrometheusMetrics(prometheus.NewRegistry(), "redproxy", "redproxy")
+
+	health := NewHealthChecker(proxy, HealthCheckConfig{FailureLimit: 1}, metrics)
+
+	factory.clients["redis-1:6379"].replies["PING"] = errors.New("i/o timeout")
+
+	health.check(time.Now())
+	assert.Equal(t, NodeHealth{Name: "shard1", State: NodeDown, Failures: 1, LastError: "i/o timeout"}, health.Nodes()[0])
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.NodeUp.With(prometheus.Labels{"node": "shard1"})))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.NodeEjected.With(prometheus.Labels{"node": "shard1"})))
+	assert.Nil(t, proxy.ejected.Load())
+
+	app := fiber.New()
+	registerAdminRoutes(app, proxy, metrics, testAdminTokenFunc)
+
+	status, body := adminRequest(t, app, "GET", "/admin/health", "")
+	assert.Equal(t, 200, status)
+	assert.Equal(
+		t,
+		`[{"name":"shard1","state":"down","failures":1,"last_error":"i/o timeout"},`+
+			`{"name":"shard2","state":"up","failures":0}]`,
+		body,
+	)
+
+	// removed nodes are not reported anymore
+	assert.Equal(t, nil, membership.Remove("shard1"))
+	health.check(time.Now())
+	assert.Equal(t, []NodeHealth{{Name: "shard2", State: NodeUp}}, health.Nodes())
+
+	app = fiber.New()
+	registerAdminRoutes(app, NewRedisProxy(setupFakeClients(1)), metrics, testAdminTokenFunc)
+
+	status, body = adminRequest(t, app, "GET", "/admin/health", "")
+	assert.Equal(t, 404, status)
+	assert.Equal(t, `{"error":"health checks are not enabled"}`, body)
+}
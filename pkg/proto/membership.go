@@ -0,0 +1,243 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/kgantsov/redproxy/pkg/consistent_hashing"
+)
+
+var errMembershipDisabled = errors.New("membership changes are not enabled")
+
+// ClientFactory connects to the backend at an address
+type ClientFactory func(addr string) RedisClient
+
+// Membership adds and removes the nodes of a proxy at runtime. The router is
+// rebuilt from the config with the new node list and swapped atomically, so
+// commands in flight finish on the topology they started with. A slot table
+// is kept, only the slots of the added or removed node move.
+type Membership struct {
+	proxy     *RedisProxy
+	config    consistent_hashing.RouterConfig
+	newClient ClientFactory
+
+	mu    sync.Mutex
+	nodes []consistent_hashing.Node
+}
+
+// NewMembership enables membership changes of a proxy routing to the given
+// nodes. Routers are built from the config, its nodes and weights are
+// replaced by the ones of the current nodes.
+func NewMembership(
+	proxy *RedisProxy, config consistent_hashing.RouterConfig, nodes []consistent_hashing.Node, newClient ClientFactory,
+) *Membership {
+	m := &Membership{
+		proxy:     proxy,
+		config:    config,
+		newClient: newClient,
+		nodes:     append([]consistent_hashing.Node{}, nodes...),
+	}
+
+	proxy.membership.Store(m)
+
+	return m
+}
+
+// Nodes returns the nodes sorted by name
+func (m *Membership) Nodes() []consistent_hashing.Node {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nodes := append([]consistent_hashing.Node{}, m.nodes...)
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+
+	return nodes
+}
+
+// Add connects to a new node and reshards to it, the returned migration
+// moves the keys it now owns
+func (m *Membership) Add(node consistent_hashing.Node) (*Migration, error) {
+	if node.Name == "" {
+		node.Name = node.Addr
+	}
+
+	if node.Weight == 0 {
+		node.Weight = 1
+	}
+
+	if node.Addr == "" {
+		return nil, fmt.Errorf("invalid node '%s', expected an address", node.Name)
+	}
+
+	if node.Weight < 0 {
+		return nil, fmt.Errorf("invalid weight of node '%s', expected a positive integer", node.Name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.index(node.Name) >= 0 {
+		return nil, fmt.Errorf("node '%s' already exists", node.Name)
+	}
+
+	nodes := append(append([]consistent_hashing.Node{}, m.nodes...), node)
+
+	router, config, err := m.router(nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	client := m.newClient(node.Addr)
+
+	migration, err := m.proxy.Reshard(router, map[string]RedisClient{node.Name: client})
+	if err != nil {
+		closeClient(client)
+		return nil, err
+	}
+
+	m.nodes = nodes
+	m.config = config
+
+	log.Info().Msgf("Added node %s at %s", node.Name, node.Addr)
+
+	return migration, nil
+}
+
+// Drain reshards away from a node, the returned migration moves its keys to
+// the other nodes and drops it once done
+func (m *Membership) Drain(name string) (*Migration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nodes, router, config, err := m.routerWithout(name)
+	if err != nil {
+		return nil, err
+	}
+
+	migration, err := m.proxy.Reshard(router, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	m.nodes = nodes
+	m.config = config
+
+	log.Info().Msgf("Draining node %s", name)
+
+	return migration, nil
+}
+
+// Remove drops a node right away, its keys are not moved and are lost to the
+// proxy. It is meant for nodes that are gone for good.
+func (m *Membership) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nodes, router, config, err := m.routerWithout(name)
+	if err != nil {
+		return err
+	}
+
+	if err := m.proxy.replaceRouter(router); err != nil {
+		return err
+	}
+
+	m.nodes = nodes
+	m.config = config
+
+	log.Info().Msgf("Removed node %s", name)
+
+	return nil
+}
+
+// index returns the position of a node, -1 if it is unknown
+func (m *Membership) index(name string) int {
+	for i, node := range m.nodes {
+		if node.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// routerWithout builds the router of the nodes other than the given one
+func (m *Membership) routerWithout(
+	name string,
+) ([]consistent_hashing.Node, consistent_hashing.Router, consistent_hashing.RouterConfig, error) {
+	i := m.index(name)
+	if i < 0 {
+		return nil, nil, m.config, fmt.Errorf("unknown node '%s'", name)
+	}
+
+	if len(m.nodes) == 1 {
+		return nil, nil, m.config, fmt.Errorf("node '%s' is the last one", name)
+	}
+
+	nodes := append(append([]consistent_hashing.Node{}, m.nodes[:i]...), m.nodes[i+1:]...)
+
+	router, config, err := m.router(nodes)
+	if err != nil {
+		return nil, nil, m.config, err
+	}
+
+	return nodes, router, config, nil
+}
+
+// router builds the router of the nodes and returns the config it was built
+// from, which becomes the config of the membership once the change is made
+func (m *Membership) router(
+	nodes []consistent_hashing.Node,
+) (consistent_hashing.Router, consistent_hashing.RouterConfig, error) {
+	config := m.config
+	config.Nodes, config.Weights = consistent_hashing.NodeNames(nodes)
+
+	if config.Slots != nil {
+		var err error
+
+		added, removed := diffNodes(m.nodes, nodes)
+
+		config.Slots, err = consistent_hashing.MoveSlots(config.Slots, added, removed, config.Weights)
+		if err != nil {
+			return nil, m.config, err
+		}
+	}
+
+	router, err := consistent_hashing.NewRouterFromConfig(config)
+	if err != nil {
+		return nil, m.config, err
+	}
+
+	return router, config, nil
+}
+
+// diffNodes returns the names of the nodes added to and removed from a list
+func diffNodes(before, after []consistent_hashing.Node) ([]string, []string) {
+	names := map[string]bool{}
+	for _, node := range before {
+		names[node.Name] = true
+	}
+
+	added := []string{}
+
+	for _, node := range after {
+		if !names[node.Name] {
+			added = append(added, node.Name)
+		}
+
+		delete(names, node.Name)
+	}
+
+	removed := []string{}
+	for _, node := range before {
+		if names[node.Name] {
+			removed = append(removed, node.Name)
+		}
+	}
+
+	return added, removed
+}
@@ -0,0 +1,247 @@
+package proto
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kgantsov/redproxy/pkg/consistent_hashing"
+)
+
+// fakeClientFactory hands out fake clients and remembers them by address
+type fakeClientFactory struct {
+	mu      sync.Mutex
+	clients map[string]*fakeRedisClient
+}
+
+func (f *fakeClientFactory) newClient(addr string) RedisClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	client := newFakeRedisClient()
+	f.clients[addr] = client
+
+	return client
+}
+
+// setupMembership returns a proxy of n named shards filled with 100 keys
+func setupMembership(t *testing.T, n int) (*RedisProxy, *Membership, *fakeClientFactory) {
+	return setupRoutedMembership(t, n, consistent_hashing.RouterConfig{Routing: consistent_hashing.RoutingKetama})
+}
+
+// setupRoutedMembership is setupMembership with the given router config
+func setupRoutedMembership(
+	t *testing.T, n int, config consistent_hashing.RouterConfig,
+) (*RedisProxy, *Membership, *fakeClientFactory) {
+	factory := &fakeClientFactory{clients: map[string]*fakeRedisClient{}}
+	nodes := []consistent_hashing.Node{}
+	clients := map[string]RedisClient{}
+
+	for i := 1; i <= n; i++ {
+		node := consistent_hashing.Node{
+			Name: fmt.Sprintf("shard%d", i), Addr: fmt.Sprintf("redis-%d:6379", i), Weight: 1,
+		}
+
+		nodes = append(nodes, node)
+		clients[node.Name] = factory.newClient(node.Addr)
+	}
+
+	config.Nodes, config.Weights = consistent_hashing.NodeNames(nodes)
+
+	router, err := consistent_hashing.NewRouterFromConfig(config)
+	assert.Equal(t, nil, err)
+
+	proxy, err := NewRedisProxyWithRouter(clients, router)
+	assert.Equal(t, nil, err)
+
+	commands := []string{}
+	for i := 0; i < 100; i++ {
+		commands = append(commands, encodeCommand("SET", fmt.Sprintf("key_%d", i), fmt.Sprint(i)))
+	}
+
+	runCommands(proxy, commands...)
+
+	return proxy, NewMembership(proxy, config, nodes, factory.newClient), factory
+}
+
+// migrate runs the migration of the last resharding to the end
+func migrate(t *testing.T, proxy *RedisProxy) {
+	metrics := NewPrometheusMetrics(prometheus.NewRegistry(), "redproxy", "redproxy")
+
+	assert.Equal(t, nil, proxy.Migration().Start(metrics))
+	assert.Eventually(t, func() bool {
+		return proxy.Migration().Status().State == MigrationDone
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// assertKeys checks that every key still has its value through the proxy
+func assertKeys(t *testing.T, proxy *RedisProxy) {
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		assert.Equal(t, fmt.Sprint(i), proxy.Get(context.Background(), key).Val(), key)
+	}
+}
+
+func TestMembershipAdd(t *testing.T) {
+	proxy, _, factory := setupMembership(t, 2)
+
+	// commands keep being served while the node joins
+	var wg sync.WaitGroup
+
+	stop := make(chan struct{})
+
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; ; i = (i + 1) % 100 {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				key := fmt.Sprintf("key_%d", i)
+				assert.Equal(t, fmt.Sprint(i), proxy.Get(context.Background(), key).Val(), key)
+			}
+		}()
+	}
+
+	assert.Equal(
+		t,
+		"+OK\r\n"+
+			"-ERR node 'shard3' already exists\r\n"+
+			"-ERR resharding is already in progress\r\n"+
+			"-ERR invalid node 'a,b', expected [name=]host:port[=weight]\r\n"+
+			"*3\r\n"+
+			"*3\r\n$6\r\nshard1\r\n$12\r\nredis-1:6379\r\n:1\r\n"+
+			"*3\r\n$6\r\nshard2\r\n$12\r\nredis-2:6379\r\n:1\r\n"+
+			"*3\r\n$6\r\nshard3\r\n$12\r\nredis-3:6379\r\n:2\r\n",
+		runAdminCommands(
+			proxy,
+			encodeCommand("PROXY", "NODE", "ADD", "shard3=redis-3:6379=2"),
+			encodeCommand("PROXY", "NODE", "ADD", "shard3=redis-4:6379"),
+			encodeCommand("PROXY", "NODE", "ADD", "shard4=redis-4:6379"),
+			encodeCommand("PROXY", "NODE", "ADD", "a,b"),
+			encodeCommand("PROXY", "NODES"),
+		),
+	)
+
+	migrate(t, proxy)
+
+	close(stop)
+	wg.Wait()
+
+	assertKeys(t, proxy)
+	assert.NotEmpty(t, factory.clients["redis-3:6379"].strings, "the new node owns keys")
+	assert.Equal(t, 3, len(proxy.topology.Load().clients))
+}
+
+func TestMembershipDrain(t *testing.T) {
+	proxy, membership, factory := setupMembership(t, 3)
+
+	assert.NotEmpty(t, factory.clients["redis-2:6379"].strings)
+	assert.Equal(t, "+OK\r\n", runAdminCommands(proxy, encodeCommand("PROXY", "NODE", "DRAIN", "shard2")))
+
+	assertKeys(t, proxy)
+	migrate(t, proxy)
+	assertKeys(t, proxy)
+
+	assert.Empty(t, factory.clients["redis-2:6379"].strings, "the drained node has no keys left")
+	assert.Equal(t, []string{"shard1", "shard3"}, proxy.topology.Load().router.Nodes())
+	assert.Equal(t, 2, len(proxy.topology.Load().clients))
+	assert.Equal(t, 2, len(membership.Nodes()))
+}
+
+func TestMembershipSlots(t *testing.T) {
+	ranges, err := consistent_hashing.ParseSlotRanges("0-999=shard1,1000-16383=shard2")
+	assert.Equal(t, nil, err)
+
+	proxy, membership, factory := setupRoutedMembership(
+		t, 2, consistent_hashing.RouterConfig{Routing: consistent_hashing.RoutingSlots, Slots: ranges},
+	)
+	previous := proxy.topology.Load().router
+
+	_, err = membership.Add(consistent_hashing.Node{Name: "shard3", Addr: "redis-3:6379"})
+	assert.Equal(t, nil, err)
+
+	// the new node takes a third of the slots, the others keep theirs
+	want, err := consistent_hashing.ParseSlotRanges(
+		"0-666=shard1,667-999=shard3,1000-11255=shard2,11256-16383=shard3",
+	)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, want, membership.config.Slots)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key_%d", i)
+
+		if node := proxy.topology.Load().router.GetNode(key); node != "shard3" {
+			assert.Equal(t, previous.GetNode(key), node, key)
+		}
+	}
+
+	migrate(t, proxy)
+	assertKeys(t, proxy)
+	assert.NotEmpty(t, factory.clients["redis-3:6379"].strings, "the new node owns keys")
+
+	// its slots are shared between the others once drained
+	_, err = membership.Drain("shard3")
+	assert.Equal(t, nil, err)
+
+	want, err = consistent_hashing.ParseSlotRanges(
+		"0-999=shard1,1000-11255=shard2,11256-13653=shard1,13654-16383=shard2",
+	)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, want, membership.config.Slots)
+
+	migrate(t, proxy)
+	assertKeys(t, proxy)
+	assert.Empty(t, factory.clients["redis-3:6379"].strings)
+}
+
+func TestMembershipRemove(t *testing.T) {
+	proxy, membership, factory := setupMembership(t, 2)
+
+	assert.Equal(
+		t,
+		"-ERR unknown node 'shard3'\r\n+OK\r\n-ERR node 'shard2' is the last one\r\n"+
+			"-ERR unknown node action 'MOVE', expected ADD, DRAIN or REMOVE\r\n",
+		runAdminCommands(
+			proxy,
+			encodeCommand("PROXY", "NODE", "REMOVE", "shard3"),
+			encodeCommand("PROXY", "NODE", "REMOVE", "shard1"),
+			encodeCommand("PROXY", "NODE", "REMOVE", "shard2"),
+			encodeCommand("PROXY", "NODE", "MOVE", "shard2"),
+		),
+	)
+
+	// the keys of the removed node are gone, the others are kept
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%d", i)
+
+		if _, ok := factory.clients["redis-2:6379"].strings[key]; ok {
+			assert.Equal(t, fmt.Sprint(i), proxy.Get(context.Background(), key).Val(), key)
+		} else {
+			assert.Equal(t, "", proxy.Get(context.Background(), key).Val(), key)
+		}
+	}
+
+	assert.Equal(t, []consistent_hashing.Node{{Name: "shard2", Addr: "redis-2:6379", Weight: 1}}, membership.Nodes())
+
+	assert.Equal(
+		t,
+		"-ERR membership changes are not enabled\r\n-ERR membership changes are not enabled\r\n",
+		runAdminCommands(
+			NewRedisProxy(setupFakeClients(1)),
+			encodeCommand("PROXY", "NODES"),
+			encodeCommand("PROXY", "NODE", "DRAIN", "shard1"),
+		),
+	)
+}
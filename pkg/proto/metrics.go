@@ -8,8 +8,18 @@ import (
 type PrometheusMetrics struct {
 	CommandsProxiedTotal *prometheus.CounterVec
 	Connections          *prometheus.GaugeVec
+	PanicsTotal          *prometheus.CounterVec
 	Latency              *prometheus.HistogramVec
 	Registry             *prometheus.Registry
+
+	MigrationRunning          *prometheus.GaugeVec
+	MigrationNodesPending     *prometheus.GaugeVec
+	MigrationKeysScannedTotal *prometheus.CounterVec
+	MigrationKeysMovedTotal   *prometheus.CounterVec
+	MigrationErrorsTotal      *prometheus.CounterVec
+
+	NodeUp      *prometheus.GaugeVec
+	NodeEjected *prometheus.GaugeVec
 }
 
 func NewPrometheusMetrics(registry prometheus.Registerer, namespace, subsystem string) *PrometheusMetrics {
@@ -35,6 +45,16 @@ func NewPrometheusMetrics(registry prometheus.Registerer, namespace, subsystem s
 		[]string{},
 	)
 
+	m.PanicsTotal = promauto.With(registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "redproxy_panics_total",
+			Help:      "Number of panics recovered while handling client requests",
+		},
+		[]string{},
+	)
+
 	m.Latency = promauto.With(registry).NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: namespace,
@@ -68,5 +88,75 @@ func NewPrometheusMetrics(registry prometheus.Registerer, namespace, subsystem s
 		[]string{},
 	)
 
+	m.MigrationRunning = promauto.With(registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "redproxy_migration_running",
+			Help:      "Whether keys are being migrated after a resharding",
+		},
+		[]string{},
+	)
+
+	m.MigrationNodesPending = promauto.With(registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "redproxy_migration_nodes_pending",
+			Help:      "Number of nodes left to scan for keys to migrate",
+		},
+		[]string{},
+	)
+
+	m.MigrationKeysScannedTotal = promauto.With(registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "redproxy_migration_keys_scanned_total",
+			Help:      "Number of keys checked by the migration",
+		},
+		[]string{},
+	)
+
+	m.MigrationKeysMovedTotal = promauto.With(registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "redproxy_migration_keys_moved_total",
+			Help:      "Number of keys moved to their new node by the migration",
+		},
+		[]string{},
+	)
+
+	m.MigrationErrorsTotal = promauto.With(registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "redproxy_migration_errors_total",
+			Help:      "Number of keys and scans the migration failed on",
+		},
+		[]string{},
+	)
+
+	m.NodeUp = promauto.With(registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "redproxy_node_up",
+			Help:      "Whether a node is up according to the health checks",
+		},
+		[]string{"node"},
+	)
+
+	m.NodeEjected = promauto.With(registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "redproxy_node_ejected",
+			Help:      "Whether a node is ejected from routing after failing its health checks",
+		},
+		[]string{"node"},
+	)
+
 	return m
 }
@@ -0,0 +1,99 @@
+package proto
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ansrivas/fiberprometheus/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/rs/zerolog/log"
+)
+
+// MetricsServer serves the metrics and the admin API of the pools of a
+// process on a single address. The metrics of a pool carry its name in the
+// pool label and its admin API is under /pools/<name>/admin.
+type MetricsServer struct {
+	Addr     string
+	Registry *prometheus.Registry
+	// AdminToken is the bearer token of the admin API routes making changes,
+	// they are disabled when it is empty
+	AdminToken string
+
+	router *fiber.App
+
+	mu    sync.Mutex
+	pools map[string]*RedisProxy
+	// metrics of the pools, the admin API starts migrations with them
+	metrics map[string]*PrometheusMetrics
+}
+
+func NewMetricsServer(addr string) *MetricsServer {
+	router := fiber.New()
+
+	registry := prometheus.NewRegistry()
+
+	prom := fiberprometheus.NewWithRegistry(
+		registry, "redproxy", "redproxy", "redproxy", map[string]string{},
+	)
+	prom.RegisterAt(router, "/metrics")
+	router.Use(prom.Middleware)
+	registry.Register(collectors.NewGoCollector())
+
+	return &MetricsServer{
+		Addr:     addr,
+		Registry: registry,
+		router:   router,
+		pools:    map[string]*RedisProxy{},
+		metrics:  map[string]*PrometheusMetrics{},
+	}
+}
+
+// AddPool registers the metrics of a pool and its admin API, the returned
+// metrics are the ones to hand to the server of the pool
+func (m *MetricsServer) AddPool(name string, proxy *RedisProxy) (*PrometheusMetrics, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.pools[name]; ok {
+		return nil, fmt.Errorf("pool '%s' is already registered", name)
+	}
+
+	registerer := prometheus.WrapRegistererWith(prometheus.Labels{"pool": name}, m.Registry)
+	metrics := NewPrometheusMetrics(registerer, "redproxy", "redproxy")
+
+	registerAdminRoutes(m.router.Group("/pools/"+name), proxy, metrics, m.adminToken)
+
+	m.pools[name] = proxy
+	m.metrics[name] = metrics
+
+	return metrics, nil
+}
+
+// ListenAndServe serves until the listener fails. With a single pool its
+// admin API is also served under /admin.
+func (m *MetricsServer) ListenAndServe() error {
+	m.registerSinglePoolRoutes()
+
+	log.Info().Msgf("Serving metrics on %s", m.Addr)
+
+	return m.router.Listen(m.Addr)
+}
+
+func (m *MetricsServer) registerSinglePoolRoutes() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.pools) != 1 {
+		return
+	}
+
+	for name, proxy := range m.pools {
+		registerAdminRoutes(m.router, proxy, m.metrics[name], m.adminToken)
+	}
+}
+
+func (m *MetricsServer) adminToken() string {
+	return m.AdminToken
+}
@@ -0,0 +1,79 @@
+package proto
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsServerPools(t *testing.T) {
+	sessions, _, _ := setupMembership(t, 2)
+	cache, _, _ := setupMembership(t, 3)
+
+	server := NewMetricsServer(":0")
+
+	sessionsMetrics, err := server.AddPool("sessions", sessions)
+	assert.Equal(t, nil, err)
+
+	cacheMetrics, err := server.AddPool("cache", cache)
+	assert.Equal(t, nil, err)
+
+	_, err = server.AddPool("cache", cache)
+	assert.EqualError(t, err, "pool 'cache' is already registered")
+
+	sessionsMetrics.CommandsProxiedTotal.With(prometheus.Labels{}).Add(2)
+	cacheMetrics.CommandsProxiedTotal.With(prometheus.Labels{}).Inc()
+
+	assert.Equal(t, nil, testutil.GatherAndCompare(server.Registry, strings.NewReader(`
+# HELP redproxy_redproxy_redproxy_commands_proxied_total Number of commands proxied
+# TYPE redproxy_redproxy_redproxy_commands_proxied_total counter
+redproxy_redproxy_redproxy_commands_proxied_total{pool="cache"} 1
+redproxy_redproxy_redproxy_commands_proxied_total{pool="sessions"} 2
+`), "redproxy_redproxy_redproxy_commands_proxied_total"))
+
+	tests := []struct {
+		url    string
+		status int
+		want   string
+	}{
+		{
+			url: "/pools/sessions/admin/nodes", status: 200,
+			want: `[{"name":"shard1","addr":"redis-1:6379","weight":1},` +
+				`{"name":"shard2","addr":"redis-2:6379","weight":1}]`,
+		},
+		{
+			url: "/pools/cache/admin/nodes", status: 200,
+			want: `[{"name":"shard1","addr":"redis-1:6379","weight":1},` +
+				`{"name":"shard2","addr":"redis-2:6379","weight":1},` +
+				`{"name":"shard3","addr":"redis-3:6379","weight":1}]`,
+		},
+		{url: "/pools/other/admin/nodes", status: 404, want: "Cannot GET /pools/other/admin/nodes"},
+	}
+
+	for _, tc := range tests {
+		status, body := adminRequest(t, server.router, "GET", tc.url, "")
+
+		assert.Equal(t, tc.status, status, tc.url)
+		assert.Equal(t, tc.want, body, tc.url)
+	}
+
+	// the admin API of a pool is only served under /admin when it is alone
+	server.registerSinglePoolRoutes()
+
+	status, _ := adminRequest(t, server.router, "GET", "/admin/nodes", "")
+	assert.Equal(t, 404, status)
+
+	single := NewMetricsServer(":0")
+
+	_, err = single.AddPool("sessions", sessions)
+	assert.Equal(t, nil, err)
+
+	single.registerSinglePoolRoutes()
+
+	status, body := adminRequest(t, single.router, "GET", "/admin/nodes", "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `[{"name":"shard1","addr":"redis-1:6379","weight":1},{"name":"shard2","addr":"redis-2:6379","weight":1}]`, body)
+}
@@ -0,0 +1,493 @@
+package proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/kgantsov/redproxy/pkg/consistent_hashing"
+)
+
+// DefaultMigrationBatchSize is the COUNT hint of the SCAN commands listing the
+// keys to migrate
+const DefaultMigrationBatchSize = 100
+
+type MigrationState string
+
+const (
+	MigrationIdle    MigrationState = "idle"
+	MigrationRunning MigrationState = "running"
+	MigrationPaused  MigrationState = "paused"
+	MigrationDone    MigrationState = "done"
+)
+
+var (
+	errNotResharding    = errors.New("no resharding in progress")
+	errAlreadyReshard   = errors.New("resharding is already in progress")
+	errMigrationRunning = errors.New("migration is already running")
+	errMigrationStopped = errors.New("migration is not running")
+	errMigrationDone    = errors.New("migration is already done")
+)
+
+// MigrationStatus is a snapshot of the progress of a migration
+type MigrationStatus struct {
+	State       MigrationState `json:"state"`
+	Nodes       int            `json:"nodes"`
+	NodesDone   int            `json:"nodes_done"`
+	KeysScanned int64          `json:"keys_scanned"`
+	KeysMoved   int64          `json:"keys_moved"`
+	Errors      int64          `json:"errors"`
+}
+
+// Migration moves the keys that belong to another node after a resharding.
+// It SCANs the nodes of the previous router one after another and moves
+// every key whose owner changed with DUMP and RESTORE, keeping its TTL.
+// Requests don't wait for it: reads fall back to the previous owner and
+// writes move their key on their own.
+type Migration struct {
+	proxy *RedisProxy
+	nodes []string
+
+	// BatchSize is the COUNT hint of the SCAN commands
+	BatchSize int64
+	// RetryInterval is the pause after a failed SCAN before it is retried, and
+	// between the checks for the ejected nodes to be back
+	RetryInterval time.Duration
+
+	mu      sync.Mutex
+	state   MigrationState
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	// nodesDone nodes have been scanned, cursor is the SCAN cursor of the next
+	nodesDone int
+	cursor    uint64
+	scanned   int64
+	moved     int64
+	failed    int64
+}
+
+func newMigration(proxy *RedisProxy, nodes []string) *Migration {
+	return &Migration{
+		proxy:         proxy,
+		nodes:         nodes,
+		BatchSize:     DefaultMigrationBatchSize,
+		RetryInterval: time.Second,
+		state:         MigrationIdle,
+	}
+}
+
+// Reshard starts routing keys with a new router. The clients of nodes the
+// proxy doesn't know yet are added to the existing ones. Until the returned
+// migration is done, the keys that changed owner are still found on their
+// previous one.
+func (c *RedisProxy) Reshard(router consistent_hashing.Router, clients map[string]RedisClient) (*Migration, error) {
+	// wait for the commands routed with the current router
+	c.reshardMu.Lock()
+	defer c.reshardMu.Unlock()
+
+	for {
+		current := c.topology.Load()
+		if current.previous != nil {
+			return nil, errAlreadyReshard
+		}
+
+		merged := make(map[string]RedisClient, len(current.clients)+len(clients))
+		for node, client := range current.clients {
+			merged[node] = client
+		}
+
+		for node, client := range clients {
+			merged[node] = client
+		}
+
+		for _, node := range router.Nodes() {
+			if _, ok := merged[node]; !ok {
+				return nil, fmt.Errorf("no client for node %s of the router", node)
+			}
+		}
+
+		next := &topology{router: router, clients: merged, previous: current.router}
+
+		if c.topology.CompareAndSwap(current, next) {
+			m := newMigration(c, current.router.Nodes())
+			c.migration.Store(m)
+
+			log.Info().Msgf("Resharding from %v to %v", current.router.Nodes(), router.Nodes())
+
+			return m, nil
+		}
+	}
+}
+
+// Migration returns the migration of the last resharding, nil if the proxy
+// was never resharded
+func (c *RedisProxy) Migration() *Migration {
+	return c.migration.Load()
+}
+
+// resharding reports whether keys may still be on their previous owner
+func (c *RedisProxy) resharding() bool {
+	return c.topology.Load().previous != nil
+}
+
+// finishResharding drops the previous router and closes the clients of the
+// nodes that aren't used anymore
+func (c *RedisProxy) finishResharding() {
+	for {
+		current := c.topology.Load()
+		if current.previous == nil {
+			return
+		}
+
+		next, err := c.routerTopology(current, current.router)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to finish resharding")
+			return
+		}
+
+		if c.topology.CompareAndSwap(current, next) {
+			closeDropped(current, next)
+
+			log.Info().Msgf("Resharding to %v is done", current.router.Nodes())
+
+			return
+		}
+	}
+}
+
+// moveKey moves a key to its new owner if its previous owner is another node.
+// Nothing is moved from or to an ejected node, a key moved to the node the
+// keys of an ejected owner are routed to meanwhile would be stranded there
+// once it is back. The migration moves the key later.
+func (c *RedisProxy) moveKey(ctx context.Context, t *topology, key string) error {
+	hashKey := c.hashKey(key)
+	node := t.router.GetNode(hashKey)
+	previous := t.previous.GetNode(hashKey)
+
+	if node == previous || c.isEjected(node) || c.isEjected(previous) {
+		return nil
+	}
+
+	_, err := c.migrateKey(ctx, key, t.clients[previous], t.clients[node])
+
+	return err
+}
+
+// migrateKey copies a key with its TTL and deletes it from the source. A key
+// the target already has was written since the resharding and is kept.
+// It reports whether the source had the key.
+func (c *RedisProxy) migrateKey(ctx context.Context, key string, from, to RedisClient) (bool, error) {
+	lock := c.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	ttl, err := from.Do(ctx, "PTTL", key).Int64()
+	if err != nil {
+		return false, err
+	}
+
+	// the key doesn't exist or has just expired
+	if ttl == -2 {
+		return false, nil
+	}
+
+	// the key expires in less than a millisecond, RESTORE would make it
+	// persistent as a TTL of 0 means none
+	if ttl == 0 {
+		return false, from.Del(ctx, key).Err()
+	}
+
+	if ttl == -1 {
+		ttl = 0
+	}
+
+	payload, err := from.Do(ctx, "DUMP", key).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	err = to.Do(ctx, "RESTORE", key, ttl, payload).Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYKEY") {
+		return false, err
+	}
+
+	return true, from.Del(ctx, key).Err()
+}
+
+// Start runs the migration in the background, a paused migration resumes
+// where it stopped
+func (m *Migration) Start(metrics *PrometheusMetrics) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch m.state {
+	case MigrationRunning:
+		return errMigrationRunning
+	case MigrationDone:
+		return errMigrationDone
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m.state = MigrationRunning
+	m.cancel = cancel
+	m.stopped = make(chan struct{})
+
+	metrics.MigrationRunning.With(prometheus.Labels{}).Set(1)
+	metrics.MigrationNodesPending.With(prometheus.Labels{}).Set(float64(len(m.nodes) - m.nodesDone))
+
+	go m.run(ctx, metrics, m.stopped)
+
+	log.Info().Msgf("Migration of %d nodes started", len(m.nodes)-m.nodesDone)
+
+	return nil
+}
+
+// Pause stops the migration after the key being moved, Start resumes it
+func (m *Migration) Pause() error {
+	if err := m.stop(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.state == MigrationRunning {
+		m.state = MigrationPaused
+	}
+
+	log.Info().Msg("Migration paused")
+
+	return nil
+}
+
+// Abort stops the migration and forgets its progress, Start begins it again.
+// The proxy keeps looking up keys on their previous owner, the moved keys
+// are not moved back.
+func (m *Migration) Abort() error {
+	m.mu.Lock()
+	state := m.state
+	m.mu.Unlock()
+
+	switch state {
+	case MigrationDone:
+		return errMigrationDone
+	case MigrationRunning:
+		if err := m.stop(); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.state == MigrationDone {
+		return errMigrationDone
+	}
+
+	m.state = MigrationIdle
+	m.nodesDone = 0
+	m.cursor = 0
+	m.scanned = 0
+	m.moved = 0
+	m.failed = 0
+
+	log.Info().Msg("Migration aborted")
+
+	return nil
+}
+
+// stop cancels the background migration and waits for it to return
+func (m *Migration) stop() error {
+	m.mu.Lock()
+
+	if m.state != MigrationRunning {
+		m.mu.Unlock()
+		return errMigrationStopped
+	}
+
+	cancel, stopped := m.cancel, m.stopped
+	m.mu.Unlock()
+
+	cancel()
+	<-stopped
+
+	return nil
+}
+
+// Status returns the progress of the migration
+func (m *Migration) Status() MigrationStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return MigrationStatus{
+		State:       m.state,
+		Nodes:       len(m.nodes),
+		NodesDone:   m.nodesDone,
+		KeysScanned: m.scanned,
+		KeysMoved:   m.moved,
+		Errors:      m.failed,
+	}
+}
+
+func (m *Migration) run(ctx context.Context, metrics *PrometheusMetrics, stopped chan struct{}) {
+	defer close(stopped)
+	defer metrics.MigrationRunning.With(prometheus.Labels{}).Set(0)
+
+	for {
+		// keys are only moved to their new owner, the migration waits for
+		// the ejected nodes to be back
+		if m.proxy.anyEjected() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(m.RetryInterval):
+			}
+
+			continue
+		}
+
+		m.mu.Lock()
+		if m.nodesDone == len(m.nodes) {
+			m.state = MigrationDone
+			m.mu.Unlock()
+
+			m.proxy.finishResharding()
+
+			return
+		}
+
+		node, cursor := m.nodes[m.nodesDone], m.cursor
+		m.mu.Unlock()
+
+		next, err := m.migrateBatch(ctx, metrics, node, cursor)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to scan node %s for keys to migrate", node)
+			metrics.MigrationErrorsTotal.With(prometheus.Labels{}).Inc()
+
+			m.mu.Lock()
+			m.failed++
+			m.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(m.RetryInterval):
+			}
+
+			continue
+		}
+
+		m.mu.Lock()
+		m.cursor = next
+
+		if next == 0 {
+			m.nodesDone++
+			metrics.MigrationNodesPending.With(prometheus.Labels{}).Set(float64(len(m.nodes) - m.nodesDone))
+
+			log.Info().Msgf("Migration of node %s is done", node)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// migrateBatch scans a batch of keys of a node and moves those that belong to
+// another node now, it returns the next SCAN cursor
+func (m *Migration) migrateBatch(
+	ctx context.Context, metrics *PrometheusMetrics, node string, cursor uint64,
+) (uint64, error) {
+	t := m.proxy.topology.Load()
+	client := t.clients[node]
+
+	reply, err := client.Do(ctx, "SCAN", cursor, "COUNT", m.BatchSize).Slice()
+	if err != nil {
+		return 0, err
+	}
+
+	next, keys, err := parseScanReply(reply)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+
+		metrics.MigrationKeysScannedTotal.With(prometheus.Labels{}).Inc()
+
+		owner := t.router.GetNode(m.proxy.hashKey(key))
+
+		var moved bool
+
+		if owner != node {
+			moved, err = m.proxy.migrateKey(ctx, key, client, t.clients[owner])
+		}
+
+		m.mu.Lock()
+		m.scanned++
+
+		switch {
+		case err != nil:
+			m.failed++
+		case moved:
+			m.moved++
+		}
+		m.mu.Unlock()
+
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to migrate key %s from %s to %s", key, node, owner)
+			metrics.MigrationErrorsTotal.With(prometheus.Labels{}).Inc()
+
+			err = nil
+		} else if moved {
+			metrics.MigrationKeysMovedTotal.With(prometheus.Labels{}).Inc()
+		}
+	}
+
+	return next, nil
+}
+
+// parseScanReply decodes the cursor and the keys of a SCAN reply
+func parseScanReply(reply []interface{}) (uint64, []string, error) {
+	if len(reply) != 2 {
+		return 0, nil, fmt.Errorf("unexpected SCAN reply %v", reply)
+	}
+
+	cursorStr, _ := reply[0].(string)
+
+	cursor, err := strconv.ParseUint(cursorStr, 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid SCAN cursor %v", reply[0])
+	}
+
+	values, _ := reply[1].([]interface{})
+	keys := make([]string, 0, len(values))
+
+	for _, value := range values {
+		key, ok := value.(string)
+		if !ok {
+			return 0, nil, fmt.Errorf("invalid SCAN key %v", value)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return cursor, keys, nil
+}
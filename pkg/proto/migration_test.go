@@ -0,0 +1,314 @@
+package proto
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kgantsov/redproxy/pkg/consistent_hashing"
+)
+
+// setupResharding fills two shards through the proxy and reshards to three,
+// it returns the proxy, the clients of the shards and the new router
+func setupResharding(t *testing.T) (*RedisProxy, map[string]RedisClient, consistent_hashing.Router) {
+	clients := map[string]RedisClient{
+		"shard1": newFakeRedisClient(),
+		"shard2": newFakeRedisClient(),
+		"shard3": newFakeRedisClient(),
+	}
+
+	previous, err := consistent_hashing.NewRouter(consistent_hashing.RoutingKetama, []string{"shard1", "shard2"})
+	assert.Equal(t, nil, err)
+
+	proxy, err := NewRedisProxyWithRouter(clients, previous)
+	assert.Equal(t, nil, err)
+
+	commands := []string{}
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			commands = append(commands, encodeCommand("SET", fmt.Sprintf("key_%d", i), "value", "PX", "60000"))
+		} else {
+			commands = append(commands, encodeCommand("SET", fmt.Sprintf("key_%d", i), fmt.Sprint(i)))
+		}
+	}
+
+	runCommands(proxy, commands...)
+
+	router, err := consistent_hashing.NewRouter(consistent_hashing.RoutingKetama, []string{"shard1", "shard2", "shard3"})
+	assert.Equal(t, nil, err)
+
+	_, err = proxy.Reshard(router, nil)
+	assert.Equal(t, nil, err)
+
+	return proxy, clients, router
+}
+
+// assertMigrated checks that every key is only on its new owner with its TTL
+func assertMigrated(t *testing.T, clients map[string]RedisClient, router consistent_hashing.Router) {
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%d", i)
+
+		for node, client := range clients {
+			fake := client.(*fakeRedisClient)
+			_, ok := fake.strings[key]
+
+			assert.Equal(t, node == router.GetNode(key), ok, key)
+
+			if ok && i%2 == 0 {
+				assert.Equal(t, 60*time.Second, fake.ttls[key], key)
+			}
+		}
+	}
+}
+
+func TestReshardReadsAndWrites(t *testing.T) {
+	proxy, clients, router := setupResharding(t)
+
+	// every key is still readable, wherever it is
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		want := "$5\r\nvalue\r\n"
+
+		if i%2 != 0 {
+			want = fmt.Sprintf("$%d\r\n%d\r\n", len(fmt.Sprint(i)), i)
+		}
+
+		assert.Equal(t, want, runCommands(proxy, encodeCommand("GET", key)), key)
+	}
+
+	// writes move their key first so they apply to its value
+	moved := 0
+
+	for i := 1; i < 100; i += 2 {
+		key := fmt.Sprintf("key_%d", i)
+		if router.GetNode(key) != "shard3" {
+			continue
+		}
+
+		moved++
+
+		assert.Equal(t, fmt.Sprintf(":%d\r\n", i+1), runCommands(proxy, encodeCommand("INCR", key)), key)
+		assert.Equal(t, fmt.Sprint(i+1), clients["shard3"].(*fakeRedisClient).strings[key], key)
+		assert.Equal(t, int64(0), clients["shard1"].Exists(context.Background(), key).Val(), key)
+		assert.Equal(t, int64(0), clients["shard2"].Exists(context.Background(), key).Val(), key)
+	}
+
+	assert.True(t, moved > 0, "some keys belong to the new shard")
+
+	_, err := proxy.Reshard(router, nil)
+	assert.EqualError(t, err, "resharding is already in progress")
+}
+
+func TestReshardWithEjectedNode(t *testing.T) {
+	proxy, clients, router := setupResharding(t)
+	proxy.eject("shard3")
+
+	migration := proxy.Migration()
+	migration.RetryInterval = time.Millisecond
+
+	// the keys of the ejected new owner stay on their previous owner
+	written := map[string]string{}
+
+	for i := 1; i < 100; i += 2 {
+		key := fmt.Sprintf("key_%d", i)
+		if router.GetNode(key) != "shard3" {
+			continue
+		}
+
+		written[key] = fmt.Sprint(i + 1)
+		previous := proxy.topology.Load().previous.GetNode(key)
+
+		assert.Equal(t, fmt.Sprintf(":%d\r\n", i+1), runCommands(proxy, encodeCommand("INCR", key)), key)
+		assert.Equal(t, fmt.Sprint(i+1), clients[previous].(*fakeRedisClient).strings[key], key)
+	}
+
+	assert.True(t, len(written) > 0, "some keys belong to the new shard")
+
+	// the migration waits for the node to be back
+	metrics := NewPrometheusMetrics(prometheus.NewRegistry(), "redproxy", "redproxy")
+	assert.Equal(t, nil, migration.Start(metrics))
+
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Equal(t, MigrationRunning, migration.Status().State)
+	assert.Equal(t, int64(0), migration.Status().KeysScanned)
+
+	proxy.readmit("shard3")
+
+	assert.Eventually(t, func() bool {
+		return migration.Status().State == MigrationDone
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assertMigrated(t, clients, router)
+
+	for key, value := range written {
+		assert.Equal(t, fmt.Sprintf("$%d\r\n%s\r\n", len(value), value), runCommands(proxy, encodeCommand("GET", key)), key)
+	}
+}
+
+func TestMigrateKeyTTL(t *testing.T) {
+	proxy := NewRedisProxy(setupFakeClients(2))
+
+	tests := []struct {
+		ttl      time.Duration
+		migrated bool
+	}{
+		{ttl: -1, migrated: true},
+		{ttl: time.Minute, migrated: true},
+		// expires before the copy would, it is not restored without a TTL
+		{ttl: 500 * time.Microsecond, migrated: false},
+	}
+
+	for _, tc := range tests {
+		from, to := newFakeRedisClient(), newFakeRedisClient()
+		from.strings["key"] = "value"
+
+		if tc.ttl > 0 {
+			from.ttls["key"] = tc.ttl
+		}
+
+		migrated, err := proxy.migrateKey(context.Background(), "key", from, to)
+
+		assert.Equal(t, nil, err, tc.ttl)
+		assert.Equal(t, tc.migrated, migrated, tc.ttl)
+		assert.Equal(t, int64(0), from.Exists(context.Background(), "key").Val(), tc.ttl)
+
+		_, ok := to.strings["key"]
+		assert.Equal(t, tc.migrated, ok, tc.ttl)
+
+		if ok {
+			ttl, expires := to.ttls["key"]
+			assert.Equal(t, tc.ttl > 0, expires, tc.ttl)
+
+			if expires {
+				assert.Equal(t, tc.ttl, ttl, tc.ttl)
+			}
+		}
+	}
+}
+
+func TestMigration(t *testing.T) {
+	proxy, clients, router := setupResharding(t)
+	migration := proxy.Migration()
+	migration.BatchSize = 7
+
+	moving := 0
+
+	for node, client := range clients {
+		for key := range client.(*fakeRedisClient).strings {
+			if router.GetNode(key) != node {
+				moving++
+			}
+		}
+	}
+
+	metrics := NewPrometheusMetrics(prometheus.NewRegistry(), "redproxy", "redproxy")
+
+	assert.Equal(t, nil, migration.Start(metrics))
+	assert.Eventually(t, func() bool {
+		return migration.Status().State == MigrationDone
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assertMigrated(t, clients, router)
+
+	assert.Equal(t, MigrationStatus{
+		State:       MigrationDone,
+		Nodes:       2,
+		NodesDone:   2,
+		KeysScanned: 100,
+		KeysMoved:   int64(moving),
+	}, migration.Status())
+
+	assert.Equal(t, float64(100), testutil.ToFloat64(metrics.MigrationKeysScannedTotal))
+	assert.Equal(t, float64(moving), testutil.ToFloat64(metrics.MigrationKeysMovedTotal))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.MigrationNodesPending))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.MigrationRunning))
+
+	assert.False(t, proxy.resharding())
+
+	assert.Equal(
+		t,
+		fmt.Sprintf(
+			"*12\r\n$5\r\nstate\r\n$4\r\ndone\r\n$5\r\nnodes\r\n:2\r\n$10\r\nnodes_done\r\n:2\r\n"+
+				"$12\r\nkeys_scanned\r\n:100\r\n$10\r\nkeys_moved\r\n:%d\r\n$6\r\nerrors\r\n:0\r\n"+
+				"-ERR migration is already done\r\n",
+			moving,
+		),
+		runAdminCommands(
+			proxy,
+			encodeCommand("PROXY", "MIGRATION", "STATUS"),
+			encodeCommand("PROXY", "MIGRATION", "START"),
+		),
+	)
+}
+
+func TestMigrationPauseAbort(t *testing.T) {
+	proxy, clients, router := setupResharding(t)
+	proxy.Migration().BatchSize = 1
+
+	for _, client := range clients {
+		client.(*fakeRedisClient).latency = time.Millisecond
+	}
+
+	assert.Equal(
+		t,
+		"-ERR migration is not running\r\n+OK\r\n-ERR migration is already running\r\n+OK\r\n-ERR migration is not running\r\n",
+		runAdminCommands(
+			proxy,
+			encodeCommand("PROXY", "MIGRATION", "PAUSE"),
+			encodeCommand("PROXY", "MIGRATION", "START"),
+			encodeCommand("PROXY", "MIGRATION", "START"),
+			encodeCommand("PROXY", "MIGRATION", "PAUSE"),
+			encodeCommand("PROXY", "MIGRATION", "PAUSE"),
+		),
+	)
+
+	status := proxy.Migration().Status()
+	assert.Equal(t, MigrationPaused, status.State)
+	assert.True(t, status.KeysScanned < 100, "the migration stopped midway")
+
+	// keys are found on either node meanwhile
+	for i := 0; i < 100; i += 2 {
+		key := fmt.Sprintf("key_%d", i)
+		assert.Equal(t, "$5\r\nvalue\r\n", runCommands(proxy, encodeCommand("GET", key)), key)
+	}
+
+	assert.Equal(t, "+OK\r\n", runAdminCommands(proxy, encodeCommand("PROXY", "MIGRATION", "ABORT")))
+	assert.Equal(t, MigrationStatus{State: MigrationIdle, Nodes: 2}, proxy.Migration().Status())
+	assert.True(t, proxy.resharding(), "an aborted migration keeps both routers")
+
+	assert.Equal(t, "+OK\r\n", runAdminCommands(proxy, encodeCommand("PROXY", "MIGRATION", "START")))
+	assert.Eventually(t, func() bool {
+		return proxy.Migration().Status().State == MigrationDone
+	}, 10*time.Second, 10*time.Millisecond)
+
+	assertMigrated(t, clients, router)
+}
+
+func TestMigrationCommandErrors(t *testing.T) {
+	proxy := NewRedisProxy(setupFakeClients(2))
+
+	assert.Equal(
+		t,
+		"-ERR no resharding in progress\r\n"+
+			"-ERR unknown subcommand or wrong number of arguments for 'MIGRATE'. Try PROXY HELP.\r\n",
+		runAdminCommands(
+			proxy,
+			encodeCommand("PROXY", "MIGRATION", "START"),
+			encodeCommand("PROXY", "MIGRATE"),
+		),
+	)
+
+	proxy, _, _ = setupResharding(t)
+
+	assert.Equal(
+		t,
+		"-ERR unknown migration action 'STOP', expected START, PAUSE, ABORT or STATUS\r\n",
+		runAdminCommands(proxy, encodeCommand("PROXY", "MIGRATION", "STOP")),
+	)
+}
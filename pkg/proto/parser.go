@@ -2,82 +2,495 @@ package proto
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
 )
 
+const (
+	// DefaultMaxBulkLen is the largest bulk argument accepted, like Redis proto-max-bulk-len
+	DefaultMaxBulkLen = 512 * 1024 * 1024
+	// DefaultMaxMultibulkLen is the largest number of arguments of a command
+	DefaultMaxMultibulkLen = 1024 * 1024
+
+	// maxInlineSize caps inline commands and length headers, like Redis
+	maxInlineSize = 64 * 1024
+	// bulkPreallocLimit is the largest argument allocated upfront, bigger ones
+	// grow as the data arrives so a forged length can't exhaust memory
+	bulkPreallocLimit = 32 * 1024
+
+	// minArgBufferSize is the initial size of the zero-copy argument buffer
+	minArgBufferSize = 4 * 1024
+	// maxArgBufferSize is the largest argument buffer kept between batches,
+	// a bigger one is dropped so a single burst doesn't pin memory forever
+	maxArgBufferSize = 1024 * 1024
+)
+
+// ProtocolError is a malformed request. The client gets an error reply and
+// the connection is closed, as the stream can't be resynchronised.
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+var (
+	errUnbalancedQuotes    = &ProtocolError{"unbalanced quotes in request"}
+	errTooBigInline        = &ProtocolError{"too big inline request"}
+	errTooBigBulkCount     = &ProtocolError{"too big bulk count string"}
+	errInvalidMultibulkLen = &ProtocolError{"invalid multibulk length"}
+	errInvalidBulkLen      = &ProtocolError{"invalid bulk length"}
+	errInvalidBulkEnd      = &ProtocolError{"expected CRLF after bulk argument"}
+)
+
 type Parser struct {
 	reader *bufio.Reader
+
+	// MaxBulkLen is the largest accepted argument in bytes
+	MaxBulkLen int64
+	// MaxMultibulkLen is the largest accepted number of arguments
+	MaxMultibulkLen int64
+
+	// ZeroCopy makes multibulk commands come with Argv instead of Args,
+	// sliced out of a buffer that is reused once Reset is called
+	ZeroCopy bool
+
+	buf  []byte
+	argv [][]byte
 }
 
 type Command struct {
 	Name string
 	Args []string
+
+	// Argv holds the name and arguments of a command parsed in zero-copy
+	// mode. It points into the parser buffer and is only valid until the
+	// parser is reset.
+	Argv [][]byte
+}
+
+// argc returns the number of arguments including the command name
+func (cmd *Command) argc() int {
+	if cmd.Argv != nil {
+		return len(cmd.Argv)
+	}
+
+	return len(cmd.Args) + 1
+}
+
+// loadArgs fills Args from Argv for the code that works with strings
+func (cmd *Command) loadArgs() {
+	if cmd.Args != nil || cmd.Argv == nil {
+		return
+	}
+
+	cmd.Args = make([]string, 0, len(cmd.Argv)-1)
+
+	for _, arg := range cmd.Argv[1:] {
+		cmd.Args = append(cmd.Args, string(arg))
+	}
 }
 
 func NewParser(reader *bufio.Reader) *Parser {
-	p := &Parser{}
+	p := &Parser{
+		MaxBulkLen:      DefaultMaxBulkLen,
+		MaxMultibulkLen: DefaultMaxMultibulkLen,
+	}
 	p.reader = reader
 
 	return p
 }
 
 func (p *Parser) ParseCommand() (*Command, error) {
-	line, err := p.readLine()
-	if err != nil {
-		return nil, err
+	for {
+		line, err := p.readLine(errTooBigInline)
+		if err != nil {
+			return nil, err
+		}
+
+		var cmd *Command
+
+		if len(line) == 0 || line[0] != '*' {
+			cmd, err = parseInline(string(line))
+		} else {
+			cmd, err = p.parseMultibulk(line)
+		}
+
+		// empty inline lines and empty multibulks are skipped like Redis does
+		if err != nil || cmd != nil {
+			return cmd, err
+		}
 	}
+}
 
-	if line[0] != '*' {
-		return &Command{Name: line}, nil
+func (p *Parser) parseMultibulk(line []byte) (*Command, error) {
+	argc, ok := parseLen(line[1:])
+	if !ok || argc > p.MaxMultibulkLen {
+		return nil, errInvalidMultibulkLen
 	}
 
-	argcStr := line[1:]
-	argc, err := strconv.ParseUint(argcStr, 10, 64)
+	if argc <= 0 {
+		return nil, nil
+	}
 
-	if err != nil || argc < 1 {
-		return nil, fmt.Errorf("error parsing number of arguments %s", err)
+	if p.ZeroCopy {
+		return p.parseMultibulkBytes(argc)
 	}
 
-	args := make([]string, 0, argc)
+	args := make([]string, 0, min(argc, maxInlineSize))
 
-	for i := 0; i < int(argc); i++ {
-		line, err := p.readLine()
+	for i := int64(0); i < argc; i++ {
+		argLen, err := p.readBulkLen()
 		if err != nil {
 			return nil, err
 		}
 
-		if line[0] != '$' {
-			return nil, fmt.Errorf("error parsing argument %s", line)
+		arg, err := p.readBulk(argLen)
+		if err != nil {
+			return nil, err
 		}
 
-		argLenStr := line[1:]
-		argLen, err := strconv.ParseUint(argLenStr, 10, 64)
+		args = append(args, arg)
+	}
 
+	return &Command{Name: strings.ToUpper(args[0]), Args: args[1:]}, nil
+}
+
+// parseMultibulkBytes parses the arguments of a multibulk command into the
+// argument buffer without converting them to strings
+func (p *Parser) parseMultibulkBytes(argc int64) (*Command, error) {
+	start := len(p.argv)
+
+	for i := int64(0); i < argc; i++ {
+		argLen, err := p.readBulkLen()
+		if err != nil {
+			return nil, err
+		}
+
+		arg, err := p.readBulkBytes(argLen)
 		if err != nil {
-			return nil, fmt.Errorf("rror parsing argument length %s", argLenStr)
+			return nil, err
 		}
 
-		arg := make([]byte, argLen+2)
+		p.argv = append(p.argv, arg)
+	}
+
+	argv := p.argv[start:len(p.argv):len(p.argv)]
+
+	return &Command{Name: strings.ToUpper(string(argv[0])), Argv: argv}, nil
+}
+
+// Reset recycles the zero-copy argument buffer, invalidating the Argv of
+// every command parsed so far
+func (p *Parser) Reset() {
+	if cap(p.buf) > maxArgBufferSize {
+		p.buf = nil
+	}
+
+	clear(p.argv)
+
+	p.buf = p.buf[:0]
+	p.argv = p.argv[:0]
+}
+
+// readBulkLen reads a bulk header like $3 and returns the length of the argument
+func (p *Parser) readBulkLen() (int64, error) {
+	line, err := p.readLine(errTooBigBulkCount)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(line) == 0 || line[0] != '$' {
+		return 0, &ProtocolError{fmt.Sprintf("expected '$', got '%s'", line[:min(len(line), 1)])}
+	}
+
+	argLen, ok := parseLen(line[1:])
+	if !ok || argLen < 0 || argLen > p.MaxBulkLen {
+		return 0, errInvalidBulkLen
+	}
+
+	return argLen, nil
+}
+
+// readBulk reads an argument of n bytes followed by CRLF
+func (p *Parser) readBulk(n int64) (string, error) {
+	if n <= bulkPreallocLimit {
+		arg := make([]byte, n)
 
 		if _, err := io.ReadFull(p.reader, arg); err != nil {
-			return nil, err
+			return "", err
 		}
 
-		args = append(args, string(arg[0:len(arg)-2]))
+		return string(arg), p.readBulkEnd()
+	}
+
+	arg, err := p.readLargeBulk(n)
+
+	return string(arg), err
+}
+
+// readBulkBytes reads an argument of n bytes followed by CRLF into the
+// argument buffer. Big arguments get their own allocation instead.
+func (p *Parser) readBulkBytes(n int64) ([]byte, error) {
+	if n > bulkPreallocLimit {
+		return p.readLargeBulk(n)
+	}
+
+	size := int(n)
+
+	if cap(p.buf)-len(p.buf) < size {
+		// the arguments already parsed keep pointing to the old buffer
+		p.buf = make([]byte, 0, max(2*cap(p.buf), size, minArgBufferSize))
+	}
+
+	start := len(p.buf)
+	p.buf = p.buf[:start+size]
+
+	if _, err := io.ReadFull(p.reader, p.buf[start:]); err != nil {
+		return nil, err
+	}
+
+	return p.buf[start : start+size : start+size], p.readBulkEnd()
+}
+
+// readLargeBulk reads an argument bigger than bulkPreallocLimit, growing the
+// buffer as the data arrives
+func (p *Parser) readLargeBulk(n int64) ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.Grow(bulkPreallocLimit)
+
+	if _, err := io.CopyN(&buf, p.reader, n); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), p.readBulkEnd()
+}
+
+// readBulkEnd reads the line ending after a bulk argument, a bare LF is
+// accepted like it is after the length lines
+func (p *Parser) readBulkEnd() error {
+	b, err := p.reader.ReadByte()
+
+	if err == nil && b == '\r' {
+		b, err = p.reader.ReadByte()
+	}
+
+	if err != nil {
+		// the connection closed in the middle of a command
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+
+		return err
+	}
+
+	if b != '\n' {
+		return errInvalidBulkEnd
+	}
+
+	return nil
+}
+
+// parseInline parses a command sent as a single line of space separated
+// arguments, the way telnet sessions and health probes talk to Redis.
+// An empty line gives no command.
+func parseInline(line string) (*Command, error) {
+	args, err := splitInlineArgs(line)
+	if err != nil || len(args) == 0 {
+		return nil, err
 	}
 
 	return &Command{Name: strings.ToUpper(args[0]), Args: args[1:]}, nil
 }
 
-func (p *Parser) readLine() (string, error) {
-	str, err := p.reader.ReadString('\n')
+// splitInlineArgs splits a line into arguments with the same rules as
+// redis-cli: arguments are separated by whitespace and may be quoted, double
+// quoted ones support escapes like \n, \" and \x00, single quoted ones only \'
+func splitInlineArgs(line string) ([]string, error) {
+	args := []string{}
+	i := 0
+
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+
+		inDoubleQuotes := false
+		inSingleQuotes := false
+
+		for done := false; !done; {
+			switch {
+			case inDoubleQuotes:
+				if i == len(line) {
+					return nil, errUnbalancedQuotes
+				}
+
+				switch {
+				case line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					arg = append(arg, byte(b))
+					i += 3
+				case line[i] == '\\' && i+1 < len(line):
+					i++
+					arg = append(arg, unescape(line[i]))
+				case line[i] == '"':
+					// the closing quote must be followed by a space or nothing
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			case inSingleQuotes:
+				if i == len(line) {
+					return nil, errUnbalancedQuotes
+				}
+
+				switch {
+				case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					arg = append(arg, '\'')
+				case line[i] == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			default:
+				if i == len(line) {
+					done = true
+					continue
+				}
+
+				switch line[i] {
+				case ' ', '\t', '\n', '\r', '\v', '\f':
+					done = true
+				case '"':
+					inDoubleQuotes = true
+				case '\'':
+					inSingleQuotes = true
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+
+			if i < len(line) {
+				i++
+			}
+		}
+
+		args = append(args, string(arg))
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func unescape(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	default:
+		return c
+	}
+}
+
+// Buffered returns the number of bytes already read from the connection
+// but not parsed yet, i.e. whether more pipelined commands are pending
+func (p *Parser) Buffered() int {
+	return p.reader.Buffered()
+}
+
+// parseLen parses the decimal length of a multibulk or bulk header without
+// converting it to a string first
+func parseLen(b []byte) (int64, bool) {
+	negative := len(b) > 0 && b[0] == '-'
+	if negative {
+		b = b[1:]
+	}
+
+	if len(b) == 0 || len(b) > 18 {
+		return 0, false
+	}
+
+	var n int64
+
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+
+		n = n*10 + int64(c-'0')
+	}
+
+	if negative {
+		n = -n
+	}
+
+	return n, true
+}
+
+// readLine reads a line terminated by either CRLF or a bare LF, returning
+// tooLong if it grows past maxInlineSize before the terminator is found.
+// The line is only valid until the next read.
+func (p *Parser) readLine(tooLong error) ([]byte, error) {
+	// the whole line is usually in the reader buffer and returned as is,
+	// a line longer than the buffer is copied while reading the rest of it
+	line, err := p.reader.ReadSlice('\n')
+
+	if err == bufio.ErrBufferFull {
+		line = append([]byte(nil), line...)
+
+		for err == bufio.ErrBufferFull && len(line) <= maxInlineSize {
+			var chunk []byte
+
+			chunk, err = p.reader.ReadSlice('\n')
+			line = append(line, chunk...)
+		}
+	}
+
+	if len(line) > maxInlineSize {
+		return nil, tooLong
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	line = line[:len(line)-1]
 
-	if err == nil {
-		return str[:len(str)-2], err
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
 	}
 
-	return str, err
+	return line, nil
 }
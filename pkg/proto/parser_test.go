@@ -2,6 +2,9 @@ package proto
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
+	"io"
 	"strings"
 	"testing"
 
@@ -28,3 +31,294 @@ func TestParserParseCommand(t *testing.T) {
 		assert.Equal(t, cmd, tc.want, "they should be equal")
 	}
 }
+
+func TestParserParseInlineCommand(t *testing.T) {
+	tests := []struct {
+		want    *Command
+		command string
+	}{
+		{command: "PING\r\n", want: &Command{Name: "PING", Args: []string{}}},
+		{command: "ping\r\n", want: &Command{Name: "PING", Args: []string{}}},
+		{command: "set foo bar\r\n", want: &Command{Name: "SET", Args: []string{"foo", "bar"}}},
+		{command: "  GET   foo  \r\n", want: &Command{Name: "GET", Args: []string{"foo"}}},
+		{command: "\r\n\r\nGET foo\r\n", want: &Command{Name: "GET", Args: []string{"foo"}}},
+		{command: "SET foo \"hello world\"\r\n", want: &Command{Name: "SET", Args: []string{"foo", "hello world"}}},
+		{command: "SET foo \"\"\r\n", want: &Command{Name: "SET", Args: []string{"foo", ""}}},
+		{command: "SET foo 'it\\'s'\r\n", want: &Command{Name: "SET", Args: []string{"foo", "it's"}}},
+		{command: "SET foo 'raw\\n'\r\n", want: &Command{Name: "SET", Args: []string{"foo", "raw\\n"}}},
+		{
+			command: "SET foo \"a\\r\\nb\\t\\\"c\\\\\"\r\n",
+			want:    &Command{Name: "SET", Args: []string{"foo", "a\r\nb\t\"c\\"}},
+		},
+		{command: "SET foo \"\\x00\\xff\\x4A\"\r\n", want: &Command{Name: "SET", Args: []string{"foo", "\x00\xffJ"}}},
+	}
+
+	for _, tc := range tests {
+		parser := NewParser(bufio.NewReader(strings.NewReader(tc.command)))
+
+		cmd, err := parser.ParseCommand()
+
+		assert.Equal(t, nil, err, tc.command)
+		assert.Equal(t, tc.want, cmd, tc.command)
+	}
+}
+
+func TestParserParseInlineCommandErrors(t *testing.T) {
+	tests := []string{
+		"SET foo \"bar\r\n",
+		"SET foo 'bar\r\n",
+		"SET foo \"bar\"baz\r\n",
+		"SET foo 'bar'baz\r\n",
+	}
+
+	for _, command := range tests {
+		parser := NewParser(bufio.NewReader(strings.NewReader(command)))
+
+		_, err := parser.ParseCommand()
+
+		assert.Equal(t, errUnbalancedQuotes, err, command)
+	}
+}
+
+func TestParserInlineMatchesMultibulk(t *testing.T) {
+	inline := NewParser(bufio.NewReader(strings.NewReader("hset key field \"some value\"\r\n")))
+	multibulk := NewParser(bufio.NewReader(strings.NewReader(
+		"*4\r\n$4\r\nhset\r\n$3\r\nkey\r\n$5\r\nfield\r\n$10\r\nsome value\r\n",
+	)))
+
+	inlineCmd, err := inline.ParseCommand()
+	assert.Equal(t, nil, err)
+
+	multibulkCmd, err := multibulk.ParseCommand()
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, multibulkCmd, inlineCmd)
+}
+
+func TestParserLineEndings(t *testing.T) {
+	tests := []struct {
+		want    *Command
+		command string
+	}{
+		{command: "GET foo\n", want: &Command{Name: "GET", Args: []string{"foo"}}},
+		{command: "\n\nGET foo\n", want: &Command{Name: "GET", Args: []string{"foo"}}},
+		{command: "*2\n$3\nGET\r\n$3\nfoo\r\n", want: &Command{Name: "GET", Args: []string{"foo"}}},
+		{command: "*0\r\n*-1\r\n*1\r\n$4\r\nPING\r\n", want: &Command{Name: "PING", Args: []string{}}},
+		{command: "*1\n$4\nPING\n*1\n$4\nPING\n", want: &Command{Name: "PING", Args: []string{}}},
+	}
+
+	for _, tc := range tests {
+		parser := NewParser(bufio.NewReader(strings.NewReader(tc.command)))
+
+		cmd, err := parser.ParseCommand()
+
+		assert.Equal(t, nil, err, tc.command)
+		assert.Equal(t, tc.want, cmd, tc.command)
+
+		// whatever follows is the same command again
+		for err == nil {
+			if cmd, err = parser.ParseCommand(); err == nil {
+				assert.Equal(t, tc.want, cmd, tc.command)
+			}
+		}
+
+		assert.Equal(t, io.EOF, err, tc.command)
+	}
+}
+
+func TestParserProtocolErrors(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{command: "*x\r\n", want: "Protocol error: invalid multibulk length"},
+		{command: "*1025\r\n", want: "Protocol error: invalid multibulk length"},
+		{command: "*1\r\n#3\r\n", want: "Protocol error: expected '$', got '#'"},
+		{command: "*1\r\n\r\n", want: "Protocol error: expected '$', got ''"},
+		{command: "*1\r\n$-1\r\n", want: "Protocol error: invalid bulk length"},
+		{command: "*1\r\n$abc\r\n", want: "Protocol error: invalid bulk length"},
+		{command: "*1\r\n$2048\r\n", want: "Protocol error: invalid bulk length"},
+		{command: "*1\r\n$9223372036854775807\r\n", want: "Protocol error: invalid bulk length"},
+		{command: strings.Repeat("a", maxInlineSize+1), want: "Protocol error: too big inline request"},
+		{command: "*" + strings.Repeat("1", maxInlineSize+1), want: "Protocol error: too big inline request"},
+		{command: "*1\r\n$" + strings.Repeat("1", maxInlineSize+1), want: "Protocol error: too big bulk count string"},
+		{command: "*1\r\n$4\r\nPINGXY", want: "Protocol error: expected CRLF after bulk argument"},
+		{command: "*1\r\n$4\r\nPING\rX\n", want: "Protocol error: expected CRLF after bulk argument"},
+	}
+
+	for _, tc := range tests {
+		for _, zeroCopy := range []bool{false, true} {
+			parser := NewParser(bufio.NewReader(strings.NewReader(tc.command)))
+			parser.MaxBulkLen = 1024
+			parser.MaxMultibulkLen = 1024
+			parser.ZeroCopy = zeroCopy
+
+			_, err := parser.ParseCommand()
+
+			var protocolErr *ProtocolError
+
+			assert.ErrorAs(t, err, &protocolErr, tc.command)
+			assert.EqualError(t, err, tc.want, tc.command)
+		}
+	}
+}
+
+func TestParserLargeBulk(t *testing.T) {
+	value := strings.Repeat("v", bulkPreallocLimit*3+7)
+	parser := NewParser(bufio.NewReader(strings.NewReader(encodeCommand("SET", "key", value))))
+
+	cmd, err := parser.ParseCommand()
+
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &Command{Name: "SET", Args: []string{"key", value}}, cmd)
+
+	// a forged length is not allocated upfront, the read just fails
+	parser = NewParser(bufio.NewReader(strings.NewReader("*1\r\n$536870912\r\nshort\r\n")))
+
+	_, err = parser.ParseCommand()
+
+	assert.Equal(t, io.EOF, err)
+}
+
+func FuzzParserParseCommand(f *testing.F) {
+	f.Add([]byte("*2\r\n$3\r\nGET\r\n$2\r\nk1\r\n"))
+	f.Add([]byte("SET foo \"bar\\x00\"\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parser := NewParser(bufio.NewReader(bytes.NewReader(data)))
+		parser.MaxBulkLen = 1024 * 1024
+
+		zeroCopyParser := NewParser(bufio.NewReader(bytes.NewReader(data)))
+		zeroCopyParser.MaxBulkLen = 1024 * 1024
+		zeroCopyParser.ZeroCopy = true
+
+		for {
+			cmd, err := parser.ParseCommand()
+			zeroCopyCmd, zeroCopyErr := zeroCopyParser.ParseCommand()
+
+			assert.Equal(t, err, zeroCopyErr)
+
+			if err != nil {
+				return
+			}
+
+			// both modes agree on every command
+			zeroCopyCmd.loadArgs()
+			assert.Equal(t, cmd.Name, zeroCopyCmd.Name)
+			assert.Equal(t, cmd.Args, zeroCopyCmd.Args)
+
+			// every parsed command survives a round trip through multibulk
+			encoded := encodeCommand(append([]string{cmd.Name}, cmd.Args...)...)
+			reparsed, err := NewParser(bufio.NewReader(strings.NewReader(encoded))).ParseCommand()
+
+			assert.Equal(t, nil, err)
+			assert.Equal(t, cmd, reparsed)
+		}
+	})
+}
+
+func TestParserZeroCopy(t *testing.T) {
+	large := strings.Repeat("v", bulkPreallocLimit+1)
+	commands := encodeCommand("SET", "foo", "bar") +
+		encodeCommand("get", "foo") +
+		encodeCommand("SET", "big", large) +
+		"PING\r\n"
+
+	parser := NewParser(bufio.NewReader(strings.NewReader(commands)))
+	parser.ZeroCopy = true
+
+	tests := []struct {
+		want *Command
+	}{
+		{want: &Command{Name: "SET", Argv: [][]byte{[]byte("SET"), []byte("foo"), []byte("bar")}}},
+		{want: &Command{Name: "GET", Argv: [][]byte{[]byte("get"), []byte("foo")}}},
+		{want: &Command{Name: "SET", Argv: [][]byte{[]byte("SET"), []byte("big"), []byte(large)}}},
+		// inline commands still come with Args
+		{want: &Command{Name: "PING", Args: []string{}}},
+	}
+
+	cmds := []*Command{}
+
+	for _, tc := range tests {
+		cmd, err := parser.ParseCommand()
+
+		assert.Equal(t, nil, err)
+		assert.Equal(t, tc.want, cmd, "they should be equal")
+
+		cmds = append(cmds, cmd)
+	}
+
+	// commands of a batch don't overwrite each other
+	assert.Equal(t, []byte("bar"), cmds[0].Argv[2])
+	assert.Equal(t, 2, cmds[1].argc())
+
+	cmds[1].loadArgs()
+	assert.Equal(t, []string{"foo"}, cmds[1].Args)
+}
+
+func TestParserZeroCopyReset(t *testing.T) {
+	command := encodeCommand("SET", "foo", "bar")
+	parser := NewParser(bufio.NewReader(strings.NewReader(command + command)))
+	parser.ZeroCopy = true
+
+	first, err := parser.ParseCommand()
+	assert.Equal(t, nil, err)
+
+	parser.Reset()
+
+	second, err := parser.ParseCommand()
+	assert.Equal(t, nil, err)
+
+	// the buffer is reused once the previous batch is done
+	assert.Equal(t, &first.Argv[0][0], &second.Argv[0][0])
+	assert.Equal(t, [][]byte{[]byte("SET"), []byte("foo"), []byte("bar")}, second.Argv)
+}
+
+// loopReader endlessly repeats the same data
+type loopReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *loopReader) Read(b []byte) (int, error) {
+	n := copy(b, r.data[r.pos:])
+	r.pos = (r.pos + n) % len(r.data)
+
+	return n, nil
+}
+
+func benchmarkParser(b *testing.B, zeroCopy bool) {
+	batch := ""
+	for i := 0; i < 100; i++ {
+		batch += encodeCommand("SET", fmt.Sprintf("key_%d", i), strings.Repeat("v", 64))
+	}
+
+	parser := NewParser(bufio.NewReader(&loopReader{data: []byte(batch)}))
+	parser.ZeroCopy = zeroCopy
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(batch)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		parser.Reset()
+
+		for j := 0; j < 100; j++ {
+			cmd, err := parser.ParseCommand()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			// what the forwarding path hands to go-redis
+			commandArgs(cmd)
+		}
+	}
+}
+
+func BenchmarkParserParseCommand(b *testing.B) {
+	benchmarkParser(b, false)
+}
+
+func BenchmarkParserParseCommandZeroCopy(b *testing.B) {
+	benchmarkParser(b, true)
+}
@@ -0,0 +1,119 @@
+package proto
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// maxBatchSize caps the number of pipelined commands executed at once so a
+// client flooding the proxy can't make it buffer unbounded replies
+const maxBatchSize = 1024
+
+// pipelinedCommand is a command of a batch that is sent to a backend pipeline
+type pipelinedCommand struct {
+	spec *commandSpec
+	cmd  *Command
+	keys []string
+}
+
+// readBatch blocks until a command arrives and then drains every command
+// already buffered from the connection. Commands parsed before an error are
+// returned along with it so they still get their replies.
+func (p *Proto) readBatch() ([]*Command, error) {
+	// the commands of the previous batch have been answered by now
+	p.parser.Reset()
+
+	cmd, err := p.parser.ParseCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := []*Command{cmd}
+
+	for len(cmds) < maxBatchSize && p.parser.Buffered() > 0 {
+		cmd, err := p.parser.ParseCommand()
+		if err != nil {
+			return cmds, err
+		}
+
+		cmds = append(cmds, cmd)
+	}
+
+	return cmds, nil
+}
+
+// execBatch runs the commands and writes their replies in the original order.
+// Consecutive single-key commands are forwarded to the backends as pipelines,
+// anything else is executed on its own between them.
+func (p *Proto) execBatch(ctx context.Context, cmds []*Command) {
+	if len(cmds) == 0 {
+		return
+	}
+
+	p.metrics.CommandsProxiedTotal.With(prometheus.Labels{}).Add(float64(len(cmds)))
+
+	if len(cmds) == 1 {
+		p.execCommand(ctx, cmds[0])
+		return
+	}
+
+	log.Debug().Msgf("Running a batch of %d pipelined commands", len(cmds))
+
+	pipelined := make([]pipelinedCommand, 0, len(cmds))
+
+	for _, cmd := range cmds {
+		if pc, ok := p.pipelineable(cmd); ok {
+			pipelined = append(pipelined, pc)
+			continue
+		}
+
+		p.execPipeline(ctx, pipelined)
+		pipelined = pipelined[:0]
+
+		p.execCommand(ctx, cmd)
+	}
+
+	p.execPipeline(ctx, pipelined)
+}
+
+// pipelineable reports whether the command can be forwarded as part of a
+// backend pipeline, i.e. it is a valid command whose keys live on one node.
+// Commands with a handler are forwarded too, the backend replies with the same
+// values the handler would send.
+func (p *Proto) pipelineable(cmd *Command) (pipelinedCommand, bool) {
+	spec, ok := lookupCommand(cmd.Name)
+	if !ok || spec.route != routeSingleKey || !spec.checkArity(cmd.argc()) {
+		return pipelinedCommand{}, false
+	}
+
+	keys := spec.commandKeys(cmd)
+	if len(keys) > 1 && !p.redis.sameNode(keys...) {
+		return pipelinedCommand{}, false
+	}
+
+	return pipelinedCommand{spec: spec, cmd: cmd, keys: keys}, true
+}
+
+func (p *Proto) execPipeline(ctx context.Context, pipelined []pipelinedCommand) {
+	if len(pipelined) == 0 {
+		return
+	}
+
+	keys := make([][]string, 0, len(pipelined))
+	args := make([][]interface{}, 0, len(pipelined))
+
+	for _, pc := range pipelined {
+		logCommand(pc.cmd)
+
+		keys = append(keys, pc.keys)
+		args = append(args, commandArgs(pc.cmd))
+	}
+
+	results := p.redis.Pipeline(ctx, p.responser.protocol, keys, args)
+
+	for i, pc := range pipelined {
+		p.sendForwardedReply(pc.spec, pc.cmd, results[i])
+	}
+}
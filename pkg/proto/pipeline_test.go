@@ -0,0 +1,209 @@
+package proto
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kgantsov/redproxy/pkg/consistent_hashing"
+)
+
+// chunkedReader returns a single chunk per Read call, simulating a client
+// that waits for every reply before sending the next command
+type chunkedReader struct {
+	chunks []string
+}
+
+func (r *chunkedReader) Read(b []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(b, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+
+	if r.chunks[0] == "" {
+		r.chunks = r.chunks[1:]
+	}
+
+	return n, nil
+}
+
+func TestProtoPipelining(t *testing.T) {
+	clients := setupFakeClients(3)
+	proxy := NewRedisProxy(clients)
+
+	commands := []string{}
+	want := ""
+
+	for i := 0; i < 50; i++ {
+		commands = append(commands, encodeCommand("SET", fmt.Sprintf("key_%d", i), fmt.Sprintf("value_%d", i)))
+		want += "+OK\r\n"
+	}
+
+	commands = append(commands, encodeCommand("DEL", "key_0", "key_1"), encodeCommand("PING"))
+	want += ":2\r\n+PONG\r\n"
+
+	for i := 0; i < 50; i++ {
+		commands = append(commands, encodeCommand("GET", fmt.Sprintf("key_%d", i)))
+
+		if i < 2 {
+			want += "$-1\r\n"
+		} else {
+			value := fmt.Sprintf("value_%d", i)
+			want += fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+		}
+	}
+
+	commands = append(commands, encodeCommand("GET"))
+	want += "-ERR wrong number of arguments for 'get' command\r\n"
+
+	p, buf := newTestProto(proxy, commands...)
+
+	handleAll(p)
+	assert.Equal(t, want, buf.String())
+
+	for node, client := range clients {
+		// one pipeline for the SETs and one for the GETs
+		assert.Equal(t, 2, client.(*fakeRedisClient).pipelines, node)
+	}
+
+	p, buf = newTestProto(proxy, commands...)
+	p.passthrough = true
+
+	handleAll(p)
+	assert.Equal(t, want, buf.String())
+
+	for node, client := range clients {
+		assert.Equal(t, 4, client.(*fakeRedisClient).pipelines, node)
+	}
+}
+
+func TestProtoPipelineReshard(t *testing.T) {
+	clients := map[string]RedisClient{
+		"shard1": newFakeRedisClient(),
+		"shard2": newFakeRedisClient(),
+		"shard3": newFakeRedisClient(),
+	}
+
+	previous, err := consistent_hashing.NewRouter(consistent_hashing.RoutingKetama, []string{"shard1", "shard2"})
+	assert.Equal(t, nil, err)
+
+	router, err := consistent_hashing.NewRouter(consistent_hashing.RoutingKetama, []string{"shard1", "shard2", "shard3"})
+	assert.Equal(t, nil, err)
+
+	proxy, err := NewRedisProxyWithRouter(clients, previous)
+	assert.Equal(t, nil, err)
+
+	commands := []string{}
+	want := ""
+	moved := ""
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		runCommands(proxy, encodeCommand("SET", key, fmt.Sprint(i)))
+
+		value := fmt.Sprint(i)
+
+		if moved == "" && router.GetNode(key) == "shard3" {
+			moved = key
+			value = fmt.Sprint(i + 1)
+			commands = append(commands, encodeCommand("INCR", key))
+			want += ":" + value + "\r\n"
+		}
+
+		commands = append(commands, encodeCommand("GET", key))
+		want += fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	}
+
+	p, buf := newTestProto(proxy, commands...)
+
+	cmds, err := p.readBatch()
+	assert.Equal(t, nil, err)
+
+	pipelined := []pipelinedCommand{}
+
+	for _, cmd := range cmds {
+		pc, ok := p.pipelineable(cmd)
+		assert.True(t, ok)
+
+		pipelined = append(pipelined, pc)
+	}
+
+	// the resharding starts once the batch is checked, before it is sent
+	_, err = proxy.Reshard(router, nil)
+	assert.Equal(t, nil, err)
+
+	p.execPipeline(context.Background(), pipelined)
+	assert.Equal(t, nil, p.responser.Flush())
+
+	assert.Equal(t, want, buf.String())
+
+	// the written key was moved to its new owner first
+	for node, client := range clients {
+		_, ok := client.(*fakeRedisClient).strings[moved]
+		assert.Equal(t, node == "shard3", ok, node)
+	}
+}
+
+func TestProtoPipeliningParseError(t *testing.T) {
+	proxy := NewRedisProxy(setupFakeClients(3))
+
+	reply := runCommands(
+		proxy,
+		encodeCommand("SET", "key", "value"),
+		encodeCommand("GET", "key"),
+		"*1\r\n#3\r\n",
+	)
+
+	assert.True(t, strings.HasPrefix(reply, "+OK\r\n$5\r\nvalue\r\n-ERR "), reply)
+}
+
+func benchmarkProto(b *testing.B, pipelined bool) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+
+	defer zerolog.SetGlobalLevel(level)
+
+	clients := setupFakeClients(3)
+	for _, client := range clients {
+		client.(*fakeRedisClient).latency = 50 * time.Microsecond
+	}
+
+	proxy := NewRedisProxy(clients)
+	metrics := NewPrometheusMetrics(prometheus.NewRegistry(), "redproxy", "redproxy")
+
+	commands := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		commands = append(commands, encodeCommand("GET", fmt.Sprintf("key_%d", i)))
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var reader io.Reader = &chunkedReader{chunks: append([]string{}, commands...)}
+		if pipelined {
+			reader = strings.NewReader(strings.Join(commands, ""))
+		}
+
+		handleAll(NewProto(metrics, proxy, reader, new(bytes.Buffer)))
+	}
+
+	b.ReportMetric(float64(b.N*len(commands))/b.Elapsed().Seconds(), "cmds/s")
+}
+
+func BenchmarkProtoPipelined(b *testing.B) {
+	benchmarkProto(b, true)
+}
+
+func BenchmarkProtoUnpipelined(b *testing.B) {
+	benchmarkProto(b, false)
+}
@@ -3,27 +3,49 @@ package proto
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v9"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
+
+	"github.com/kgantsov/redproxy/pkg/consistent_hashing"
 )
 
+// redisVersion is the Redis version the proxy presents itself as
+const redisVersion = "7.2.0"
+
+var lastClientID atomic.Int64
+
 type Proto struct {
 	metrics   *PrometheusMetrics
 	parser    *Parser
 	responser *Responser
 	redis     *RedisProxy
+
+	id   int64
+	name string
+
+	// passthrough forwards the single-shard commands that have a handler as
+	// is too, so their replies are relayed like the ones of other commands.
+	// Pipelined batches forward them either way.
+	passthrough bool
+
+	// adminToken is the token PROXY AUTH checks, admin is set once it did
+	adminToken string
+	admin      bool
 }
 
 func NewProto(metrics *PrometheusMetrics, redis *RedisProxy, reader io.Reader, writer io.Writer) *Proto {
 	r := bufio.NewReader(reader)
 	parser := NewParser(r)
+	parser.ZeroCopy = true
 	responser := NewResponser(writer)
 
 	p := &Proto{
@@ -31,6 +53,7 @@ func NewProto(metrics *PrometheusMetrics, redis *RedisProxy, reader io.Reader, w
 		parser:    parser,
 		responser: responser,
 		redis:     redis,
+		id:        lastClientID.Add(1),
 	}
 
 	return p
@@ -39,170 +62,715 @@ func NewProto(metrics *PrometheusMetrics, redis *RedisProxy, reader io.Reader, w
 func (p *Proto) HandleRequest() error {
 	var ctx = context.Background()
 
-	cmd, err := p.parser.ParseCommand()
+	cmds, err := p.readBatch()
 	if err != nil && err != io.EOF {
 		log.Error().Msgf("Failed to parse command: %v", err)
 	}
 
-	log.Info().Msgf("GOT A COMMAND %+v", cmd)
 	start := time.Now()
 
 	defer func() {
 		p.metrics.Latency.With(prometheus.Labels{}).Observe(float64(time.Since(start).Nanoseconds()) / 1e9)
 	}()
 
-	if err != nil {
-		if err == io.EOF {
-			log.Debug().Msg("Client has been disconnected")
-		} else {
-			p.responser.SendError(err)
+	p.execBatch(ctx, cmds)
+
+	var protocolErr *ProtocolError
+
+	if errors.As(err, &protocolErr) {
+		p.responser.SendError(err)
+	}
+
+	// the replies of the whole batch are written at once
+	if flushErr := p.responser.Flush(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+
+	if err == io.EOF {
+		log.Debug().Msg("Client has been disconnected")
+	}
+
+	return err
+}
+
+// execCommand validates a single command against the command table and runs it
+func (p *Proto) execCommand(ctx context.Context, cmd *Command) {
+	logCommand(cmd)
+
+	spec, ok := lookupCommand(cmd.Name)
+	if !ok {
+		p.responser.SendError(unknownCommandError(cmd))
+		return
+	}
+
+	if !spec.checkArity(cmd.argc()) {
+		p.responser.SendError(
+			fmt.Errorf("wrong number of arguments for '%s' command", spec.name),
+		)
+		return
+	}
+
+	p.dispatch(ctx, spec, cmd)
+}
+
+// logCommand logs a command about to run, only converting the arguments of
+// a zero-copy command when the log level is enabled
+func logCommand(cmd *Command) {
+	if e := log.Info(); e.Enabled() {
+		cmd.loadArgs()
+		e.Msgf("Running '%s' command with args: %+v", cmd.Name, cmd.Args)
+	}
+}
+
+func unknownCommandError(cmd *Command) error {
+	cmd.loadArgs()
+
+	args := make([]string, 0, len(cmd.Args))
+
+	// like Redis, the name and the args echoed are cut to 128 bytes
+	for _, arg := range cmd.Args {
+		args = append(args, fmt.Sprintf("'%.128s' ", arg))
+	}
+
+	return fmt.Errorf(
+		"unknown command '%.128s', with args beginning with: %s", cmd.Name, strings.Join(args, ""),
+	)
+}
+
+func (p *Proto) dispatch(ctx context.Context, spec *commandSpec, cmd *Command) {
+	switch spec.route {
+	case routeUnsupported:
+		p.responser.SendError(fmt.Errorf("command '%s' is not supported by the proxy", spec.name))
+	case routeSingleKey:
+		keys := spec.commandKeys(cmd)
+
+		if len(keys) > 1 && !p.redis.sameNode(keys...) {
+			p.responser.SendError(errCrossSlot)
+			return
 		}
 
-		return err
+		if spec.handler == nil || p.passthrough {
+			p.forward(ctx, spec, keys, cmd)
+			return
+		}
+
+		cmd.loadArgs()
+		spec.handler(p, ctx, cmd)
+	default:
+		cmd.loadArgs()
+		spec.handler(p, ctx, cmd)
 	}
+}
 
-	log.Info().Msgf("Running '%s' command with args: %+v", cmd.Name, cmd.Args)
+// handleHello switches the connection to the requested RESP version and
+// replies with the server info like Redis does
+func (p *Proto) handleHello(ctx context.Context, cmd *Command) {
+	protocol := p.responser.protocol
+	name := p.name
+	args := cmd.Args
 
-	switch cmd.Name {
-	case "HELLO":
-		p.responser.SendArr([]string{})
-	case "GET":
-		val, err := p.redis.Get(ctx, cmd.Args[0]).Result()
+	if len(args) > 0 {
+		version, err := strconv.Atoi(args[0])
 		if err != nil {
-			if err == redis.Nil {
-				p.responser.SendNull()
-			} else {
-				log.Error().Err(err).Msgf("Failed to get value from Redis for key %s", cmd.Args[0])
-				p.responser.SendError(err)
-			}
-		} else {
-			p.responser.SendStr(val)
+			p.responser.SendError(errors.New("Protocol version is not an integer or out of range"))
+			return
 		}
-	case "SET":
-		expiration := 0
-		multiplier := time.Second
-
-		if len(cmd.Args) == 4 {
-			if strings.ToUpper(cmd.Args[2]) == "PX" {
-				multiplier = time.Millisecond
-			} else if strings.ToUpper(cmd.Args[2]) != "EX" {
-				p.responser.SendError(fmt.Errorf("invalid option '%s' for SET command", cmd.Args[2]))
-				return nil
-			}
-
-			expiration, err = strconv.Atoi(cmd.Args[3])
-			if err != nil {
-				p.responser.SendError(err)
-				return nil
-			}
-
-			log.Info().Msgf("Setting expiration to %s %d seconds", cmd.Args[2], expiration)
+
+		if version != 2 && version != 3 {
+			p.responser.SendError(redisError("NOPROTO unsupported protocol version"))
+			return
 		}
 
-		err = p.redis.Set(ctx, cmd.Args[0], cmd.Args[1], time.Duration(expiration)*multiplier).Err()
-		if err != nil {
-			log.Error().Err(err).Msgf("Failed to set value in Redis for key %s", cmd.Args[0])
-			p.responser.SendError(err)
-		} else {
-			p.responser.SendStr("OK")
+		protocol = version
+		args = args[1:]
+	}
+
+	for len(args) > 0 {
+		switch {
+		case strings.ToUpper(args[0]) == "AUTH" && len(args) >= 3:
+			// the proxy has no credentials of its own to check them against,
+			// accepting any of them would look like authentication to clients
+			p.responser.SendError(errors.New("AUTH is not supported by the proxy"))
+			return
+		case strings.ToUpper(args[0]) == "SETNAME" && len(args) >= 2:
+			name = args[1]
+			args = args[2:]
+		default:
+			p.responser.SendError(fmt.Errorf("Syntax error in HELLO option '%s'", args[0]))
+			return
 		}
-	case "HGET":
-		val, err := p.redis.HGet(ctx, cmd.Args[0], cmd.Args[1]).Result()
-		if err != nil {
-			if err == redis.Nil {
-				p.responser.SendNull()
-			} else {
-				log.Error().Err(err).Msgf(
-					"Failed to hget value from Redis for key %s %s", cmd.Args[0], cmd.Args[1],
-				)
-				p.responser.SendError(err)
-			}
+	}
+
+	p.name = name
+	p.responser.SetProtocol(protocol)
+
+	p.responser.sendMapLen(7)
+	p.responser.SendBulk("server")
+	p.responser.SendBulk("redis")
+	p.responser.SendBulk("version")
+	p.responser.SendBulk(redisVersion)
+	p.responser.SendBulk("proto")
+	p.responser.SendInt(int64(protocol))
+	p.responser.SendBulk("id")
+	p.responser.SendInt(p.id)
+	p.responser.SendBulk("mode")
+	p.responser.SendBulk("standalone")
+	p.responser.SendBulk("role")
+	p.responser.SendBulk("master")
+	p.responser.SendBulk("modules")
+	p.responser.SendArr([]string{})
+}
+
+// handleClientCommand answers the CLIENT subcommands describing the client
+// connection to the proxy, the backend connections are never exposed
+func (p *Proto) handleClientCommand(ctx context.Context, cmd *Command) {
+	subcommand := strings.ToUpper(cmd.Args[0])
+
+	switch {
+	case subcommand == "ID" && len(cmd.Args) == 1:
+		p.responser.SendInt(p.id)
+	case subcommand == "GETNAME" && len(cmd.Args) == 1:
+		if p.name == "" {
+			p.responser.SendNull()
 		} else {
-			p.responser.SendStr(val)
+			p.responser.SendBulk(p.name)
 		}
-	case "HSET":
-		err := p.redis.HSet(ctx, cmd.Args[0], cmd.Args[1], cmd.Args[2]).Err()
-		if err != nil {
-			log.Error().Err(err).Msgf(
-				"Failed to hset value in Redis for key %s %s", cmd.Args[0], cmd.Args[1],
-			)
-			p.responser.SendError(err)
-		} else {
+	case subcommand == "SETNAME" && len(cmd.Args) == 2:
+		p.name = cmd.Args[1]
+		p.responser.SendStr("OK")
+	case subcommand == "INFO" && len(cmd.Args) == 1:
+		p.responser.SendVerbatim("txt", fmt.Sprintf(
+			"id=%d name=%s resp=%d lib-name=redproxy\n", p.id, p.name, p.responser.protocol,
+		))
+	case subcommand == "TRACKING" && len(cmd.Args) >= 2:
+		// invalidation messages are pushed by the backends on their own
+		// connections, which the proxy shares between clients, so it has
+		// nothing to push to a client and client side caching is not supported
+		if strings.ToUpper(cmd.Args[1]) == "OFF" {
 			p.responser.SendStr("OK")
+		} else {
+			p.responser.SendError(errors.New("CLIENT TRACKING is not supported by the proxy"))
 		}
-	case "DEL":
-		res := p.redis.Del(ctx, cmd.Args...).Val()
-		p.responser.SendInt(res)
-	case "KEYS":
-		values := p.redis.Keys(ctx, cmd.Args[0]).Val()
-		p.responser.SendArr(values)
-	case "APPEND":
-		value := p.redis.Append(ctx, cmd.Args[0], cmd.Args[1]).Val()
-		p.responser.SendInt(value)
-	case "INCR":
-		value := p.redis.IncrBy(ctx, cmd.Args[0], 1).Val()
-		p.responser.SendInt(value)
-	case "INCRBY":
-		incrBy, err := strconv.Atoi(cmd.Args[1])
+	default:
+		p.responser.SendError(fmt.Errorf(
+			"unknown subcommand or wrong number of arguments for '%s'. Try CLIENT HELP.", cmd.Args[0],
+		))
+	}
+}
 
-		if err != nil {
-			p.responser.SendError(err)
-			return nil
+func (p *Proto) handlePing(ctx context.Context, cmd *Command) {
+	p.responser.SendPong()
+}
+
+// handleClusterCommand answers the CLUSTER subcommands that don't depend on
+// a cluster topology, so slot based tooling works against the proxy
+func (p *Proto) handleClusterCommand(ctx context.Context, cmd *Command) {
+	subcommand := strings.ToUpper(cmd.Args[0])
+
+	switch {
+	case subcommand == "KEYSLOT" && len(cmd.Args) == 2:
+		p.responser.SendInt(int64(consistent_hashing.KeySlot(p.redis.hashKey(cmd.Args[1]))))
+	default:
+		p.responser.SendError(fmt.Errorf(
+			"unknown subcommand or wrong number of arguments for '%s'. Try CLUSTER HELP.", cmd.Args[0],
+		))
+	}
+}
+
+// handleProxyCommand runs the admin subcommands of the proxy itself
+func (p *Proto) handleProxyCommand(ctx context.Context, cmd *Command) {
+	subcommand := strings.ToUpper(cmd.Args[0])
+
+	switch {
+	case subcommand == "AUTH" && len(cmd.Args) == 2:
+		p.handleProxyAuth(cmd.Args[1])
+	case subcommand == "MIGRATION" && len(cmd.Args) == 2:
+		p.handleMigration(strings.ToUpper(cmd.Args[1]))
+	case subcommand == "NODES" && len(cmd.Args) == 1:
+		p.handleNodes()
+	case subcommand == "NODE" && len(cmd.Args) == 3:
+		p.handleNode(strings.ToUpper(cmd.Args[1]), cmd.Args[2])
+	case subcommand == "HEALTH" && len(cmd.Args) == 1:
+		p.handleHealth()
+	default:
+		p.responser.SendError(fmt.Errorf(
+			"unknown subcommand or wrong number of arguments for '%s'. Try PROXY HELP.", cmd.Args[0],
+		))
+	}
+}
+
+// handleProxyAuth lets the connection make admin changes if it gives the
+// admin token
+func (p *Proto) handleProxyAuth(token string) {
+	switch {
+	case p.adminToken == "":
+		p.responser.SendError(errAdminDisabled)
+	case !validAdminToken(p.adminToken, token):
+		p.responser.SendError(redisError("WRONGPASS invalid admin token"))
+	default:
+		p.admin = true
+		p.responser.SendStr("OK")
+	}
+}
+
+// checkAdmin replies with an error unless the connection can make admin
+// changes
+func (p *Proto) checkAdmin() bool {
+	switch {
+	case p.adminToken == "":
+		p.responser.SendError(errAdminDisabled)
+	case !p.admin:
+		p.responser.SendError(errAdminToken)
+	default:
+		return true
+	}
+
+	return false
+}
+
+// handleMigration starts, pauses, aborts or describes the migration of the
+// keys after a resharding, anything but STATUS is an admin change
+func (p *Proto) handleMigration(action string) {
+	if action != "STATUS" && !p.checkAdmin() {
+		return
+	}
+
+	migration := p.redis.Migration()
+	if migration == nil {
+		p.responser.SendError(errNotResharding)
+		return
+	}
+
+	var err error
+
+	switch action {
+	case "START":
+		err = migration.Start(p.metrics)
+	case "PAUSE":
+		err = migration.Pause()
+	case "ABORT":
+		err = migration.Abort()
+	case "STATUS":
+		status := migration.Status()
+
+		p.responser.sendMapLen(6)
+		p.responser.SendBulk("state")
+		p.responser.SendBulk(string(status.State))
+		p.responser.SendBulk("nodes")
+		p.responser.SendInt(int64(status.Nodes))
+		p.responser.SendBulk("nodes_done")
+		p.responser.SendInt(int64(status.NodesDone))
+		p.responser.SendBulk("keys_scanned")
+		p.responser.SendInt(status.KeysScanned)
+		p.responser.SendBulk("keys_moved")
+		p.responser.SendInt(status.KeysMoved)
+		p.responser.SendBulk("errors")
+		p.responser.SendInt(status.Errors)
+
+		return
+	default:
+		err = fmt.Errorf("unknown migration action '%s', expected START, PAUSE, ABORT or STATUS", action)
+	}
+
+	if err != nil {
+		p.responser.SendError(err)
+		return
+	}
+
+	p.responser.SendStr("OK")
+}
+
+// handleNodes replies with the name, address and weight of every node
+func (p *Proto) handleNodes() {
+	membership := p.redis.membership.Load()
+	if membership == nil {
+		p.responser.SendError(errMembershipDisabled)
+		return
+	}
+
+	nodes := membership.Nodes()
+
+	p.responser.sendArrayLen(len(nodes))
+
+	for _, node := range nodes {
+		p.responser.sendArrayLen(3)
+		p.responser.SendBulk(node.Name)
+		p.responser.SendBulk(node.Addr)
+		p.responser.SendInt(int64(node.Weight))
+	}
+}
+
+// handleHealth replies with the name, the state and the failed checks in a
+// row of the checked nodes
+func (p *Proto) handleHealth() {
+	health := p.redis.health.Load()
+	if health == nil {
+		p.responser.SendError(errHealthCheckDisabled)
+		return
+	}
+
+	nodes := health.Nodes()
+
+	p.responser.sendArrayLen(len(nodes))
+
+	for _, node := range nodes {
+		p.responser.sendArrayLen(3)
+		p.responser.SendBulk(node.Name)
+		p.responser.SendBulk(string(node.State))
+		p.responser.SendInt(int64(node.Failures))
+	}
+}
+
+// handleNode adds a node given like the -hosts flag, [name=]host:port[=weight],
+// or drains or removes a node by name
+func (p *Proto) handleNode(action, arg string) {
+	if !p.checkAdmin() {
+		return
+	}
+
+	membership := p.redis.membership.Load()
+	if membership == nil {
+		p.responser.SendError(errMembershipDisabled)
+		return
+	}
+
+	var err error
+
+	switch action {
+	case "ADD":
+		var nodes []consistent_hashing.Node
+
+		nodes, err = consistent_hashing.ParseNodes(arg)
+
+		switch {
+		case err != nil:
+		case len(nodes) != 1:
+			err = fmt.Errorf("invalid node '%s', expected [name=]host:port[=weight]", arg)
+		default:
+			_, err = membership.Add(nodes[0])
 		}
+	case "DRAIN":
+		_, err = membership.Drain(arg)
+	case "REMOVE":
+		err = membership.Remove(arg)
+	default:
+		err = fmt.Errorf("unknown node action '%s', expected ADD, DRAIN or REMOVE", action)
+	}
 
-		value := p.redis.IncrBy(ctx, cmd.Args[0], int64(incrBy)).Val()
-		p.responser.SendInt(value)
-	case "DECR":
-		value := p.redis.DecrBy(ctx, cmd.Args[0], 1).Val()
-		p.responser.SendInt(value)
-	case "DECRBY":
-		decrBy, err := strconv.Atoi(cmd.Args[1])
+	if err != nil {
+		p.responser.SendError(err)
+		return
+	}
 
-		if err != nil {
+	p.responser.SendStr("OK")
+}
+
+func (p *Proto) handleGet(ctx context.Context, cmd *Command) {
+	val, err := p.redis.Get(ctx, cmd.Args[0]).Result()
+	if err != nil {
+		if err == redis.Nil {
+			p.responser.SendNull()
+		} else {
+			log.Error().Err(err).Msgf("Failed to get value from Redis for key %s", cmd.Args[0])
 			p.responser.SendError(err)
-			return nil
 		}
+	} else {
+		p.responser.SendBulk(val)
+	}
+}
 
-		value := p.redis.DecrBy(ctx, cmd.Args[0], int64(decrBy)).Val()
-		p.responser.SendInt(value)
-	case "EXISTS":
-		exists := p.redis.Exists(ctx, cmd.Args...).Val()
-		if exists > 0 {
-			p.responser.SendInt(exists)
+func (p *Proto) handleHGet(ctx context.Context, cmd *Command) {
+	val, err := p.redis.HGet(ctx, cmd.Args[0], cmd.Args[1]).Result()
+	if err != nil {
+		if err == redis.Nil {
+			p.responser.SendNull()
 		} else {
-			p.responser.SendInt(0)
-		}
-	case "TTL":
-		ttl := p.redis.TTL(ctx, cmd.Args[0]).Val()
-		p.responser.SendInt(int64(ttl.Seconds()))
-	case "EXPIRE":
-		expiration, err := strconv.Atoi(cmd.Args[1])
-		if err != nil {
+			log.Error().Err(err).Msgf(
+				"Failed to hget value from Redis for key %s %s", cmd.Args[0], cmd.Args[1],
+			)
 			p.responser.SendError(err)
-			return nil
 		}
+	} else {
+		p.responser.SendBulk(val)
+	}
+}
+
+func (p *Proto) handleHSet(ctx context.Context, cmd *Command) {
+	added, err := p.redis.HSet(ctx, cmd.Args[0], toInterfaces(cmd.Args[1:])...).Result()
+	if err != nil {
+		log.Error().Err(err).Msgf(
+			"Failed to hset value in Redis for key %s %s", cmd.Args[0], cmd.Args[1],
+		)
+		p.responser.SendError(err)
+	} else {
+		p.responser.SendInt(added)
+	}
+}
+
+func (p *Proto) handleDel(ctx context.Context, cmd *Command) {
+	res, err := p.redis.Del(ctx, cmd.Args...).Result()
+	p.sendInt(cmd, res, err)
+}
+
+func (p *Proto) handleUnlink(ctx context.Context, cmd *Command) {
+	res, err := p.redis.Unlink(ctx, cmd.Args...).Result()
+	p.sendInt(cmd, res, err)
+}
+
+func (p *Proto) handleTouch(ctx context.Context, cmd *Command) {
+	res, err := p.redis.Touch(ctx, cmd.Args...).Result()
+	p.sendInt(cmd, res, err)
+}
+
+func (p *Proto) handleMGet(ctx context.Context, cmd *Command) {
+	values, err := p.redis.MGet(ctx, cmd.Args...).Result()
+	if err != nil {
+		p.sendBackendError(cmd, err)
+		return
+	}
+
+	p.responser.SendReply(values)
+}
+
+func (p *Proto) handleMSet(ctx context.Context, cmd *Command) {
+	if len(cmd.Args)%2 != 0 {
+		p.responser.SendError(errors.New("wrong number of arguments for 'mset' command"))
+		return
+	}
+
+	if err := p.redis.MSet(ctx, cmd.Args...).Err(); err != nil {
+		p.sendBackendError(cmd, err)
+		return
+	}
+
+	p.responser.SendStr("OK")
+}
+
+func (p *Proto) handleKeys(ctx context.Context, cmd *Command) {
+	values, err := p.redis.Keys(ctx, cmd.Args[0]).Result()
+	if err != nil {
+		p.sendBackendError(cmd, err)
+		return
+	}
+
+	p.responser.SendArr(values)
+}
+
+func (p *Proto) handleScan(ctx context.Context, cmd *Command) {
+	cursor, err := strconv.ParseUint(cmd.Args[0], 10, 64)
+	if err != nil {
+		p.responser.SendError(errInvalidCursor)
+		return
+	}
+
+	options, err := parseScanOptions(cmd.Args[1:])
+	if err != nil {
+		p.responser.SendError(err)
+		return
+	}
+
+	keys, next, err := p.redis.Scan(ctx, cursor, options...).Result()
+	if err != nil {
+		p.sendBackendError(cmd, err)
+		return
+	}
+
+	p.responser.sendArrayLen(2)
+	p.responser.SendBulk(strconv.FormatUint(next, 10))
+	p.responser.SendArr(keys)
+}
+
+func (p *Proto) handleAppend(ctx context.Context, cmd *Command) {
+	value, err := p.redis.Append(ctx, cmd.Args[0], cmd.Args[1]).Result()
+	p.sendInt(cmd, value, err)
+}
+
+func (p *Proto) handleIncr(ctx context.Context, cmd *Command) {
+	value, err := p.redis.IncrBy(ctx, cmd.Args[0], 1).Result()
+	p.sendInt(cmd, value, err)
+}
+
+func (p *Proto) handleIncrBy(ctx context.Context, cmd *Command) {
+	incrBy, err := strconv.ParseInt(cmd.Args[1], 10, 64)
+
+	if err != nil {
+		p.responser.SendError(errNotInteger)
+		return
+	}
+
+	value, err := p.redis.IncrBy(ctx, cmd.Args[0], incrBy).Result()
+	p.sendInt(cmd, value, err)
+}
+
+func (p *Proto) handleDecr(ctx context.Context, cmd *Command) {
+	value, err := p.redis.DecrBy(ctx, cmd.Args[0], 1).Result()
+	p.sendInt(cmd, value, err)
+}
+
+func (p *Proto) handleDecrBy(ctx context.Context, cmd *Command) {
+	decrBy, err := strconv.ParseInt(cmd.Args[1], 10, 64)
+
+	if err != nil {
+		p.responser.SendError(errNotInteger)
+		return
+	}
+
+	value, err := p.redis.DecrBy(ctx, cmd.Args[0], decrBy).Result()
+	p.sendInt(cmd, value, err)
+}
+
+func (p *Proto) handleExists(ctx context.Context, cmd *Command) {
+	exists, err := p.redis.Exists(ctx, cmd.Args...).Result()
+	p.sendInt(cmd, exists, err)
+}
+
+func (p *Proto) handleTTL(ctx context.Context, cmd *Command) {
+	ttl, err := p.redis.TTL(ctx, cmd.Args[0]).Result()
+	if err != nil {
+		p.sendBackendError(cmd, err)
+		return
+	}
+
+	// -2 and -1 (no key, no expiration) are returned as is by go-redis
+	if ttl < 0 {
+		p.responser.SendInt(int64(ttl))
+		return
+	}
+
+	p.responser.SendInt(int64(ttl.Seconds()))
+}
+
+func (p *Proto) handleSAdd(ctx context.Context, cmd *Command) {
+	value, err := p.redis.SAdd(ctx, cmd.Args[0], toInterfaces(cmd.Args[1:])...).Result()
+	p.sendInt(cmd, value, err)
+}
+
+func (p *Proto) handleSRem(ctx context.Context, cmd *Command) {
+	value, err := p.redis.SRem(ctx, cmd.Args[0], toInterfaces(cmd.Args[1:])...).Result()
+	p.sendInt(cmd, value, err)
+}
+
+func (p *Proto) handleSMembers(ctx context.Context, cmd *Command) {
+	members, err := p.redis.SMembers(ctx, cmd.Args[0]).Result()
+	if err != nil {
+		p.sendBackendError(cmd, err)
+		return
+	}
+
+	p.responser.SendSet(toInterfaces(members))
+}
+
+// sendInt replies with the integer result of a command or its error
+func (p *Proto) sendInt(cmd *Command, value int64, err error) {
+	if err != nil {
+		p.sendBackendError(cmd, err)
+		return
+	}
+
+	p.responser.SendInt(value)
+}
+
+// sendBackendError replies with the error a command failed with, errors of
+// the backends keep their prefix like WRONGTYPE
+func (p *Proto) sendBackendError(cmd *Command, err error) {
+	cmd.loadArgs()
+	log.Error().Err(err).Msgf("Failed to run '%s' command with args: %+v", cmd.Name, cmd.Args)
+	p.responser.SendError(err)
+}
+
+// forward sends the command to the node owning the keys and relays the reply,
+// so any command and reply shape is supported without a dedicated handler.
+func (p *Proto) forward(ctx context.Context, spec *commandSpec, keys []string, cmd *Command) {
+	p.sendForwardedReply(spec, cmd, p.redis.Forward(ctx, p.responser.protocol, keys, commandArgs(cmd)...))
+}
+
+// sendForwardedReply relays the reply of a forwarded command, as is when the
+// backend encoded it in the RESP version of the client
+func (p *Proto) sendForwardedReply(spec *commandSpec, cmd *Command, reply Reply) {
+	if reply.Raw != nil {
+		p.responser.SendRaw(reply.Raw)
+		return
+	}
 
-		res := p.redis.Expire(ctx, cmd.Args[0], time.Duration(expiration)*time.Second)
+	p.sendCmdReply(spec, cmd, reply.Cmd)
+}
 
-		if res.Val() {
-			p.responser.SendInt(1)
+// sendCmdReply encodes the reply of a forwarded command decoded by go-redis,
+// which tells statuses and sets apart from bulk strings and arrays by the
+// command table only
+func (p *Proto) sendCmdReply(spec *commandSpec, cmd *Command, redisCmd *redis.Cmd) {
+	val, err := redisCmd.Result()
+	if err != nil {
+		if err == redis.Nil {
+			p.responser.SendNull()
 		} else {
-			p.responser.SendInt(0)
+			p.sendBackendError(cmd, err)
 		}
-	case "SADD":
-		value := p.redis.SAdd(ctx, cmd.Args[0], cmd.Args[1]).Val()
-		p.responser.SendInt(value)
-	case "SREM":
-		value := p.redis.SRem(ctx, cmd.Args[0], cmd.Args[1]).Val()
-		p.responser.SendInt(value)
-	case "SMEMBERS":
-		members := p.redis.SMembers(ctx, cmd.Args[0]).Val()
-		p.responser.SendArr(members)
-	case "PING":
-		p.responser.SendPong()
-	default:
-		p.responser.SendError(fmt.Errorf("unsupported command '%s'", cmd.Name))
+
+		return
+	}
+
+	if status, ok := val.(string); ok && status == "OK" && statusReply(spec, cmd) {
+		p.responser.SendStr(status)
+		return
+	}
+
+	if values, ok := val.([]interface{}); ok && spec.flags&flagSetReply != 0 {
+		p.responser.SendSet(values)
+		return
+	}
+
+	p.responser.SendReply(val)
+}
+
+// statusReply tells if an "OK" reply of a command is a status, SET with the
+// GET option replies with the old value instead, which may be "OK" too
+func statusReply(spec *commandSpec, cmd *Command) bool {
+	if spec.flags&flagStatusReply == 0 {
+		return false
+	}
+
+	if spec.name != "set" {
+		return true
+	}
+
+	cmd.loadArgs()
+
+	for _, arg := range cmd.Args[2:] {
+		if strings.EqualFold(arg, "GET") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// commandArgs returns the name and arguments of a command to send to a
+// backend. Zero-copy arguments are passed as byte slices, which go-redis
+// writes to the connection as they are.
+func commandArgs(cmd *Command) []interface{} {
+	if cmd.Argv != nil {
+		args := make([]interface{}, 0, len(cmd.Argv))
+
+		for _, arg := range cmd.Argv {
+			args = append(args, arg)
+		}
+
+		return args
+	}
+
+	args := make([]interface{}, 0, len(cmd.Args)+1)
+	args = append(args, cmd.Name)
+
+	return append(args, toInterfaces(cmd.Args)...)
+}
+
+func toInterfaces(values []string) []interface{} {
+	res := make([]interface{}, 0, len(values))
+
+	for _, value := range values {
+		res = append(res, value)
 	}
 
-	return nil
+	return res
 }
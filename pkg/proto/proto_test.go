@@ -0,0 +1,829 @@
+package proto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kgantsov/redproxy/pkg/consistent_hashing"
+)
+
+func encodeCommand(args ...string) string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+
+	for _, arg := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	return sb.String()
+}
+
+func newTestProto(proxy *RedisProxy, commands ...string) (*Proto, *bytes.Buffer) {
+	buf := new(bytes.Buffer)
+	metrics := NewPrometheusMetrics(prometheus.NewRegistry(), "redproxy", "redproxy")
+
+	return NewProto(metrics, proxy, strings.NewReader(strings.Join(commands, "")), buf), buf
+}
+
+func handleAll(p *Proto) {
+	for {
+		if err := p.HandleRequest(); err == io.EOF {
+			break
+		}
+	}
+}
+
+func runCommands(proxy *RedisProxy, commands ...string) string {
+	p, buf := newTestProto(proxy, commands...)
+	handleAll(p)
+
+	return buf.String()
+}
+
+// runAdminCommands runs commands on a connection that gave the admin token
+func runAdminCommands(proxy *RedisProxy, commands ...string) string {
+	p, buf := newTestProto(proxy, commands...)
+	p.adminToken = testAdminToken
+	p.admin = true
+	handleAll(p)
+
+	return buf.String()
+}
+
+func setCannedReply(clients map[string]RedisClient, command string, reply interface{}) {
+	for _, client := range clients {
+		client.(*fakeRedisClient).replies[command] = reply
+	}
+}
+
+func TestProtoBinarySafeValues(t *testing.T) {
+	values := []string{
+		"plain",
+		"",
+		"line1\r\nline2",
+		"\r\n",
+		"zero\x00byte",
+		"\x00\x01\x02\xff\xfe",
+		"+OK\r\n-ERR fake\r\n",
+		strings.Repeat("\r\n\x00", 100),
+	}
+
+	for _, value := range values {
+		proxy := NewRedisProxy(setupFakeClients(3))
+
+		reply := runCommands(
+			proxy,
+			encodeCommand("SET", "key", value),
+			encodeCommand("GET", "key"),
+			encodeCommand("HSET", "hash", "field", value),
+			encodeCommand("HGET", "hash", "field"),
+		)
+
+		bulk := fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+		want := "+OK\r\n" + bulk + ":1\r\n" + bulk
+
+		assert.Equal(t, want, reply, fmt.Sprintf("round trip of %q", value))
+	}
+}
+
+func TestProtoPassthrough(t *testing.T) {
+	clients := setupFakeClients(3)
+
+	setCannedReply(clients, "XRANGE", []interface{}{
+		[]interface{}{"1-0", []interface{}{"f", "v"}},
+	})
+	setCannedReply(clients, "HMGET", []interface{}{"a", nil, "b"})
+	setCannedReply(clients, "HGETALL", map[interface{}]interface{}{"f": "v"})
+	setCannedReply(clients, "ZSCORE", 1.5)
+	setCannedReply(clients, "LPUSH", fakeRedisError(
+		"WRONGTYPE Operation against a key holding the wrong kind of value",
+	))
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{command: encodeCommand("TTL", "missing"), want: ":-2\r\n"},
+		{command: encodeCommand("SET", "key", "value"), want: "+OK\r\n"},
+		{command: encodeCommand("TTL", "key"), want: ":-1\r\n"},
+		{command: encodeCommand("GET", "key"), want: "$5\r\nvalue\r\n"},
+		{command: encodeCommand("GET", "missing"), want: "$-1\r\n"},
+		{
+			command: encodeCommand("XRANGE", "stream", "-", "+"),
+			want:    "*1\r\n*2\r\n$3\r\n1-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n",
+		},
+		{
+			command: encodeCommand("HMGET", "hash", "a", "x", "b"),
+			want:    "*3\r\n$1\r\na\r\n$-1\r\n$1\r\nb\r\n",
+		},
+		{command: encodeCommand("HGETALL", "hash"), want: "*2\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{command: encodeCommand("ZSCORE", "zset", "member"), want: "$3\r\n1.5\r\n"},
+		{
+			command: encodeCommand("LPUSH", "key", "item"),
+			want:    "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+		},
+		{command: encodeCommand("LPUSH"), want: "-ERR wrong number of arguments for 'lpush' command\r\n"},
+		{command: encodeCommand("PING"), want: "+PONG\r\n"},
+	}
+
+	proxy := NewRedisProxy(clients)
+
+	for _, tc := range tests {
+		p, buf := newTestProto(proxy, tc.command)
+		p.passthrough = true
+
+		handleAll(p)
+
+		assert.Equal(t, tc.want, buf.String(), fmt.Sprintf("reply to %q", tc.command))
+	}
+}
+
+func TestProtoCommandValidation(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{command: encodeCommand("GET"), want: "-ERR wrong number of arguments for 'get' command\r\n"},
+		{command: encodeCommand("HSET", "k", "f"), want: "-ERR wrong number of arguments for 'hset' command\r\n"},
+		{command: encodeCommand("TTL", "k", "extra"), want: "-ERR wrong number of arguments for 'ttl' command\r\n"},
+		{command: encodeCommand("DEL"), want: "-ERR wrong number of arguments for 'del' command\r\n"},
+		{
+			command: encodeCommand("FOO", "a", "b"),
+			want:    "-ERR unknown command 'FOO', with args beginning with: 'a' 'b' \r\n",
+		},
+		{
+			// line breaks can't end the error early and long args are cut
+			command: encodeCommand("FOO", "a\r\n+OK", strings.Repeat("x", 200)) + encodeCommand("PING"),
+			want: "-ERR unknown command 'FOO', with args beginning with: 'a  +OK' '" +
+				strings.Repeat("x", 128) + "' \r\n+PONG\r\n",
+		},
+		{command: encodeCommand("MULTI"), want: "-ERR command 'multi' is not supported by the proxy\r\n"},
+		{command: encodeCommand("INCRBY", "k", "x"), want: "-ERR value is not an integer or out of range\r\n"},
+		{
+			command: encodeCommand("DECRBY", "k", "99999999999999999999"),
+			want:    "-ERR value is not an integer or out of range\r\n",
+		},
+		{command: encodeCommand("LPUSH", "list", "a"), want: ":1\r\n"},
+		{command: "ping\r\n", want: "+PONG\r\n"},
+		{command: "set foo \"bar baz\"\r\nget foo\r\n", want: "+OK\r\n$7\r\nbar baz\r\n"},
+	}
+
+	clients := setupFakeClients(3)
+	setCannedReply(clients, "LPUSH", int64(1))
+
+	proxy := NewRedisProxy(clients)
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, runCommands(proxy, tc.command), fmt.Sprintf("reply to %q", tc.command))
+	}
+}
+
+func TestProtoSetExpireOptions(t *testing.T) {
+	proxy := NewRedisProxy(setupFakeClients(3))
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{command: encodeCommand("SET", "lock", "a", "NX"), want: "+OK\r\n"},
+		{command: encodeCommand("SET", "lock", "b", "NX"), want: "$-1\r\n"},
+		{command: encodeCommand("SET", "lock", "c", "EX", "10", "NX"), want: "$-1\r\n"},
+		{command: encodeCommand("SET", "lock", "d", "XX", "GET"), want: "$1\r\na\r\n"},
+		{command: encodeCommand("SET", "missing", "e", "XX"), want: "$-1\r\n"},
+		{command: encodeCommand("GET", "lock"), want: "$1\r\nd\r\n"},
+		{command: encodeCommand("SET", "lock", "f", "EX"), want: "-ERR syntax error\r\n"},
+		{command: encodeCommand("EXPIRE", "lock", "10", "XX"), want: ":0\r\n"},
+		{command: encodeCommand("EXPIRE", "lock", "10", "NX"), want: ":1\r\n"},
+		{command: encodeCommand("EXPIRE", "lock", "20", "NX"), want: ":0\r\n"},
+		{command: encodeCommand("TTL", "lock"), want: ":10\r\n"},
+		{command: encodeCommand("EXPIRE", "lock", "10", "FOO"), want: "-ERR Unsupported option FOO\r\n"},
+		// an old value of "OK" is a bulk string
+		{command: encodeCommand("SET", "status", "OK"), want: "+OK\r\n"},
+		{command: encodeCommand("SET", "status", "v", "GET"), want: "$2\r\nOK\r\n"},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, runCommands(proxy, tc.command), fmt.Sprintf("reply to %q", tc.command))
+	}
+}
+
+func TestProtoCrossSlot(t *testing.T) {
+	clients := setupFakeClients(3)
+	setCannedReply(clients, "RENAME", "OK")
+
+	proxy := NewRedisProxy(clients)
+
+	var src, dst string
+
+	for i := 0; src == "" || dst == ""; i++ {
+		key := fmt.Sprintf("key_%d", i)
+
+		switch {
+		case src == "":
+			src = key
+		case !proxy.sameNode(src, key):
+			dst = key
+		}
+	}
+
+	assert.Equal(
+		t,
+		"-CROSSSLOT Keys in request don't hash to the same slot\r\n",
+		runCommands(proxy, encodeCommand("RENAME", src, dst)),
+	)
+	assert.Equal(t, "+OK\r\n", runCommands(proxy, encodeCommand("RENAME", src, src)))
+}
+
+func TestProtoBackendErrors(t *testing.T) {
+	wrongType := fakeRedisError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	timeout := errors.New("i/o timeout")
+
+	tests := []struct {
+		command string
+		err     error
+		want    string
+	}{
+		{command: encodeCommand("APPEND", "k", "v"), err: wrongType, want: "-" + wrongType.Error() + "\r\n"},
+		{command: encodeCommand("INCR", "k"), err: wrongType, want: "-" + wrongType.Error() + "\r\n"},
+		{command: encodeCommand("INCRBY", "k", "2"), err: timeout, want: "-ERR i/o timeout\r\n"},
+		{command: encodeCommand("DECR", "k"), err: timeout, want: "-ERR i/o timeout\r\n"},
+		{command: encodeCommand("DECRBY", "k", "2"), err: wrongType, want: "-" + wrongType.Error() + "\r\n"},
+		{command: encodeCommand("SADD", "k", "a"), err: wrongType, want: "-" + wrongType.Error() + "\r\n"},
+		{command: encodeCommand("SREM", "k", "a"), err: wrongType, want: "-" + wrongType.Error() + "\r\n"},
+		{command: encodeCommand("SMEMBERS", "k"), err: wrongType, want: "-" + wrongType.Error() + "\r\n"},
+		{command: encodeCommand("KEYS", "*"), err: timeout, want: "-ERR i/o timeout\r\n"},
+		{command: encodeCommand("DEL", "a", "b", "c"), err: timeout, want: "-ERR i/o timeout\r\n"},
+		{command: encodeCommand("EXISTS", "a", "b", "c"), err: timeout, want: "-ERR i/o timeout\r\n"},
+		{command: encodeCommand("TTL", "k"), err: timeout, want: "-ERR i/o timeout\r\n"},
+		{command: encodeCommand("EXPIRE", "k", "10"), err: timeout, want: "-ERR i/o timeout\r\n"},
+		{command: encodeCommand("MGET", "a", "b", "c"), err: timeout, want: "-ERR i/o timeout\r\n"},
+		{command: encodeCommand("MSET", "a", "1", "b", "2"), err: timeout, want: "-ERR i/o timeout\r\n"},
+		{command: encodeCommand("SCAN", "0", "COUNT", "10"), err: timeout, want: "-ERR i/o timeout\r\n"},
+		{command: encodeCommand("GET", "k"), err: wrongType, want: "-" + wrongType.Error() + "\r\n"},
+		{command: encodeCommand("LPUSH", "k", "a"), err: wrongType, want: "-" + wrongType.Error() + "\r\n"},
+	}
+
+	for _, tc := range tests {
+		clients := map[string]RedisClient{}
+		for i := 0; i < 3; i++ {
+			clients[fmt.Sprintf("redis-%d:6379", i)] = erroringRedisClient{err: tc.err}
+		}
+
+		assert.Equal(t, tc.want, runCommands(NewRedisProxy(clients), tc.command), fmt.Sprintf("reply to %q", tc.command))
+	}
+
+	// a fan-out fails when any of the nodes does
+	clients := setupFakeClients(2)
+	clients["redis-3:6381"] = erroringRedisClient{err: timeout}
+
+	proxy := NewRedisProxy(clients)
+
+	keys := []string{}
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("key_%d", i))
+	}
+
+	assert.Equal(
+		t,
+		"-ERR i/o timeout\r\n-ERR i/o timeout\r\n-ERR i/o timeout\r\n",
+		runCommands(
+			proxy,
+			encodeCommand("KEYS", "*"),
+			encodeCommand(append([]string{"DEL"}, keys...)...),
+			encodeCommand(append([]string{"EXISTS"}, keys...)...),
+		),
+	)
+}
+
+func TestProtoMultiKeyFanOut(t *testing.T) {
+	clients := setupFakeClients(3)
+	proxy := NewRedisProxy(clients)
+
+	keys := []string{}
+	for i := 0; i < 10; i++ {
+		keys = append(keys, fmt.Sprintf("key_%d", i))
+		runCommands(proxy, encodeCommand("SET", keys[i], "value"))
+	}
+
+	// a missing key and a repeated one, counted every time like Redis does
+	args := append(append([]string{}, keys[:5]...), "missing", "key_0")
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{command: "EXISTS", want: ":6\r\n"},
+		{command: "TOUCH", want: ":6\r\n"},
+		{command: "DEL", want: ":5\r\n"},
+		{command: "EXISTS", want: ":0\r\n"},
+		{command: "UNLINK", want: ":0\r\n"},
+	}
+
+	for _, tc := range tests {
+		for _, client := range clients {
+			client.(*fakeRedisClient).calls = nil
+		}
+
+		assert.Equal(t, tc.want, runCommands(proxy, encodeCommand(append([]string{tc.command}, args...)...)), tc.command)
+
+		// every node gets a single command with the keys it owns, in order
+		want := map[string][]string{}
+		for _, key := range args {
+			node := proxy.locate(proxy.topology.Load(), key)
+			want[node] = append(want[node], key)
+		}
+
+		assert.Greater(t, len(want), 1, "the keys span several nodes")
+
+		for node, client := range clients {
+			var calls []string
+			if nodeKeys, ok := want[node]; ok {
+				calls = []string{strings.Join(append([]string{tc.command}, nodeKeys...), " ")}
+			}
+
+			assert.Equal(t, calls, client.(*fakeRedisClient).calls, tc.command+" on "+node)
+		}
+	}
+
+	assert.Equal(
+		t,
+		":5\r\n",
+		runCommands(proxy, encodeCommand(append([]string{"UNLINK"}, keys...)...)),
+	)
+}
+
+func TestProtoMGetMSet(t *testing.T) {
+	clients := setupFakeClients(3)
+	proxy := NewRedisProxy(clients)
+
+	args := []string{"MSET"}
+	for i := 0; i < 10; i++ {
+		args = append(args, fmt.Sprintf("key_%d", i), fmt.Sprintf("value_%d", i))
+	}
+
+	// the last value of a repeated key wins
+	args = append(args, "key_0", "last")
+
+	assert.Equal(t, "+OK\r\n", runCommands(proxy, encodeCommand(args...)))
+
+	nodes := 0
+
+	for _, client := range clients {
+		fake := client.(*fakeRedisClient)
+		if len(fake.calls) == 0 {
+			continue
+		}
+
+		nodes++
+
+		assert.Equal(t, 1, len(fake.calls), "a single MSET per node")
+
+		for key, value := range fake.strings {
+			assert.Equal(t, proxy.locate(proxy.topology.Load(), key), nodeName(clients, fake), key)
+
+			if key == "key_0" {
+				assert.Equal(t, "last", value)
+			} else {
+				assert.Equal(t, "value_"+strings.TrimPrefix(key, "key_"), value)
+			}
+		}
+	}
+
+	assert.Greater(t, nodes, 1, "the keys span several nodes")
+
+	for _, client := range clients {
+		client.(*fakeRedisClient).calls = nil
+	}
+
+	assert.Equal(
+		t,
+		"*6\r\n$4\r\nlast\r\n$-1\r\n$7\r\nvalue_9\r\n$7\r\nvalue_3\r\n$4\r\nlast\r\n$7\r\nvalue_5\r\n",
+		runCommands(proxy, encodeCommand("MGET", "key_0", "missing", "key_9", "key_3", "key_0", "key_5")),
+	)
+
+	for _, client := range clients {
+		assert.LessOrEqual(t, len(client.(*fakeRedisClient).calls), 1, "a single MGET per node")
+	}
+
+	var other string
+
+	for i := 1; other == ""; i++ {
+		if key := fmt.Sprintf("key_%d", i); !proxy.sameNode("key_0", key) {
+			other = key
+		}
+	}
+
+	assert.Equal(
+		t,
+		"-CROSSSLOT Keys in request don't hash to the same slot\r\n:1\r\n:0\r\n"+
+			"-ERR wrong number of arguments for 'mset' command\r\n",
+		runCommands(
+			proxy,
+			encodeCommand("MSETNX", "key_0", "1", other, "2"),
+			encodeCommand("MSETNX", "{user}:a", "1", "{user}:b", "2"),
+			encodeCommand("MSETNX", "{user}:b", "3", "{user}:c", "4"),
+			encodeCommand("MSET", "a", "1", "b"),
+		),
+	)
+
+	assert.Equal(t, "*3\r\n$1\r\n1\r\n$1\r\n2\r\n$-1\r\n", runCommands(proxy, encodeCommand("MGET", "{user}:a", "{user}:b", "{user}:c")))
+}
+
+// nodeName returns the name of the node of a client
+func nodeName(clients map[string]RedisClient, client RedisClient) string {
+	for name, c := range clients {
+		if c == client {
+			return name
+		}
+	}
+
+	return ""
+}
+
+func TestProtoScan(t *testing.T) {
+	clients := setupFakeClients(3)
+	proxy := NewRedisProxy(clients)
+
+	want := map[string]bool{}
+	commands := []string{}
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		want[key] = true
+		commands = append(commands, encodeCommand("SET", key, "value"))
+	}
+
+	for i := 0; i < 5; i++ {
+		commands = append(commands, encodeCommand("HSET", fmt.Sprintf("hash_%d", i), "field", "value"))
+	}
+
+	runCommands(proxy, commands...)
+
+	// scan collects the keys of a full iteration
+	scan := func(options ...interface{}) (map[string]bool, int) {
+		keys := map[string]bool{}
+		calls := 0
+
+		for cursor := uint64(0); ; calls++ {
+			page, next, err := proxy.Scan(context.Background(), cursor, options...).Result()
+			assert.Equal(t, nil, err)
+
+			for _, key := range page {
+				assert.False(t, keys[key], "%s is returned once", key)
+				keys[key] = true
+			}
+
+			if next == 0 {
+				return keys, calls + 1
+			}
+
+			cursor = next
+		}
+	}
+
+	keys, calls := scan("COUNT", "7", "TYPE", "string")
+	assert.Equal(t, want, keys)
+	assert.Greater(t, calls, 3, "every node is scanned in several steps")
+
+	keys, _ = scan("MATCH", "key_1*")
+	assert.Equal(t, 11, len(keys))
+
+	keys, _ = scan("TYPE", "hash")
+	assert.Equal(t, map[string]bool{"hash_0": true, "hash_1": true, "hash_2": true, "hash_3": true, "hash_4": true}, keys)
+
+	// the cursor is the index of the node with the cursor of that node above it
+	_, next, err := proxy.Scan(context.Background(), 0, "COUNT", "2").Result()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(0), next&(maxScanNodes-1))
+	assert.NotEqual(t, uint64(0), next>>scanNodeBits)
+
+	// an ejected node is skipped, its keys are routed to the other nodes
+	proxy.eject("redis-2:6380")
+
+	live := map[string]bool{}
+	for key := range want {
+		if !clients["redis-2:6380"].(*fakeRedisClient).exists(key) {
+			live[key] = true
+		}
+	}
+
+	assert.NotEqual(t, len(want), len(live))
+
+	keys, _ = scan("TYPE", "string")
+	assert.Equal(t, live, keys)
+
+	listed, err := proxy.Keys(context.Background(), "key_*").Result()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(live), len(listed))
+
+	for _, key := range listed {
+		assert.True(t, live[key], key)
+	}
+
+	proxy.readmit("redis-2:6380")
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{command: encodeCommand("SCAN", "abc"), want: "-ERR invalid cursor\r\n"},
+		{command: encodeCommand("SCAN", "3"), want: "-ERR invalid cursor\r\n"},
+		{command: encodeCommand("SCAN", "0", "COUNT", "x"), want: "-ERR value is not an integer or out of range\r\n"},
+		{command: encodeCommand("SCAN", "0", "COUNT", "0"), want: "-ERR syntax error\r\n"},
+		{command: encodeCommand("SCAN", "0", "COUNT"), want: "-ERR syntax error\r\n"},
+		{command: encodeCommand("SCAN", "0", "LIMIT", "10"), want: "-ERR syntax error\r\n"},
+		{command: encodeCommand("SCAN", "0", "MATCH", "hash_[12]"), want: "*2\r\n$1\r\n0\r\n*2\r\n$6\r\nhash_1\r\n$6\r\nhash_2\r\n"},
+	}
+
+	single := NewRedisProxy(setupFakeClients(1))
+	runCommands(
+		single,
+		encodeCommand("HSET", "hash_1", "field", "value"),
+		encodeCommand("HSET", "hash_2", "field", "value"),
+		encodeCommand("HSET", "hash_3", "field", "value"),
+	)
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, runCommands(single, tc.command), fmt.Sprintf("reply to %q", tc.command))
+	}
+}
+
+func FuzzProtoHandleRequest(f *testing.F) {
+	for name := range commandTable {
+		for argc := 0; argc < 6; argc++ {
+			f.Add(name, strings.Repeat("arg\x00", argc))
+		}
+	}
+
+	f.Add("SET", "k\x00v\x00EX\x00ten")
+	f.Add("SET", "k\x00v\x00PX")
+	f.Add("INCRBY", "k\x00not-a-number")
+	f.Add("EXPIRE", "k\x00-1")
+
+	proxy := NewRedisProxy(setupFakeClients(3))
+
+	f.Fuzz(func(t *testing.T, name, rawArgs string) {
+		args := []string{name}
+		if rawArgs != "" {
+			args = append(args, strings.Split(strings.TrimSuffix(rawArgs, "\x00"), "\x00")...)
+		}
+
+		p, buf := newTestProto(proxy, encodeCommand(args...))
+
+		assert.NotPanics(t, func() { handleAll(p) })
+		assert.NotEmpty(t, buf.String())
+	})
+}
+
+func TestProtoHello(t *testing.T) {
+	helloReply := func(header string, protocol, id int64) string {
+		return fmt.Sprintf(
+			"%s$6\r\nserver\r\n$5\r\nredis\r\n$7\r\nversion\r\n$%d\r\n%s\r\n"+
+				"$5\r\nproto\r\n:%d\r\n$2\r\nid\r\n:%d\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n"+
+				"$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n",
+			header, len(redisVersion), redisVersion, protocol, id,
+		)
+	}
+
+	proxy := NewRedisProxy(setupFakeClients(3))
+
+	tests := []struct {
+		want     func(id int64) string
+		commands []string
+	}{
+		{
+			commands: []string{encodeCommand("HELLO")},
+			want:     func(id int64) string { return helloReply("*14\r\n", 2, id) },
+		},
+		{
+			commands: []string{encodeCommand("HELLO", "3")},
+			want:     func(id int64) string { return helloReply("%7\r\n", 3, id) },
+		},
+		{
+			commands: []string{encodeCommand("HELLO", "3", "SETNAME", "app"), encodeCommand("CLIENT", "GETNAME")},
+			want:     func(id int64) string { return helloReply("%7\r\n", 3, id) + "$3\r\napp\r\n" },
+		},
+		{
+			// the connection is left as it was
+			commands: []string{encodeCommand("HELLO", "3", "AUTH", "default", "secret", "SETNAME", "app"), encodeCommand("CLIENT", "GETNAME")},
+			want:     func(id int64) string { return "-ERR AUTH is not supported by the proxy\r\n$-1\r\n" },
+		},
+		{
+			commands: []string{encodeCommand("HELLO", "4"), encodeCommand("GET", "missing")},
+			want:     func(id int64) string { return "-NOPROTO unsupported protocol version\r\n$-1\r\n" },
+		},
+		{
+			commands: []string{encodeCommand("HELLO", "three")},
+			want: func(id int64) string {
+				return "-ERR Protocol version is not an integer or out of range\r\n"
+			},
+		},
+		{
+			commands: []string{encodeCommand("HELLO", "3", "SETNAME")},
+			want:     func(id int64) string { return "-ERR Syntax error in HELLO option 'SETNAME'\r\n" },
+		},
+	}
+
+	for _, tc := range tests {
+		p, buf := newTestProto(proxy, tc.commands...)
+		handleAll(p)
+
+		assert.Equal(t, tc.want(p.id), buf.String(), fmt.Sprintf("%q", tc.commands))
+	}
+}
+
+func TestProtoRESP3Replies(t *testing.T) {
+	clients := setupFakeClients(3)
+	setCannedReply(clients, "HGETALL", map[interface{}]interface{}{"f": "v"})
+	setCannedReply(clients, "ZSCORE", 1.5)
+	setCannedReply(clients, "SINTER", []interface{}{"a"})
+
+	proxy := NewRedisProxy(clients)
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{command: encodeCommand("HGETALL", "hash"), want: "%1\r\n$1\r\nf\r\n$1\r\nv\r\n"},
+		{command: encodeCommand("ZSCORE", "zset", "member"), want: ",1.5\r\n"},
+		{command: encodeCommand("SINTER", "set"), want: "~1\r\n$1\r\na\r\n"},
+		{command: encodeCommand("GET", "missing"), want: "_\r\n"},
+		{command: encodeCommand("CLIENT", "TRACKING", "ON"), want: "-ERR CLIENT TRACKING is not supported by the proxy\r\n"},
+		{command: encodeCommand("CLIENT", "TRACKING", "OFF"), want: "+OK\r\n"},
+	}
+
+	for _, tc := range tests {
+		p, buf := newTestProto(proxy, encodeCommand("HELLO", "3"), tc.command)
+		handleAll(p)
+
+		assert.True(t, strings.HasSuffix(buf.String(), "*0\r\n"+tc.want), fmt.Sprintf("%q: %q", tc.command, buf.String()))
+	}
+
+	clients = setupFakeClients(1)
+	proxy = NewRedisProxy(clients)
+
+	p, buf := newTestProto(
+		proxy,
+		encodeCommand("HELLO", "3"),
+		encodeCommand("SADD", "set", "a"),
+		encodeCommand("SMEMBERS", "set"),
+		encodeCommand("CLIENT", "INFO"),
+	)
+	handleAll(p)
+
+	info := fmt.Sprintf("id=%d name= resp=3 lib-name=redproxy\n", p.id)
+	want := fmt.Sprintf(":1\r\n~1\r\n$1\r\na\r\n=%d\r\ntxt:%s\r\n", len(info)+4, info)
+
+	assert.True(t, strings.HasSuffix(buf.String(), want), buf.String())
+}
+
+func TestProtoProtocolError(t *testing.T) {
+	proxy := NewRedisProxy(setupFakeClients(3))
+
+	p, buf := newTestProto(proxy, "*1\r\n$-5\r\n", encodeCommand("PING"))
+
+	err := p.HandleRequest()
+
+	var protocolErr *ProtocolError
+
+	assert.ErrorAs(t, err, &protocolErr)
+	assert.Equal(t, "-ERR Protocol error: invalid bulk length\r\n", buf.String())
+}
+
+func TestProtoWriteError(t *testing.T) {
+	proxy := NewRedisProxy(setupFakeClients(3))
+	metrics := NewPrometheusMetrics(prometheus.NewRegistry(), "redproxy", "redproxy")
+	reader := &chunkedReader{chunks: []string{encodeCommand("PING"), encodeCommand("PING")}}
+
+	p := NewProto(metrics, proxy, reader, &countingWriter{failAfter: 1})
+
+	assert.Equal(t, nil, p.HandleRequest())
+	assert.EqualError(t, p.HandleRequest(), "write: broken pipe")
+}
+
+func TestProtoHashSlots(t *testing.T) {
+	clients := setupFakeClients(2)
+
+	ranges, err := consistent_hashing.ParseSlotRanges("0-12181=redis-1:6379,12182=redis-2:6380,12183-16383=redis-1:6379")
+	assert.Equal(t, nil, err)
+
+	slots, err := consistent_hashing.NewHashSlotsFromRanges(ranges)
+	assert.Equal(t, nil, err)
+
+	proxy, err := NewRedisProxyWithRouter(clients, slots)
+	assert.Equal(t, nil, err)
+
+	reply := runCommands(
+		proxy,
+		encodeCommand("SET", "foo", "1"),
+		encodeCommand("SET", "bar", "2"),
+		encodeCommand("CLUSTER", "KEYSLOT", "foo"),
+		encodeCommand("cluster", "keyslot", "bar"),
+		encodeCommand("CLUSTER", "NODES"),
+	)
+
+	assert.Equal(
+		t,
+		"+OK\r\n+OK\r\n:12182\r\n:5061\r\n"+
+			"-ERR unknown subcommand or wrong number of arguments for 'NODES'. Try CLUSTER HELP.\r\n",
+		reply,
+	)
+
+	// foo hashes to slot 12182, the only one of redis-2
+	assert.Equal(t, map[string]string{"foo": "1"}, clients["redis-2:6380"].(*fakeRedisClient).strings)
+	assert.Equal(t, map[string]string{"bar": "2"}, clients["redis-1:6379"].(*fakeRedisClient).strings)
+
+	_, err = NewRedisProxyWithRouter(setupFakeClients(1), slots)
+	assert.EqualError(t, err, "no client for node redis-2:6380 of the router")
+}
+
+func TestProtoHashTags(t *testing.T) {
+	clients := setupFakeClients(3)
+	setCannedReply(clients, "RENAME", "OK")
+
+	proxy := NewRedisProxy(clients)
+
+	for i := 0; i < 50; i++ {
+		profile := fmt.Sprintf("user:{%d}:profile", i)
+		sessions := fmt.Sprintf("user:{%d}:sessions", i)
+
+		assert.True(t, proxy.sameNode(profile, sessions), profile)
+		assert.Equal(t, "+OK\r\n", runCommands(proxy, encodeCommand("RENAME", profile, sessions)), profile)
+	}
+
+	assert.Equal(t, ":3443\r\n", runCommands(proxy, encodeCommand("CLUSTER", "KEYSLOT", "{user1000}.following")))
+
+	// with other delimiters the braces are part of the hashed key
+	assert.Equal(t, nil, proxy.SetHashTag("[]"))
+	assert.Equal(
+		t,
+		fmt.Sprintf(":%d\r\n", consistent_hashing.KeySlot("{user1000}.following")),
+		runCommands(proxy, encodeCommand("CLUSTER", "KEYSLOT", "{user1000}.following")),
+	)
+
+	for i := 0; i < 50; i++ {
+		assert.True(t, proxy.sameNode(fmt.Sprintf("user:[%d]:profile", i), fmt.Sprintf("user:[%d]:sessions", i)))
+	}
+
+	crossed := false
+
+	assert.Equal(t, nil, proxy.SetHashTag(""))
+
+	for i := 0; i < 50 && !crossed; i++ {
+		crossed = !proxy.sameNode(fmt.Sprintf("user:{%d}:profile", i), fmt.Sprintf("user:{%d}:sessions", i))
+	}
+
+	assert.True(t, crossed, "keys are spread when hash tags are disabled")
+	assert.Error(t, proxy.SetHashTag("{"))
+}
+
+func TestProtoSetShardClient(t *testing.T) {
+	clients := map[string]RedisClient{
+		"shard1": newFakeRedisClient(),
+		"shard2": newFakeRedisClient(),
+		"shard3": newFakeRedisClient(),
+	}
+
+	router, err := consistent_hashing.NewRouter(consistent_hashing.RoutingKetama, []string{"shard1", "shard2", "shard3"})
+	assert.Equal(t, nil, err)
+
+	proxy, err := NewRedisProxyWithRouter(clients, router)
+	assert.Equal(t, nil, err)
+
+	commands := []string{}
+	for i := 0; i < 30; i++ {
+		commands = append(commands, encodeCommand("SET", fmt.Sprintf("key_%d", i), "value"))
+	}
+
+	runCommands(proxy, commands...)
+
+	moved := newFakeRedisClient()
+
+	previous, err := proxy.SetShardClient("shard2", moved)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, clients["shard2"], previous)
+
+	// the keys of shard2 now go to its new backend, the others don't move
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		reply := runCommands(proxy, encodeCommand("GET", key))
+
+		if router.GetNode(key) == "shard2" {
+			assert.Equal(t, "$-1\r\n", reply, key)
+		} else {
+			assert.Equal(t, "$5\r\nvalue\r\n", reply, key)
+		}
+	}
+
+	_, err = proxy.SetShardClient("shard4", moved)
+	assert.EqualError(t, err, "unknown shard shard4")
+}
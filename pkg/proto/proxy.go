@@ -2,6 +2,11 @@ package proto
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v9"
@@ -15,6 +20,10 @@ type RedisClient interface {
 	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
 	Del(ctx context.Context, keys ...string) *redis.IntCmd
 	Exists(ctx context.Context, keys ...string) *redis.IntCmd
+	Unlink(ctx context.Context, keys ...string) *redis.IntCmd
+	Touch(ctx context.Context, keys ...string) *redis.IntCmd
+	MGet(ctx context.Context, keys ...string) *redis.SliceCmd
+	MSet(ctx context.Context, values ...interface{}) *redis.StatusCmd
 	Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd
 	TTL(ctx context.Context, key string) *redis.DurationCmd
 	Append(ctx context.Context, key, value string) *redis.IntCmd
@@ -26,11 +35,42 @@ type RedisClient interface {
 	SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
 	SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
 	SMembers(ctx context.Context, key string) *redis.StringSliceCmd
+	Do(ctx context.Context, args ...interface{}) *redis.Cmd
+	Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
+}
+
+// topology is the routing state of a proxy: the router and the clients of
+// the nodes it routes to. It is replaced as a whole so a request never sees a
+// router and clients that don't match.
+type topology struct {
+	router  consistent_hashing.Router
+	clients map[string]RedisClient
+
+	// previous is the router being resharded from, keys are still looked up
+	// on the nodes it routes to until their migration is done
+	previous consistent_hashing.Router
 }
 
 type RedisProxy struct {
-	clients           map[string]RedisClient
-	consistentHashing *consistent_hashing.ConsistentHashing
+	topology atomic.Pointer[topology]
+
+	// migration moves the keys of the last resharding
+	migration atomic.Pointer[Migration]
+	// membership changes the nodes at runtime, nil when not enabled
+	membership atomic.Pointer[Membership]
+	// health checks the nodes, nil when not enabled
+	health atomic.Pointer[HealthChecker]
+	// ejected are the nodes taken out of routing by the health checks
+	ejected atomic.Pointer[ejection]
+	// keyLocks serialize moving a key between nodes
+	keyLocks [64]sync.Mutex
+	// reshardMu is held for reading by the commands in flight, so a
+	// resharding never starts under a command routed with the old router
+	reshardMu sync.RWMutex
+
+	// hashTag delimits the part of the keys that is hashed, empty hashes
+	// whole keys
+	hashTag string
 }
 
 func NewRedisProxy(clients map[string]RedisClient) *RedisProxy {
@@ -42,35 +82,245 @@ func NewRedisProxy(clients map[string]RedisClient) *RedisProxy {
 
 	consistentHashing := consistent_hashing.NewConsistentHashing(nodes, 10)
 
-	r := &RedisProxy{clients: clients, consistentHashing: consistentHashing}
+	r := &RedisProxy{hashTag: consistent_hashing.DefaultHashTag}
+	r.topology.Store(&topology{router: consistentHashing, clients: clients})
 
 	return r
 }
 
-func (c *RedisProxy) getNode(key string) RedisClient {
-	node := c.consistentHashing.GetNode(key)
-	log.Debug().Msgf("Got a node `%s` for a key `%s`", node, key)
+// NewRedisProxyWithRouter routes keys with the given router, every node it
+// routes to must have a client. Clients are keyed by node name, which is the
+// address unless shards are named.
+func NewRedisProxyWithRouter(clients map[string]RedisClient, router consistent_hashing.Router) (*RedisProxy, error) {
+	for _, node := range router.Nodes() {
+		if _, ok := clients[node]; !ok {
+			return nil, fmt.Errorf("no client for node %s of the router", node)
+		}
+	}
+
+	r := &RedisProxy{hashTag: consistent_hashing.DefaultHashTag}
+	r.topology.Store(&topology{router: router, clients: clients})
+
+	return r, nil
+}
+
+// SetShardClient points a shard at a new backend, like after moving it to
+// another address. Its keys stay on it as placement only depends on the shard
+// name. The previous client is returned so the caller can close it once the
+// requests in flight are done.
+func (c *RedisProxy) SetShardClient(name string, client RedisClient) (RedisClient, error) {
+	for {
+		current := c.topology.Load()
+
+		previous, ok := current.clients[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown shard %s", name)
+		}
+
+		clients := make(map[string]RedisClient, len(current.clients))
+		for node, nodeClient := range current.clients {
+			clients[node] = nodeClient
+		}
+
+		clients[name] = client
 
-	return c.clients[node]
+		next := *current
+		next.clients = clients
+
+		if c.topology.CompareAndSwap(current, &next) {
+			log.Info().Msgf("Shard %s has a new backend", name)
+
+			return previous, nil
+		}
+	}
+}
+
+// replaceRouter routes keys with a new router right away, the keys of the
+// nodes it doesn't route to anymore are not looked up there
+func (c *RedisProxy) replaceRouter(router consistent_hashing.Router) error {
+	for {
+		current := c.topology.Load()
+		if current.previous != nil {
+			return errAlreadyReshard
+		}
+
+		next, err := c.routerTopology(current, router)
+		if err != nil {
+			return err
+		}
+
+		if c.topology.CompareAndSwap(current, next) {
+			closeDropped(current, next)
+
+			return nil
+		}
+	}
 }
 
-func (c *RedisProxy) getNodes(keys ...string) map[string]RedisClient {
-	keyClients := map[string]RedisClient{}
+// routerTopology returns the topology of a router with the clients of its
+// nodes taken from the current one
+func (c *RedisProxy) routerTopology(current *topology, router consistent_hashing.Router) (*topology, error) {
+	clients := map[string]RedisClient{}
+
+	for _, node := range router.Nodes() {
+		client, ok := current.clients[node]
+		if !ok {
+			return nil, fmt.Errorf("no client for node %s of the router", node)
+		}
+
+		clients[node] = client
+	}
+
+	return &topology{router: router, clients: clients}, nil
+}
+
+// clientCloseDelay leaves the commands in flight on a client dropped from
+// the topology time to finish before it is closed
+const clientCloseDelay = 10 * time.Second
+
+// closeDropped closes the clients of the nodes that are gone from a topology
+func closeDropped(previous, next *topology) {
+	for node, client := range previous.clients {
+		if _, ok := next.clients[node]; !ok {
+			time.AfterFunc(clientCloseDelay, func() { closeClient(client) })
+		}
+	}
+}
+
+// closeClient closes the connections of a client that supports it
+func closeClient(client RedisClient) {
+	if closer, ok := client.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Error().Err(err).Msg("Failed to close a Redis client")
+		}
+	}
+}
+
+// SetHashTag changes the hash tag delimiters, like "{}" or "[]", an empty
+// tag disables hash tags
+func (c *RedisProxy) SetHashTag(tag string) error {
+	if err := consistent_hashing.ValidateHashTag(tag); err != nil {
+		return err
+	}
+
+	c.hashTag = tag
+
+	return nil
+}
+
+// hashKey returns the part of a key that decides which node owns it
+func (c *RedisProxy) hashKey(key string) string {
+	return consistent_hashing.HashTagKey(key, c.hashTag)
+}
+
+// locate returns the name of the node owning a key, the keys of an ejected
+// node are owned by another one until it is readmitted
+func (c *RedisProxy) locate(t *topology, key string) string {
+	hashKey := c.hashKey(key)
+	node := t.router.GetNode(hashKey)
+
+	if ejected := c.ejected.Load(); ejected != nil && ejected.nodes[node] {
+		return c.liveNode(t, ejected, hashKey, node)
+	}
+
+	return node
+}
+
+// readNode returns the client to read a key from and a func to call once
+// the read is done. While resharding, a key its new owner doesn't have yet is
+// read from its previous owner, which it can't be moved from meanwhile.
+func (c *RedisProxy) readNode(ctx context.Context, key string) (RedisClient, func()) {
+	client, release, _ := c.route(ctx, false, key)
+
+	return client, release
+}
+
+// writeNode returns the client to write a key to and a func to call once
+// the write is done. While resharding, the key is moved from its previous
+// owner first so the write applies to its value.
+func (c *RedisProxy) writeNode(ctx context.Context, key string) (RedisClient, func(), error) {
+	return c.route(ctx, true, key)
+}
+
+// route returns the client of the node owning the keys, which the caller
+// has checked to be a single one, and a func to call once the command is
+// done. While resharding, reads of a single key fall back to the previous
+// owner on a miss and anything else moves the keys to the new owner first.
+func (c *RedisProxy) route(ctx context.Context, write bool, keys ...string) (RedisClient, func(), error) {
+	c.reshardMu.RLock()
+
+	client, unlock, err := c.routeWith(ctx, c.topology.Load(), write, keys...)
+	if unlock == nil {
+		return client, c.reshardMu.RUnlock, err
+	}
+
+	return client, func() {
+		unlock()
+		c.reshardMu.RUnlock()
+	}, err
+}
+
+// routeWith routes the keys with a topology loaded under reshardMu, which the
+// caller holds until the command is done. The returned func, nil when there is
+// nothing to unlock, releases the key a read falls back to the previous owner
+// of.
+func (c *RedisProxy) routeWith(ctx context.Context, t *topology, write bool, keys ...string) (RedisClient, func(), error) {
+	node := c.locate(t, keys[0])
+	log.Debug().Msgf("Got a node `%s` for a key `%s`", node, keys[0])
+
+	client := t.clients[node]
+
+	if t.previous == nil {
+		return client, nil, nil
+	}
+
+	hashKey := c.hashKey(keys[0])
+	previous := t.previous.GetNode(hashKey)
+
+	// the keys of an ejected new owner stay on their previous owner until it
+	// is back, the migration waits for it too
+	if len(keys) == 1 && node != t.router.GetNode(hashKey) && !c.isEjected(previous) {
+		return t.clients[previous], nil, nil
+	}
+
+	if !write && len(keys) == 1 {
+		if previous == node || c.isEjected(previous) {
+			return client, nil, nil
+		}
+
+		// the key stays where it is until the read is done
+		lock := c.keyLock(keys[0])
+		lock.Lock()
+
+		found, err := client.Exists(ctx, keys[0]).Result()
+		if err != nil || found > 0 {
+			lock.Unlock()
+			return client, nil, nil
+		}
+
+		return t.clients[previous], lock.Unlock, nil
+	}
 
 	for _, key := range keys {
-		node := c.consistentHashing.GetNode(key)
-		log.Debug().Msgf("Got a node `%s` for a key `%s`", node, key)
-		keyClients[key] = c.clients[node]
+		if err := c.moveKey(ctx, t, key); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	return keyClients
+	return client, nil, nil
+}
+
+// keyLock returns the lock serializing the moves of a key between nodes
+func (c *RedisProxy) keyLock(key string) *sync.Mutex {
+	return &c.keyLocks[consistent_hashing.KeySlot(key)%len(c.keyLocks)]
 }
 
 func (c *RedisProxy) getClientsForKeys(keys ...string) map[string][]string {
+	t := c.topology.Load()
 	nodeKeys := map[string][]string{}
 
 	for _, key := range keys {
-		node := c.consistentHashing.GetNode(key)
+		node := c.locate(t, key)
 		log.Debug().Msgf("Got a node `%s` for a key `%s`", node, key)
 		nodeKeys[node] = append(nodeKeys[node], key)
 	}
@@ -78,83 +328,416 @@ func (c *RedisProxy) getClientsForKeys(keys ...string) map[string][]string {
 	return nodeKeys
 }
 
+// Forward sends an arbitrary command to the node owning its keys, without any
+// command specific handling, and returns the backend reply in the RESP version
+// of the client. Commands the command table doesn't mark as reads are routed
+// like writes.
+func (c *RedisProxy) Forward(ctx context.Context, protocol int, keys []string, args ...interface{}) Reply {
+	client, release, err := c.route(ctx, isWrite(args), keys...)
+	defer release()
+
+	if err != nil {
+		return Reply{Cmd: redis.NewCmdResult(nil, err)}
+	}
+
+	return forwardTo(ctx, client, protocol, args)
+}
+
+// forwardTo sends a command to a client, relaying the reply when it can
+func forwardTo(ctx context.Context, client RedisClient, protocol int, args []interface{}) Reply {
+	if r, ok := client.(relayer); ok {
+		replies, err := r.Relay(ctx, protocol, [][]interface{}{args})
+		if err != nil {
+			return Reply{Cmd: redis.NewCmdResult(nil, err)}
+		}
+
+		return Reply{Raw: replies[0]}
+	}
+
+	return Reply{Cmd: client.Do(ctx, args...)}
+}
+
+// isWrite reports whether a command given as the arguments of Forward is
+// routed like a write, which is anything the command table doesn't mark as a
+// read
+func isWrite(args []interface{}) bool {
+	spec, ok := lookupCommand(commandName(args[0]))
+
+	return !ok || spec.flags&flagRead == 0
+}
+
+// commandName returns the upper case name of a command given as the first
+// argument of Do
+func commandName(arg interface{}) string {
+	switch name := arg.(type) {
+	case string:
+		return strings.ToUpper(name)
+	case []byte:
+		return strings.ToUpper(string(name))
+	}
+
+	return ""
+}
+
+// sameNode reports whether all the keys are owned by a single node
+func (c *RedisProxy) sameNode(keys ...string) bool {
+	return len(c.getClientsForKeys(keys...)) <= 1
+}
+
+// Pipeline sends each command to the node owning its keys, which the caller
+// has checked to be a single one. Commands of a node are sent as a single
+// pipeline and the nodes are queried concurrently, the replies are returned in
+// the order of the commands. While resharding, the commands are routed one by
+// one like on their own instead.
+func (c *RedisProxy) Pipeline(ctx context.Context, protocol int, keys [][]string, cmds [][]interface{}) []Reply {
+	c.reshardMu.RLock()
+	defer c.reshardMu.RUnlock()
+
+	t := c.topology.Load()
+	results := make([]Reply, len(cmds))
+
+	if t.previous != nil {
+		for i, args := range cmds {
+			results[i] = c.forwardWith(ctx, t, protocol, keys[i], args)
+		}
+
+		return results
+	}
+
+	nodeCmds := map[string][]int{}
+
+	for i, cmdKeys := range keys {
+		node := c.locate(t, cmdKeys[0])
+		nodeCmds[node] = append(nodeCmds[node], i)
+	}
+
+	var wg sync.WaitGroup
+
+	for node, indexes := range nodeCmds {
+		wg.Add(1)
+
+		go func(client RedisClient, indexes []int) {
+			defer wg.Done()
+
+			if r, ok := client.(relayer); ok {
+				relayPipeline(ctx, r, protocol, cmds, indexes, results)
+				return
+			}
+
+			// errors are reported by every command individually
+			_, _ = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, i := range indexes {
+					results[i] = Reply{Cmd: pipe.Do(ctx, cmds[i]...)}
+				}
+
+				return nil
+			})
+		}(t.clients[node], indexes)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// forwardWith forwards a command routed with a topology loaded under
+// reshardMu, which the caller holds
+func (c *RedisProxy) forwardWith(ctx context.Context, t *topology, protocol int, keys []string, args []interface{}) Reply {
+	client, unlock, err := c.routeWith(ctx, t, isWrite(args), keys...)
+	if unlock != nil {
+		defer unlock()
+	}
+
+	if err != nil {
+		return Reply{Cmd: redis.NewCmdResult(nil, err)}
+	}
+
+	return forwardTo(ctx, client, protocol, args)
+}
+
+// relayPipeline relays the replies of the commands of a node, a failed
+// connection fails all of them
+func relayPipeline(ctx context.Context, r relayer, protocol int, cmds [][]interface{}, indexes []int, results []Reply) {
+	nodeCmds := make([][]interface{}, 0, len(indexes))
+	for _, i := range indexes {
+		nodeCmds = append(nodeCmds, cmds[i])
+	}
+
+	replies, err := r.Relay(ctx, protocol, nodeCmds)
+
+	for j, i := range indexes {
+		if err != nil {
+			results[i] = Reply{Cmd: redis.NewCmdResult(nil, err)}
+		} else {
+			results[i] = Reply{Raw: replies[j]}
+		}
+	}
+}
+
 func (c *RedisProxy) Get(ctx context.Context, key string) *redis.StringCmd {
-	return c.getNode(key).Get(ctx, key)
+	client, release := c.readNode(ctx, key)
+	defer release()
+
+	return client.Get(ctx, key)
 }
 
 func (c *RedisProxy) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
-	return c.getNode(key).Set(ctx, key, value, expiration)
+	client, release, err := c.writeNode(ctx, key)
+	defer release()
+
+	if err != nil {
+		return redis.NewStatusResult("", err)
+	}
+
+	return client.Set(ctx, key, value, expiration)
 }
 
 func (c *RedisProxy) Del(ctx context.Context, keys ...string) *redis.IntCmd {
-	var res int64
+	return c.sumPerNode(ctx, true, keys, RedisClient.Del)
+}
 
-	keyClients := c.getNodes(keys...)
+func (c *RedisProxy) Unlink(ctx context.Context, keys ...string) *redis.IntCmd {
+	return c.sumPerNode(ctx, true, keys, RedisClient.Unlink)
+}
 
-	for _, key := range keys {
-		client := keyClients[key]
-		res += client.Del(ctx, keys...).Val()
+func (c *RedisProxy) Exists(ctx context.Context, keys ...string) *redis.IntCmd {
+	return c.sumPerNode(ctx, false, keys, RedisClient.Exists)
+}
+
+func (c *RedisProxy) Touch(ctx context.Context, keys ...string) *redis.IntCmd {
+	return c.sumPerNode(ctx, false, keys, RedisClient.Touch)
+}
+
+// sumPerNode sends a single command to every node owning some of the keys,
+// with only the keys it owns, and adds up their integer replies
+func (c *RedisProxy) sumPerNode(
+	ctx context.Context,
+	write bool,
+	keys []string,
+	run func(client RedisClient, ctx context.Context, keys ...string) *redis.IntCmd,
+) *redis.IntCmd {
+	var (
+		mu    sync.Mutex
+		total int64
+	)
+
+	err := c.perNode(ctx, write, keys, func(client RedisClient, nodeKeys []string) error {
+		n, err := run(client, ctx, nodeKeys...).Result()
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		total += n
+		mu.Unlock()
+
+		return nil
+	})
+	if err != nil {
+		return redis.NewIntResult(0, err)
 	}
 
-	cmd := &redis.IntCmd{}
-	cmd.SetVal(res)
+	return redis.NewIntResult(total, nil)
+}
 
-	return cmd
+// perNode runs a func for every node owning some of the keys, with the keys
+// it owns in the order they are given. The nodes are queried concurrently and
+// the first error is returned once all of them are done.
+func (c *RedisProxy) perNode(
+	ctx context.Context, write bool, keys []string, run func(client RedisClient, nodeKeys []string) error,
+) error {
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+
+	for _, nodeKeys := range c.getClientsForKeys(keys...) {
+		wg.Add(1)
+
+		go func(nodeKeys []string) {
+			defer wg.Done()
+
+			client, release, err := c.route(ctx, write, nodeKeys...)
+			if err == nil {
+				err = run(client, nodeKeys)
+			}
+
+			release()
+
+			if err != nil {
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+			}
+		}(nodeKeys)
+	}
+
+	wg.Wait()
+
+	return first
 }
 
-func (c *RedisProxy) Exists(ctx context.Context, keys ...string) *redis.IntCmd {
-	res := int64(0)
+// MGet reads the keys with one MGET per node and returns the values in the
+// order of the keys, nil for the missing ones
+func (c *RedisProxy) MGet(ctx context.Context, keys ...string) *redis.SliceCmd {
+	var mu sync.Mutex
+
+	// a key repeated in the request has the same value every time
+	values := make(map[string]interface{}, len(keys))
 
-	keyClients := c.getNodes(keys...)
+	err := c.perNode(ctx, false, keys, func(client RedisClient, nodeKeys []string) error {
+		nodeValues, err := client.MGet(ctx, nodeKeys...).Result()
+		if err != nil {
+			return err
+		}
 
+		mu.Lock()
+		defer mu.Unlock()
+
+		for i, key := range nodeKeys {
+			values[key] = nodeValues[i]
+		}
+
+		return nil
+	})
+	if err != nil {
+		return redis.NewSliceResult(nil, err)
+	}
+
+	res := make([]interface{}, 0, len(keys))
 	for _, key := range keys {
-		client := keyClients[key]
-		res += client.Exists(ctx, key).Val()
+		res = append(res, values[key])
 	}
 
-	cmd := &redis.IntCmd{}
-	cmd.SetVal(res)
+	return redis.NewSliceResult(res, nil)
+}
 
-	return cmd
+// MSet writes pairs of keys and values with one MSET per node. Every node
+// sets its keys atomically, but the nodes don't all at once: a failed node
+// leaves the keys of the others set.
+func (c *RedisProxy) MSet(ctx context.Context, pairs ...string) *redis.StatusCmd {
+	keys := make([]string, 0, len(pairs)/2)
+	// the last value of a key repeated in the request wins, like in Redis
+	values := make(map[string]string, len(pairs)/2)
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		keys = append(keys, pairs[i])
+		values[pairs[i]] = pairs[i+1]
+	}
+
+	err := c.perNode(ctx, true, keys, func(client RedisClient, nodeKeys []string) error {
+		nodePairs := make([]interface{}, 0, len(nodeKeys)*2)
+		seen := make(map[string]bool, len(nodeKeys))
+
+		for _, key := range nodeKeys {
+			if !seen[key] {
+				seen[key] = true
+				nodePairs = append(nodePairs, key, values[key])
+			}
+		}
+
+		return client.MSet(ctx, nodePairs...).Err()
+	})
+	if err != nil {
+		return redis.NewStatusResult("", err)
+	}
+
+	return redis.NewStatusResult("OK", nil)
 }
 
 func (c *RedisProxy) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
-	return c.getNode(key).Expire(ctx, key, expiration)
+	client, release, err := c.writeNode(ctx, key)
+	defer release()
+
+	if err != nil {
+		return redis.NewBoolResult(false, err)
+	}
+
+	return client.Expire(ctx, key, expiration)
 }
 
 func (c *RedisProxy) TTL(ctx context.Context, key string) *redis.DurationCmd {
-	return c.getNode(key).TTL(ctx, key)
+	client, release := c.readNode(ctx, key)
+	defer release()
+
+	return client.TTL(ctx, key)
 }
 
 func (c *RedisProxy) Append(ctx context.Context, key, value string) *redis.IntCmd {
-	return c.getNode(key).Append(ctx, key, value)
+	client, release, err := c.writeNode(ctx, key)
+	defer release()
+
+	if err != nil {
+		return redis.NewIntResult(0, err)
+	}
+
+	return client.Append(ctx, key, value)
 }
 
 func (c *RedisProxy) IncrBy(ctx context.Context, key string, value int64) *redis.IntCmd {
-	return c.getNode(key).IncrBy(ctx, key, value)
+	client, release, err := c.writeNode(ctx, key)
+	defer release()
+
+	if err != nil {
+		return redis.NewIntResult(0, err)
+	}
+
+	return client.IncrBy(ctx, key, value)
 }
 
 func (c *RedisProxy) DecrBy(ctx context.Context, key string, decrement int64) *redis.IntCmd {
-	return c.getNode(key).DecrBy(ctx, key, decrement)
+	client, release, err := c.writeNode(ctx, key)
+	defer release()
+
+	if err != nil {
+		return redis.NewIntResult(0, err)
+	}
+
+	return client.DecrBy(ctx, key, decrement)
 }
 
 func (c *RedisProxy) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
-	return c.getNode(key).SAdd(ctx, key, members...)
+	client, release, err := c.writeNode(ctx, key)
+	defer release()
+
+	if err != nil {
+		return redis.NewIntResult(0, err)
+	}
+
+	return client.SAdd(ctx, key, members...)
 }
 
 func (c *RedisProxy) SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
-	return c.getNode(key).SRem(ctx, key, members...)
+	client, release, err := c.writeNode(ctx, key)
+	defer release()
+
+	if err != nil {
+		return redis.NewIntResult(0, err)
+	}
+
+	return client.SRem(ctx, key, members...)
 }
 
 func (c *RedisProxy) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
-	return c.getNode(key).SMembers(ctx, key)
+	client, release := c.readNode(ctx, key)
+	defer release()
+
+	return client.SMembers(ctx, key)
 }
 
 func (c *RedisProxy) Keys(ctx context.Context, pattern string) *redis.StringSliceCmd {
+	t := c.topology.Load()
 	keys := []string{}
 
-	for _, client := range c.clients {
-		serverKeys := client.Keys(ctx, pattern).Val()
+	for _, node := range c.scanNodes(t) {
+		serverKeys, err := t.clients[node].Keys(ctx, pattern).Result()
+		if err != nil {
+			return redis.NewStringSliceResult(nil, err)
+		}
+
 		keys = append(keys, serverKeys...)
 	}
 
@@ -165,8 +748,19 @@ func (c *RedisProxy) Keys(ctx context.Context, pattern string) *redis.StringSlic
 }
 
 func (c *RedisProxy) HGet(ctx context.Context, key, field string) *redis.StringCmd {
-	return c.getNode(key).HGet(ctx, key, field)
+	client, release := c.readNode(ctx, key)
+	defer release()
+
+	return client.HGet(ctx, key, field)
 }
+
 func (c *RedisProxy) HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
-	return c.getNode(key).HSet(ctx, key, values...)
+	client, release, err := c.writeNode(ctx, key)
+	defer release()
+
+	if err != nil {
+		return redis.NewIntResult(0, err)
+	}
+
+	return client.HSet(ctx, key, values...)
 }
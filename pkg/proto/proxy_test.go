@@ -0,0 +1,851 @@
+package proto
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+type fakeRedisError string
+
+func (e fakeRedisError) Error() string { return string(e) }
+
+func (fakeRedisError) RedisError() {}
+
+// fakePanic as a canned reply makes the fake client panic
+type fakePanic string
+
+type fakeRedisClient struct {
+	mu      sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	sets    map[string]map[string]struct{}
+	ttls    map[string]time.Duration
+
+	// replies holds canned Do replies by command name
+	replies map[string]interface{}
+	// latency simulates the round-trip to the backend for Get, Do and Pipelined
+	latency time.Duration
+	// pipelines counts the executed pipelines
+	pipelines int
+	// cursors holds the last key returned for every SCAN cursor
+	cursors []string
+	// calls records the multi-key commands run, like "DEL k1 k2"
+	calls []string
+}
+
+// fakePipeline queues nothing and runs every command on the fake right away,
+// the embedded interface is nil so only Do may be used
+type fakePipeline struct {
+	redis.Pipeliner
+	client *fakeRedisClient
+}
+
+func (p fakePipeline) Do(ctx context.Context, args ...interface{}) *redis.Cmd {
+	return p.client.do(ctx, args...)
+}
+
+func newFakeRedisClient() *fakeRedisClient {
+	return &fakeRedisClient{
+		strings: map[string]string{},
+		hashes:  map[string]map[string]string{},
+		sets:    map[string]map[string]struct{}{},
+		ttls:    map[string]time.Duration{},
+		replies: map[string]interface{}{},
+		cursors: []string{""},
+	}
+}
+
+func setupFakeClients(n int) map[string]RedisClient {
+	clients := map[string]RedisClient{}
+
+	for i := 0; i < n; i++ {
+		clients[fmt.Sprintf("redis-%d:%d", i+1, 6379+i)] = newFakeRedisClient()
+	}
+
+	return clients
+}
+
+func (c *fakeRedisClient) exists(key string) bool {
+	_, isString := c.strings[key]
+	_, isHash := c.hashes[key]
+	_, isSet := c.sets[key]
+
+	return isString || isHash || isSet
+}
+
+func (c *fakeRedisClient) Get(ctx context.Context, key string) *redis.StringCmd {
+	time.Sleep(c.latency)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	val, ok := c.strings[key]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+
+	return redis.NewStringResult(val, nil)
+}
+
+func (c *fakeRedisClient) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.strings[key] = fmt.Sprint(value)
+	if expiration > 0 {
+		c.ttls[key] = expiration
+	} else {
+		delete(c.ttls, key)
+	}
+
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (c *fakeRedisClient) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.record("DEL", keys)
+
+	return redis.NewIntResult(c.del(keys), nil)
+}
+
+func (c *fakeRedisClient) Unlink(ctx context.Context, keys ...string) *redis.IntCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.record("UNLINK", keys)
+
+	return redis.NewIntResult(c.del(keys), nil)
+}
+
+func (c *fakeRedisClient) del(keys []string) int64 {
+	var deleted int64
+
+	for _, key := range keys {
+		if c.exists(key) {
+			deleted++
+		}
+
+		delete(c.strings, key)
+		delete(c.hashes, key)
+		delete(c.sets, key)
+		delete(c.ttls, key)
+	}
+
+	return deleted
+}
+
+func (c *fakeRedisClient) Exists(ctx context.Context, keys ...string) *redis.IntCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.record("EXISTS", keys)
+
+	return redis.NewIntResult(c.count(keys), nil)
+}
+
+func (c *fakeRedisClient) Touch(ctx context.Context, keys ...string) *redis.IntCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.record("TOUCH", keys)
+
+	return redis.NewIntResult(c.count(keys), nil)
+}
+
+// count returns the number of the keys that exist, counting repeated ones
+// every time like Redis does
+func (c *fakeRedisClient) count(keys []string) int64 {
+	var found int64
+
+	for _, key := range keys {
+		if c.exists(key) {
+			found++
+		}
+	}
+
+	return found
+}
+
+func (c *fakeRedisClient) record(name string, keys []string) {
+	c.calls = append(c.calls, strings.Join(append([]string{name}, keys...), " "))
+}
+
+func (c *fakeRedisClient) MGet(ctx context.Context, keys ...string) *redis.SliceCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.record("MGET", keys)
+
+	values := make([]interface{}, 0, len(keys))
+
+	for _, key := range keys {
+		if value, ok := c.strings[key]; ok {
+			values = append(values, value)
+		} else {
+			values = append(values, nil)
+		}
+	}
+
+	return redis.NewSliceResult(values, nil)
+}
+
+func (c *fakeRedisClient) MSet(ctx context.Context, values ...interface{}) *redis.StatusCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pairs := make([]string, 0, len(values))
+	for _, value := range values {
+		pairs = append(pairs, fmt.Sprint(value))
+	}
+
+	c.record("MSET", pairs)
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		c.strings[pairs[i]] = pairs[i+1]
+		delete(c.ttls, pairs[i])
+	}
+
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (c *fakeRedisClient) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.exists(key) {
+		return redis.NewBoolResult(false, nil)
+	}
+
+	c.ttls[key] = expiration
+
+	return redis.NewBoolResult(true, nil)
+}
+
+func (c *fakeRedisClient) TTL(ctx context.Context, key string) *redis.DurationCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.exists(key) {
+		return redis.NewDurationResult(-2, nil)
+	}
+
+	ttl, ok := c.ttls[key]
+	if !ok {
+		return redis.NewDurationResult(-1, nil)
+	}
+
+	return redis.NewDurationResult(ttl, nil)
+}
+
+func (c *fakeRedisClient) Append(ctx context.Context, key, value string) *redis.IntCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.strings[key] += value
+
+	return redis.NewIntResult(int64(len(c.strings[key])), nil)
+}
+
+func (c *fakeRedisClient) IncrBy(ctx context.Context, key string, value int64) *redis.IntCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := int64(0)
+
+	if val, ok := c.strings[key]; ok {
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return redis.NewIntResult(0, fmt.Errorf("ERR value is not an integer or out of range"))
+		}
+
+		current = n
+	}
+
+	current += value
+	c.strings[key] = strconv.FormatInt(current, 10)
+
+	return redis.NewIntResult(current, nil)
+}
+
+func (c *fakeRedisClient) DecrBy(ctx context.Context, key string, decrement int64) *redis.IntCmd {
+	return c.IncrBy(ctx, key, -decrement)
+}
+
+func (c *fakeRedisClient) Keys(ctx context.Context, pattern string) *redis.StringSliceCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := []string{}
+
+	for key := range c.keySet() {
+		if matched, _ := path.Match(pattern, key); matched {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return redis.NewStringSliceResult(keys, nil)
+}
+
+func (c *fakeRedisClient) keySet() map[string]struct{} {
+	keys := map[string]struct{}{}
+
+	for key := range c.strings {
+		keys[key] = struct{}{}
+	}
+
+	for key := range c.hashes {
+		keys[key] = struct{}{}
+	}
+
+	for key := range c.sets {
+		keys[key] = struct{}{}
+	}
+
+	return keys
+}
+
+func (c *fakeRedisClient) HGet(ctx context.Context, key, field string) *redis.StringCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	val, ok := c.hashes[key][field]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+
+	return redis.NewStringResult(val, nil)
+}
+
+func (c *fakeRedisClient) HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hashes[key] == nil {
+		c.hashes[key] = map[string]string{}
+	}
+
+	var added int64
+
+	for i := 0; i+1 < len(values); i += 2 {
+		field := fmt.Sprint(values[i])
+		if _, ok := c.hashes[key][field]; !ok {
+			added++
+		}
+
+		c.hashes[key][field] = fmt.Sprint(values[i+1])
+	}
+
+	return redis.NewIntResult(added, nil)
+}
+
+func (c *fakeRedisClient) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sets[key] == nil {
+		c.sets[key] = map[string]struct{}{}
+	}
+
+	var added int64
+
+	for _, member := range members {
+		m := fmt.Sprint(member)
+		if _, ok := c.sets[key][m]; !ok {
+			added++
+		}
+
+		c.sets[key][m] = struct{}{}
+	}
+
+	return redis.NewIntResult(added, nil)
+}
+
+func (c *fakeRedisClient) SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var removed int64
+
+	for _, member := range members {
+		m := fmt.Sprint(member)
+		if _, ok := c.sets[key][m]; ok {
+			removed++
+		}
+
+		delete(c.sets[key], m)
+	}
+
+	return redis.NewIntResult(removed, nil)
+}
+
+func (c *fakeRedisClient) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members := []string{}
+
+	for member := range c.sets[key] {
+		members = append(members, member)
+	}
+
+	sort.Strings(members)
+
+	return redis.NewStringSliceResult(members, nil)
+}
+
+// erroringRedisClient fails every command with its error, like a backend
+// that timed out or a key holding the wrong type
+type erroringRedisClient struct {
+	err error
+}
+
+func (c erroringRedisClient) Get(ctx context.Context, key string) *redis.StringCmd {
+	return redis.NewStringResult("", c.err)
+}
+
+func (c erroringRedisClient) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	return redis.NewStatusResult("", c.err)
+}
+
+func (c erroringRedisClient) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	return redis.NewIntResult(0, c.err)
+}
+
+func (c erroringRedisClient) Exists(ctx context.Context, keys ...string) *redis.IntCmd {
+	return redis.NewIntResult(0, c.err)
+}
+
+func (c erroringRedisClient) Unlink(ctx context.Context, keys ...string) *redis.IntCmd {
+	return redis.NewIntResult(0, c.err)
+}
+
+func (c erroringRedisClient) Touch(ctx context.Context, keys ...string) *redis.IntCmd {
+	return redis.NewIntResult(0, c.err)
+}
+
+func (c erroringRedisClient) MGet(ctx context.Context, keys ...string) *redis.SliceCmd {
+	return redis.NewSliceResult(nil, c.err)
+}
+
+func (c erroringRedisClient) MSet(ctx context.Context, values ...interface{}) *redis.StatusCmd {
+	return redis.NewStatusResult("", c.err)
+}
+
+func (c erroringRedisClient) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
+	return redis.NewBoolResult(false, c.err)
+}
+
+func (c erroringRedisClient) TTL(ctx context.Context, key string) *redis.DurationCmd {
+	return redis.NewDurationResult(0, c.err)
+}
+
+func (c erroringRedisClient) Append(ctx context.Context, key, value string) *redis.IntCmd {
+	return redis.NewIntResult(0, c.err)
+}
+
+func (c erroringRedisClient) IncrBy(ctx context.Context, key string, value int64) *redis.IntCmd {
+	return redis.NewIntResult(0, c.err)
+}
+
+func (c erroringRedisClient) DecrBy(ctx context.Context, key string, decrement int64) *redis.IntCmd {
+	return redis.NewIntResult(0, c.err)
+}
+
+func (c erroringRedisClient) Keys(ctx context.Context, pattern string) *redis.StringSliceCmd {
+	return redis.NewStringSliceResult(nil, c.err)
+}
+
+func (c erroringRedisClient) HGet(ctx context.Context, key, field string) *redis.StringCmd {
+	return redis.NewStringResult("", c.err)
+}
+
+func (c erroringRedisClient) HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	return redis.NewIntResult(0, c.err)
+}
+
+func (c erroringRedisClient) SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	return redis.NewIntResult(0, c.err)
+}
+
+func (c erroringRedisClient) SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	return redis.NewIntResult(0, c.err)
+}
+
+func (c erroringRedisClient) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	return redis.NewStringSliceResult(nil, c.err)
+}
+
+func (c erroringRedisClient) Do(ctx context.Context, args ...interface{}) *redis.Cmd {
+	return redis.NewCmdResult(nil, c.err)
+}
+
+func (c erroringRedisClient) Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error) {
+	_ = fn(erroringPipeline{err: c.err})
+
+	return nil, c.err
+}
+
+// erroringPipeline fails the commands queued with Do
+type erroringPipeline struct {
+	redis.Pipeliner
+	err error
+}
+
+func (p erroringPipeline) Do(ctx context.Context, args ...interface{}) *redis.Cmd {
+	return redis.NewCmdResult(nil, p.err)
+}
+
+func newCmdResult(val interface{}, err error) *redis.Cmd {
+	if err != nil {
+		return redis.NewCmdResult(nil, err)
+	}
+
+	return redis.NewCmdResult(val, nil)
+}
+
+func (c *fakeRedisClient) Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error) {
+	time.Sleep(c.latency)
+
+	c.mu.Lock()
+	c.pipelines++
+	c.mu.Unlock()
+
+	return nil, fn(fakePipeline{client: c})
+}
+
+func (c *fakeRedisClient) Do(ctx context.Context, args ...interface{}) *redis.Cmd {
+	time.Sleep(c.latency)
+
+	return c.do(ctx, args...)
+}
+
+func (c *fakeRedisClient) do(ctx context.Context, args ...interface{}) *redis.Cmd {
+	strs := make([]string, 0, len(args))
+
+	for i, arg := range args {
+		// zero-copy arguments are copied like go-redis does writing them out
+		if b, ok := arg.([]byte); ok {
+			arg = string(b)
+			args[i] = arg
+		}
+
+		strs = append(strs, fmt.Sprint(arg))
+	}
+
+	name := strings.ToUpper(strs[0])
+
+	c.mu.Lock()
+	reply, ok := c.replies[name]
+	c.mu.Unlock()
+
+	if ok {
+		if msg, isPanic := reply.(fakePanic); isPanic {
+			panic(string(msg))
+		}
+
+		if err, isErr := reply.(error); isErr {
+			return redis.NewCmdResult(nil, err)
+		}
+
+		return redis.NewCmdResult(reply, nil)
+	}
+
+	switch name {
+	case "GET":
+		return newCmdResult(c.Get(ctx, strs[1]).Result())
+	case "SET":
+		return c.set(strs[1:])
+	case "EXPIRE":
+		return c.expire(strs[1:])
+	case "HGET":
+		return newCmdResult(c.HGet(ctx, strs[1], strs[2]).Result())
+	case "HSET":
+		return newCmdResult(c.HSet(ctx, strs[1], args[2:]...).Result())
+	case "SADD":
+		return newCmdResult(c.SAdd(ctx, strs[1], args[2:]...).Result())
+	case "INCR":
+		return newCmdResult(c.IncrBy(ctx, strs[1], 1).Result())
+	case "TTL":
+		ttl, err := c.TTL(ctx, strs[1]).Result()
+		if err != nil || ttl < 0 {
+			return newCmdResult(int64(ttl), err)
+		}
+
+		return newCmdResult(int64(ttl.Seconds()), nil)
+	case "PTTL":
+		return newCmdResult(c.pttl(strs[1]), nil)
+	case "DUMP":
+		return c.dump(strs[1])
+	case "RESTORE":
+		return c.restore(strs[1], strs[2], strs[3])
+	case "PING":
+		return redis.NewCmdResult("PONG", nil)
+	case "MSETNX":
+		return c.msetnx(strs[1:])
+	case "SCAN":
+		return c.scan(strs[1:])
+	case "SMEMBERS":
+		members, err := c.SMembers(ctx, strs[1]).Result()
+		values := make([]interface{}, 0, len(members))
+
+		for _, member := range members {
+			values = append(values, member)
+		}
+
+		return newCmdResult(values, err)
+	}
+
+	return redis.NewCmdResult(nil, fakeRedisError(fmt.Sprintf("ERR unknown command '%s'", strs[0])))
+}
+
+// set runs a SET with its NX, XX, GET, EX and PX options
+func (c *fakeRedisClient) set(args []string) *redis.Cmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key, value := args[0], args[1]
+	old, exists := c.strings[key]
+
+	var nx, xx, get bool
+
+	expiration := time.Duration(-1)
+
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GET":
+			get = true
+		case "EX", "PX":
+			if i+1 == len(args) {
+				return redis.NewCmdResult(nil, fakeRedisError("ERR syntax error"))
+			}
+
+			n, _ := strconv.Atoi(args[i+1])
+			expiration = time.Duration(n) * time.Second
+
+			if strings.ToUpper(args[i]) == "PX" {
+				expiration = time.Duration(n) * time.Millisecond
+			}
+
+			i++
+		default:
+			return redis.NewCmdResult(nil, fakeRedisError("ERR syntax error"))
+		}
+	}
+
+	var reply interface{} = "OK"
+	if get {
+		reply = nil
+		if exists {
+			reply = old
+		}
+	}
+
+	if (nx && exists) || (xx && !exists) {
+		if get {
+			return newCmdResult(reply, nil)
+		}
+
+		return redis.NewCmdResult(nil, redis.Nil)
+	}
+
+	c.strings[key] = value
+
+	if expiration > 0 {
+		c.ttls[key] = expiration
+	} else {
+		delete(c.ttls, key)
+	}
+
+	if reply == nil {
+		return redis.NewCmdResult(nil, redis.Nil)
+	}
+
+	return redis.NewCmdResult(reply, nil)
+}
+
+// expire runs an EXPIRE with its NX and XX options
+func (c *fakeRedisClient) expire(args []string) *redis.Cmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seconds, err := strconv.Atoi(args[1])
+	if err != nil {
+		return redis.NewCmdResult(nil, fakeRedisError("ERR value is not an integer or out of range"))
+	}
+
+	_, hasTTL := c.ttls[args[0]]
+
+	for _, option := range args[2:] {
+		switch strings.ToUpper(option) {
+		case "NX":
+			if hasTTL {
+				return redis.NewCmdResult(int64(0), nil)
+			}
+		case "XX":
+			if !hasTTL {
+				return redis.NewCmdResult(int64(0), nil)
+			}
+		default:
+			return redis.NewCmdResult(nil, fakeRedisError("ERR Unsupported option "+option))
+		}
+	}
+
+	if !c.exists(args[0]) {
+		return redis.NewCmdResult(int64(0), nil)
+	}
+
+	c.ttls[args[0]] = time.Duration(seconds) * time.Second
+
+	return redis.NewCmdResult(int64(1), nil)
+}
+
+func (c *fakeRedisClient) msetnx(pairs []string) *redis.Cmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.record("MSETNX", pairs)
+
+	for i := 0; i < len(pairs); i += 2 {
+		if c.exists(pairs[i]) {
+			return redis.NewCmdResult(int64(0), nil)
+		}
+	}
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		c.strings[pairs[i]] = pairs[i+1]
+	}
+
+	return redis.NewCmdResult(int64(1), nil)
+}
+
+func (c *fakeRedisClient) pttl(key string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.exists(key) {
+		return -2
+	}
+
+	ttl, ok := c.ttls[key]
+	if !ok {
+		return -1
+	}
+
+	return ttl.Milliseconds()
+}
+
+// dump serializes strings only, as a type byte followed by the value
+func (c *fakeRedisClient) dump(key string) *redis.Cmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	val, ok := c.strings[key]
+	if !ok {
+		return redis.NewCmdResult(nil, redis.Nil)
+	}
+
+	return redis.NewCmdResult("\x00"+val, nil)
+}
+
+func (c *fakeRedisClient) restore(key, ttl, payload string) *redis.Cmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.exists(key) {
+		return redis.NewCmdResult(nil, fakeRedisError("BUSYKEY Target key name already exists."))
+	}
+
+	ms, err := strconv.ParseInt(ttl, 10, 64)
+	if err != nil || !strings.HasPrefix(payload, "\x00") {
+		return redis.NewCmdResult(nil, fakeRedisError("ERR Bad data format"))
+	}
+
+	c.strings[key] = payload[1:]
+	if ms > 0 {
+		c.ttls[key] = time.Duration(ms) * time.Millisecond
+	}
+
+	return redis.NewCmdResult("OK", nil)
+}
+
+// scan pages through the sorted keys, a cursor stands for the last key
+// returned so deleting keys while scanning doesn't skip any
+func (c *fakeRedisClient) scan(args []string) *redis.Cmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cursor, _ := strconv.Atoi(args[0])
+	count := 10
+	pattern, keyType := "*", ""
+
+	for i := 1; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			count, _ = strconv.Atoi(args[i+1])
+		case "MATCH":
+			pattern = args[i+1]
+		case "TYPE":
+			keyType = args[i+1]
+		}
+	}
+
+	keys := []string{}
+	for key := range c.keySet() {
+		if cursor == 0 || key > c.cursors[cursor] {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	// like Redis, MATCH and TYPE filter the keys of a page once it is read
+	page := []interface{}{}
+	for i, key := range keys {
+		if i == count {
+			break
+		}
+
+		if matched, _ := path.Match(pattern, key); matched && (keyType == "" || c.keyType(key) == keyType) {
+			page = append(page, key)
+		}
+	}
+
+	next := 0
+	if len(keys) > count {
+		c.cursors = append(c.cursors, keys[count-1])
+		next = len(c.cursors) - 1
+	}
+
+	return redis.NewCmdResult([]interface{}{strconv.Itoa(next), page}, nil)
+}
+
+func (c *fakeRedisClient) keyType(key string) string {
+	if _, ok := c.strings[key]; ok {
+		return "string"
+	}
+
+	switch {
+	case c.hashes[key] != nil:
+		return "hash"
+	case c.sets[key] != nil:
+		return "set"
+	}
+
+	return "none"
+}
@@ -0,0 +1,430 @@
+package proto
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+var (
+	errBackendClosed = errors.New("backend client is closed")
+	errPoolTimeout   = errors.New("redis: connection pool timeout")
+)
+
+// Reply is the reply of a forwarded command. Raw holds it as encoded by the
+// backend when the client of the node is a relayer, Cmd holds it as decoded by
+// go-redis otherwise.
+type Reply struct {
+	Raw []byte
+	Cmd *redis.Cmd
+}
+
+// relayer is implemented by the clients able to relay replies as encoded by
+// the backend, in the RESP version of the client connection
+type relayer interface {
+	Relay(ctx context.Context, protocol int, cmds [][]interface{}) ([][]byte, error)
+}
+
+// BackendClient is the client of a backend node. The go-redis client serves
+// the commands the proxy handles itself, while forwarded commands are relayed
+// over connections of their own: go-redis decodes every reply over RESP3, and
+// encoding them again loses what tells them apart, like a status from a bulk
+// string or the flat RESP2 array of WITHSCORES from RESP3 pairs.
+type BackendClient struct {
+	*redis.Client
+
+	options *redis.Options
+
+	// open holds a token per relay connection in use, so there are at most
+	// the pool size of the go-redis client of them, idle ones included
+	open chan struct{}
+
+	mu sync.Mutex
+	// idle are the relay connections by RESP version
+	idle   map[int][]*relayConn
+	closed bool
+}
+
+// relayConn is a connection to a backend speaking the RESP version of the
+// clients it relays the replies of
+type relayConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+	wr   *bufio.Writer
+}
+
+func NewBackendClient(options *redis.Options) *BackendClient {
+	client := redis.NewClient(options)
+
+	return &BackendClient{
+		Client:  client,
+		options: client.Options(),
+		open:    make(chan struct{}, client.Options().PoolSize),
+		idle:    map[int][]*relayConn{},
+	}
+}
+
+// Relay sends the commands as a single pipeline and returns their replies as
+// encoded by the backend, error replies included. An error is returned when
+// the connection fails, in which case no reply can be trusted. An idle
+// connection the backend closed meanwhile, after a restart or its timeout,
+// is replaced by a new one once.
+func (c *BackendClient) Relay(ctx context.Context, protocol int, cmds [][]interface{}) ([][]byte, error) {
+	cn, pooled, err := c.conn(ctx, protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, stale, err := cn.roundTrip(ctx, cmds, c.options)
+
+	if err != nil && stale && pooled {
+		cn.conn.Close()
+
+		cn, err = c.dial(ctx, protocol)
+		if err != nil {
+			<-c.open
+			return nil, err
+		}
+
+		replies, _, err = cn.roundTrip(ctx, cmds, c.options)
+	}
+
+	if err != nil {
+		cn.conn.Close()
+		<-c.open
+
+		return nil, err
+	}
+
+	c.release(protocol, cn)
+
+	return replies, nil
+}
+
+// Close closes the relay connections and the go-redis client
+func (c *BackendClient) Close() error {
+	c.mu.Lock()
+	c.closed = true
+
+	for _, conns := range c.idle {
+		for _, cn := range conns {
+			cn.conn.Close()
+		}
+	}
+
+	c.idle = map[int][]*relayConn{}
+	c.mu.Unlock()
+
+	return c.Client.Close()
+}
+
+// conn returns an idle connection of the RESP version or dials a new one,
+// and tells which. It waits up to the pool timeout while the pool size of
+// connections are in use.
+func (c *BackendClient) conn(ctx context.Context, protocol int) (*relayConn, bool, error) {
+	timer := time.NewTimer(c.options.PoolTimeout)
+	defer timer.Stop()
+
+	select {
+	case c.open <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case <-timer.C:
+		return nil, false, errPoolTimeout
+	}
+
+	c.mu.Lock()
+
+	if c.closed {
+		c.mu.Unlock()
+		<-c.open
+
+		return nil, false, errBackendClosed
+	}
+
+	if conns := c.idle[protocol]; len(conns) > 0 {
+		cn := conns[len(conns)-1]
+		c.idle[protocol] = conns[:len(conns)-1]
+		c.mu.Unlock()
+
+		return cn, true, nil
+	}
+
+	// idle connections of the other RESP version make room for the new one
+	for version, conns := range c.idle {
+		for len(conns) > 0 && c.idleCount()+len(c.open) > c.options.PoolSize {
+			conns[len(conns)-1].conn.Close()
+			conns = conns[:len(conns)-1]
+			c.idle[version] = conns
+		}
+	}
+
+	c.mu.Unlock()
+
+	cn, err := c.dial(ctx, protocol)
+	if err != nil {
+		<-c.open
+		return nil, false, err
+	}
+
+	return cn, false, nil
+}
+
+// release keeps a connection for the next commands, conn keeps the idle and
+// the used ones within the pool size of the go-redis client
+func (c *BackendClient) release(protocol int, cn *relayConn) {
+	c.mu.Lock()
+
+	if c.closed {
+		cn.conn.Close()
+	} else {
+		c.idle[protocol] = append(c.idle[protocol], cn)
+	}
+
+	c.mu.Unlock()
+	<-c.open
+}
+
+// idleCount returns the number of idle connections, c.mu must be held
+func (c *BackendClient) idleCount() int {
+	count := 0
+	for _, conns := range c.idle {
+		count += len(conns)
+	}
+
+	return count
+}
+
+// dial connects to the backend and sets the connection up like go-redis does,
+// except that RESP2 connections stay in RESP2
+func (c *BackendClient) dial(ctx context.Context, protocol int) (*relayConn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, c.options.DialTimeout)
+	defer cancel()
+
+	conn, err := c.options.Dialer(dialCtx, c.options.Network, c.options.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cn := &relayConn{conn: conn, rd: bufio.NewReader(conn), wr: bufio.NewWriter(conn)}
+
+	var setup [][]interface{}
+
+	switch {
+	case protocol == 3 && c.options.Password != "":
+		setup = append(setup, []interface{}{"HELLO", "3", "AUTH", authUser(c.options), c.options.Password})
+	case protocol == 3:
+		setup = append(setup, []interface{}{"HELLO", "3"})
+	case c.options.Username != "":
+		setup = append(setup, []interface{}{"AUTH", c.options.Username, c.options.Password})
+	case c.options.Password != "":
+		setup = append(setup, []interface{}{"AUTH", c.options.Password})
+	}
+
+	if c.options.DB > 0 {
+		setup = append(setup, []interface{}{"SELECT", c.options.DB})
+	}
+
+	if len(setup) == 0 {
+		return cn, nil
+	}
+
+	replies, _, err := cn.roundTrip(ctx, setup, c.options)
+	if err == nil {
+		for _, reply := range replies {
+			if reply[0] == '-' {
+				err = redisError(reply[1 : len(reply)-2])
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return cn, nil
+}
+
+// authUser returns the user to authenticate as with HELLO, which unlike AUTH
+// always takes one
+func authUser(options *redis.Options) string {
+	if options.Username == "" {
+		return "default"
+	}
+
+	return options.Username
+}
+
+// roundTrip writes the commands and reads a reply for each of them. On error
+// it tells if the connection was found closed before the backend replied
+// anything, so the commands can be sent again on another one.
+func (cn *relayConn) roundTrip(
+	ctx context.Context, cmds [][]interface{}, options *redis.Options,
+) ([][]byte, bool, error) {
+	if err := cn.conn.SetWriteDeadline(deadline(ctx, options.WriteTimeout)); err != nil {
+		return nil, true, err
+	}
+
+	for _, args := range cmds {
+		writeCommand(cn.wr, args)
+	}
+
+	if err := cn.wr.Flush(); err != nil {
+		return nil, true, err
+	}
+
+	if err := cn.conn.SetReadDeadline(deadline(ctx, options.ReadTimeout)); err != nil {
+		return nil, false, err
+	}
+
+	if _, err := cn.rd.Peek(1); err != nil {
+		return nil, errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET), err
+	}
+
+	replies := make([][]byte, 0, len(cmds))
+
+	for range cmds {
+		reply, err := appendReply(cn.rd, nil)
+		if err != nil {
+			return nil, false, err
+		}
+
+		replies = append(replies, reply)
+	}
+
+	return replies, false, nil
+}
+
+// deadline returns the earliest of the context deadline and the timeout,
+// the zero time when there is neither
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	var t time.Time
+
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+
+	if d, ok := ctx.Deadline(); ok && (t.IsZero() || d.Before(t)) {
+		t = d
+	}
+
+	return t
+}
+
+// writeCommand encodes a command as an array of bulk strings
+func writeCommand(wr *bufio.Writer, args []interface{}) {
+	wr.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+
+	for _, arg := range args {
+		var value string
+
+		switch v := arg.(type) {
+		case string:
+			value = v
+		case []byte:
+			wr.WriteString("$" + strconv.Itoa(len(v)) + "\r\n")
+			wr.Write(v)
+			wr.WriteString("\r\n")
+
+			continue
+		default:
+			value = fmt.Sprint(v)
+		}
+
+		wr.WriteString("$" + strconv.Itoa(len(value)) + "\r\n")
+		wr.WriteString(value)
+		wr.WriteString("\r\n")
+	}
+}
+
+// appendReply reads a RESP2 or RESP3 reply as it is encoded and appends it to
+// buf. Attributes are kept along with the reply they precede.
+func appendReply(rd *bufio.Reader, buf []byte) ([]byte, error) {
+	start := len(buf)
+
+	buf, err := appendLine(rd, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	line := buf[start:]
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: invalid reply: %q", line)
+	}
+
+	switch line[0] {
+	case '+', '-', ':', '_', ',', '#', '(':
+		return buf, nil
+	case '$', '=', '!':
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid reply: %q", line)
+		}
+
+		if n < 0 {
+			return buf, nil
+		}
+
+		return appendN(rd, buf, n+2)
+	case '*', '~', '>', '%', '|':
+		kind := line[0]
+
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid reply: %q", line)
+		}
+
+		if kind == '%' || kind == '|' {
+			n *= 2
+		}
+
+		for i := 0; i < n; i++ {
+			if buf, err = appendReply(rd, buf); err != nil {
+				return nil, err
+			}
+		}
+
+		if kind == '|' {
+			return appendReply(rd, buf)
+		}
+
+		return buf, nil
+	}
+
+	return nil, fmt.Errorf("redis: invalid reply: %q", line)
+}
+
+// appendLine appends a line, with its CRLF, however long it is
+func appendLine(rd *bufio.Reader, buf []byte) ([]byte, error) {
+	for {
+		chunk, err := rd.ReadSlice('\n')
+		buf = append(buf, chunk...)
+
+		if err != bufio.ErrBufferFull {
+			return buf, err
+		}
+	}
+}
+
+// appendN appends the next n bytes
+func appendN(rd *bufio.Reader, buf []byte, n int) ([]byte, error) {
+	start := len(buf)
+	buf = append(buf, make([]byte, n)...)
+
+	if _, err := io.ReadFull(rd, buf[start:]); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
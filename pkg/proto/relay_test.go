@@ -0,0 +1,313 @@
+package proto
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// startRawBackend serves canned replies, as encoded by Redis, by RESP version
+// and command line. Connections are in RESP2 until they send HELLO 3.
+func startRawBackend(t *testing.T, replies map[int]map[string]string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveRawBackend(conn, replies)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveRawBackend(conn net.Conn, replies map[int]map[string]string) {
+	defer conn.Close()
+
+	parser := NewParser(bufio.NewReader(conn))
+	protocol := 2
+
+	for {
+		cmd, err := parser.ParseCommand()
+		if err != nil {
+			return
+		}
+
+		line := strings.TrimSpace(strings.ToUpper(cmd.Name) + " " + strings.Join(cmd.Args, " "))
+
+		if strings.HasPrefix(line, "HELLO 3") {
+			protocol = 3
+			line = "HELLO 3"
+		}
+
+		reply, ok := replies[protocol][line]
+		if !ok {
+			reply = fmt.Sprintf("-ERR unknown command '%s'\r\n", line)
+		}
+
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func TestProtoRelayedReplies(t *testing.T) {
+	addr := startRawBackend(t, map[int]map[string]string{
+		2: {
+			"ZRANGE z 0 -1 WITHSCORES": "*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$3\r\n2.5\r\n",
+			"TYPE k":                   "+string\r\n",
+			"SET k v GET":              "$2\r\nOK\r\n",
+			"SET lock v NX":            "$-1\r\n",
+			"ZPOPMIN z 2":              "*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$3\r\n2.5\r\n",
+			"LPUSH k x":                "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+		},
+		3: {
+			"HELLO 3":                  "%1\r\n$5\r\nproto\r\n:3\r\n",
+			"ZRANGE z 0 -1 WITHSCORES": "*2\r\n*2\r\n$1\r\na\r\n,1\r\n*2\r\n$1\r\nb\r\n,2.5\r\n",
+			"TYPE k":                   "+string\r\n",
+			"HGETALL h":                "|1\r\n+ttl\r\n:10\r\n%1\r\n$1\r\nf\r\n$1\r\nv\r\n",
+		},
+	})
+
+	client := NewBackendClient(&redis.Options{Addr: addr})
+	defer client.Close()
+
+	proxy := NewRedisProxy(map[string]RedisClient{addr: client})
+
+	tests := []struct {
+		commands []string
+		want     string
+	}{
+		{
+			commands: []string{encodeCommand("ZRANGE", "z", "0", "-1", "WITHSCORES")},
+			want:     "*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$3\r\n2.5\r\n",
+		},
+		{commands: []string{encodeCommand("TYPE", "k")}, want: "+string\r\n"},
+		{commands: []string{encodeCommand("SET", "k", "v", "GET")}, want: "$2\r\nOK\r\n"},
+		{commands: []string{encodeCommand("SET", "lock", "v", "NX")}, want: "$-1\r\n"},
+		{
+			// pipelined commands are relayed the same way
+			commands: []string{
+				encodeCommand("ZPOPMIN", "z", "2"),
+				encodeCommand("TYPE", "k"),
+				encodeCommand("LPUSH", "k", "x"),
+			},
+			want: "*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$3\r\n2.5\r\n" +
+				"+string\r\n" +
+				"-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+		},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, runCommands(proxy, tc.commands...), fmt.Sprintf("%q", tc.commands))
+	}
+
+	// RESP3 clients get the replies of RESP3 connections
+	p, buf := newTestProto(
+		proxy,
+		encodeCommand("HELLO", "3"),
+		encodeCommand("ZRANGE", "z", "0", "-1", "WITHSCORES"),
+		encodeCommand("TYPE", "k"),
+		encodeCommand("HGETALL", "h"),
+	)
+	handleAll(p)
+
+	want := "*2\r\n*2\r\n$1\r\na\r\n,1\r\n*2\r\n$1\r\nb\r\n,2.5\r\n" +
+		"+string\r\n" +
+		"|1\r\n+ttl\r\n:10\r\n%1\r\n$1\r\nf\r\n$1\r\nv\r\n"
+
+	assert.True(t, strings.HasSuffix(buf.String(), "*0\r\n"+want), buf.String())
+}
+
+func TestBackendClientSetup(t *testing.T) {
+	addr := startRawBackend(t, map[int]map[string]string{
+		2: {"AUTH secret": "+OK\r\n", "SELECT 2": "+OK\r\n", "GET k": "$1\r\nv\r\n"},
+		3: {"HELLO 3": "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+	})
+
+	client := NewBackendClient(&redis.Options{Addr: addr, Password: "secret", DB: 2})
+
+	replies, err := client.Relay(context.Background(), 2, [][]interface{}{{"GET", "k"}, {"GET", []byte("x")}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, [][]byte{[]byte("$1\r\nv\r\n"), []byte("-ERR unknown command 'GET x'\r\n")}, replies)
+
+	_, err = client.Relay(context.Background(), 3, [][]interface{}{{"GET", "k"}})
+	assert.EqualError(t, err, "WRONGPASS invalid username-password pair or user is disabled.")
+
+	assert.Equal(t, nil, client.Close())
+
+	_, err = client.Relay(context.Background(), 2, [][]interface{}{{"GET", "k"}})
+	assert.Equal(t, errBackendClosed, err)
+}
+
+// countingBackend answers PING slowly and counts its connections
+type countingBackend struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	max   int
+	dials int
+}
+
+func startCountingBackend(t *testing.T) *countingBackend {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+
+	t.Cleanup(func() { listener.Close() })
+
+	b := &countingBackend{listener: listener, conns: map[net.Conn]bool{}}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			b.mu.Lock()
+			b.conns[conn] = true
+			b.dials++
+			if len(b.conns) > b.max {
+				b.max = len(b.conns)
+			}
+			b.mu.Unlock()
+
+			go b.serve(conn)
+		}
+	}()
+
+	return b
+}
+
+func (b *countingBackend) serve(conn net.Conn) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, conn)
+		b.mu.Unlock()
+
+		conn.Close()
+	}()
+
+	parser := NewParser(bufio.NewReader(conn))
+
+	for {
+		if _, err := parser.ParseCommand(); err != nil {
+			return
+		}
+
+		time.Sleep(5 * time.Millisecond)
+
+		if _, err := conn.Write([]byte("+PONG\r\n")); err != nil {
+			return
+		}
+	}
+}
+
+// closeConns closes the connections like a backend restart does
+func (b *countingBackend) closeConns() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for conn := range b.conns {
+		conn.Close()
+	}
+}
+
+func TestBackendClientPoolSize(t *testing.T) {
+	backend := startCountingBackend(t)
+
+	client := NewBackendClient(&redis.Options{Addr: backend.listener.Addr().String(), PoolSize: 2})
+	defer client.Close()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			replies, err := client.Relay(context.Background(), 2, [][]interface{}{{"PING"}})
+			assert.Equal(t, nil, err)
+			assert.Equal(t, [][]byte{[]byte("+PONG\r\n")}, replies)
+		}()
+	}
+
+	wg.Wait()
+
+	backend.mu.Lock()
+	assert.Equal(t, 2, backend.max, "connections are limited to the pool size")
+	assert.Equal(t, 2, backend.dials, "connections are reused")
+	backend.mu.Unlock()
+
+	// the idle connections went away with a backend restart
+	backend.closeConns()
+	time.Sleep(10 * time.Millisecond)
+
+	replies, err := client.Relay(context.Background(), 2, [][]interface{}{{"PING"}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, [][]byte{[]byte("+PONG\r\n")}, replies)
+
+	// a client waits for a connection up to the pool timeout
+	busy := NewBackendClient(&redis.Options{
+		Addr: backend.listener.Addr().String(), PoolSize: 1, PoolTimeout: time.Millisecond,
+	})
+	defer busy.Close()
+
+	busy.open <- struct{}{}
+
+	_, err = busy.Relay(context.Background(), 2, [][]interface{}{{"PING"}})
+	assert.Equal(t, errPoolTimeout, err)
+}
+
+func TestAppendReply(t *testing.T) {
+	replies := []string{
+		"+OK\r\n",
+		"-ERR fake\r\n",
+		":1\r\n",
+		"$-1\r\n",
+		"$0\r\n\r\n",
+		"$4\r\na\r\nb\r\n",
+		"*-1\r\n",
+		"*2\r\n*1\r\n:1\r\n$1\r\nx\r\n",
+		"_\r\n",
+		",1.5\r\n",
+		"#t\r\n",
+		"(12345678901234567890\r\n",
+		"=8\r\ntxt:text\r\n",
+		"~1\r\n$1\r\na\r\n",
+		"%1\r\n$1\r\nf\r\n*1\r\n:2\r\n",
+		">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\nk\r\n",
+		"|1\r\n+key-popularity\r\n%1\r\n$1\r\na\r\n,0.1\r\n*1\r\n:1\r\n",
+		"+" + strings.Repeat("x", 10000) + "\r\n",
+	}
+
+	rd := bufio.NewReaderSize(strings.NewReader(strings.Join(replies, "")), 16)
+
+	for _, want := range replies {
+		reply, err := appendReply(rd, nil)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, want, string(reply))
+	}
+
+	for _, invalid := range []string{"?\r\n", "$x\r\n", "*1\r\n", "+OK\n"} {
+		_, err := appendReply(bufio.NewReader(strings.NewReader(invalid)), nil)
+		assert.Error(t, err, invalid)
+	}
+}
@@ -1,79 +1,281 @@
 package proto
 
 import (
+	"bufio"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
 
-	"github.com/rs/zerolog/log"
+	"github.com/go-redis/redis/v9"
 )
 
+// redisError is an error reply generated by the proxy that already carries
+// its Redis prefix, so it is sent as is like errors coming from a backend
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+func (redisError) RedisError() {}
+
+var errCrossSlot = redisError("CROSSSLOT Keys in request don't hash to the same slot")
+
+// Responser encodes replies into a buffer that is written to the connection
+// by Flush, once per batch of commands instead of once per reply fragment
 type Responser struct {
-	conn io.Writer
+	conn *bufio.Writer
+
+	// protocol is the RESP version negotiated with HELLO, 2 or 3
+	protocol int
+
+	// err is the first write error, replies are dropped after it
+	err error
+
+	// scratch is used to format numbers without allocating
+	scratch [32]byte
 }
 
 func NewResponser(conn io.Writer) *Responser {
-	r := &Responser{conn}
+	r := &Responser{conn: bufio.NewWriter(conn), protocol: 2}
 
 	return r
 }
 
-func (r *Responser) SendError(val error) {
-	_, err := fmt.Fprintf(r.conn, "-ERR %s\r\n", val)
+// SetProtocol switches the encoding of replies to RESP2 or RESP3
+func (r *Responser) SetProtocol(protocol int) {
+	r.protocol = protocol
+}
 
-	if err != nil {
-		log.Error().Msgf("Cound not send a aresponse: %v", err)
+// Flush writes the buffered replies to the connection and returns the first
+// error hit while writing them, after which the connection is unusable
+func (r *Responser) Flush() error {
+	if r.err == nil {
+		r.err = r.conn.Flush()
 	}
+
+	return r.err
 }
 
-func (r *Responser) SendPong() {
-	_, err := fmt.Fprintf(r.conn, "+PONG\r\n")
-	if err != nil {
-		log.Error().Msgf("Cound not send a aresponse: %v", err)
+func (r *Responser) write(value string) {
+	if r.err != nil {
+		return
 	}
+
+	_, r.err = r.conn.WriteString(value)
 }
 
-func (r *Responser) SendInt(value int64) {
-	_, err := fmt.Fprintf(r.conn, ":%d\r\n", value)
+// writeLine writes a reply line made of a type prefix and a value
+func (r *Responser) writeLine(prefix byte, value string) {
+	if r.err != nil {
+		return
+	}
 
-	if err != nil {
-		log.Error().Msgf("Cound not send a aresponse: %v", err)
+	r.err = r.conn.WriteByte(prefix)
+	r.write(value)
+	r.write("\r\n")
+}
+
+// writeInt writes a reply line made of a type prefix and a number, like the
+// header of an array or a bulk string
+func (r *Responser) writeInt(prefix byte, value int64) {
+	if r.err != nil {
+		return
 	}
+
+	line := append(r.scratch[:0], prefix)
+	line = strconv.AppendInt(line, value, 10)
+	line = append(line, '\r', '\n')
+
+	_, r.err = r.conn.Write(line)
 }
 
-func (r *Responser) SendStr(value string) {
-	_, err := fmt.Fprintf(r.conn, "+%s\r\n", value)
+// newlineReplacer turns the line breaks of an error message into spaces, like
+// Redis does, as they would end the error reply early
+var newlineReplacer = strings.NewReplacer("\r", " ", "\n", " ")
 
-	if err != nil {
-		log.Error().Msgf("Cound not send a aresponse: %v", err)
+func (r *Responser) SendError(val error) {
+	// errors returned by a backend already carry their prefix (ERR, WRONGTYPE, ...)
+	if _, ok := val.(redis.Error); ok {
+		r.writeLine('-', newlineReplacer.Replace(val.Error()))
+		return
 	}
+
+	r.writeLine('-', "ERR "+newlineReplacer.Replace(val.Error()))
 }
 
-func (r *Responser) SendNull() {
-	_, err := fmt.Fprintf(r.conn, "$-1\r\n")
+// SendRaw sends a reply already encoded by a backend
+func (r *Responser) SendRaw(reply []byte) {
+	if r.err != nil {
+		return
+	}
+
+	_, r.err = r.conn.Write(reply)
+}
+
+func (r *Responser) SendPong() {
+	r.write("+PONG\r\n")
+}
+
+func (r *Responser) SendInt(value int64) {
+	r.writeInt(':', value)
+}
+
+func (r *Responser) SendStr(value string) {
+	r.writeLine('+', value)
+}
+
+func (r *Responser) SendBulk(value string) {
+	r.writeInt('$', int64(len(value)))
+	r.write(value)
+	r.write("\r\n")
+}
 
-	if err != nil {
-		log.Error().Msgf("Cound not send a aresponse: %v", err)
+func (r *Responser) SendNull() {
+	if r.protocol == 3 {
+		r.write("_\r\n")
+		return
 	}
+
+	r.write("$-1\r\n")
 }
 
 func (r *Responser) SendArr(values []string) {
-	_, err := fmt.Fprintf(r.conn, "*%d\r\n", len(values))
+	r.sendArrayLen(len(values))
 
-	if err != nil {
-		log.Error().Msgf("Cound not send a aresponse: %v", err)
+	for _, value := range values {
+		r.SendBulk(value)
+	}
+}
+
+// SendSet sends a RESP3 set, RESP2 clients get an array
+func (r *Responser) SendSet(values []interface{}) {
+	if r.protocol == 3 {
+		r.writeInt('~', int64(len(values)))
+	} else {
+		r.sendArrayLen(len(values))
 	}
 
 	for _, value := range values {
-		_, err = fmt.Fprintf(r.conn, "$%d\r\n", len(value))
+		r.SendReply(value)
+	}
+}
+
+// SendDouble sends a RESP3 double, RESP2 clients get a bulk string
+func (r *Responser) SendDouble(value float64) {
+	var repr string
 
-		if err != nil {
-			log.Error().Msgf("Cound not send a aresponse: %v", err)
+	switch {
+	case math.IsInf(value, 1):
+		repr = "inf"
+	case math.IsInf(value, -1):
+		repr = "-inf"
+	case math.IsNaN(value):
+		repr = "nan"
+	default:
+		repr = strconv.FormatFloat(value, 'f', -1, 64)
+	}
+
+	if r.protocol == 3 {
+		r.writeLine(',', repr)
+		return
+	}
+
+	r.SendBulk(repr)
+}
+
+// SendBool sends a RESP3 boolean, RESP2 clients get 1 or 0
+func (r *Responser) SendBool(value bool) {
+	if r.protocol == 3 {
+		if value {
+			r.write("#t\r\n")
+		} else {
+			r.write("#f\r\n")
 		}
 
-		_, err = fmt.Fprintf(r.conn, "%s\r\n", value)
+		return
+	}
+
+	if value {
+		r.SendInt(1)
+	} else {
+		r.SendInt(0)
+	}
+}
+
+// SendBigNumber sends a RESP3 big number, RESP2 clients get a bulk string
+func (r *Responser) SendBigNumber(value *big.Int) {
+	if r.protocol == 3 {
+		r.writeLine('(', value.String())
+		return
+	}
+
+	r.SendBulk(value.String())
+}
+
+// SendVerbatim sends a RESP3 verbatim string of the given three letter
+// format (txt or mkd), RESP2 clients get a bulk string
+func (r *Responser) SendVerbatim(format, value string) {
+	if r.protocol == 3 {
+		r.writeInt('=', int64(len(value)+4))
+		r.write(format)
+		r.write(":")
+		r.write(value)
+		r.write("\r\n")
+		return
+	}
+
+	r.SendBulk(value)
+}
+
+// SendReply encodes a reply decoded by go-redis. Backends are spoken to in
+// RESP3, so for RESP2 clients maps are flattened into arrays, doubles and big
+// numbers become bulk strings and booleans become integers like Redis does.
+func (r *Responser) SendReply(val interface{}) {
+	switch v := val.(type) {
+	case nil:
+		r.SendNull()
+	case string:
+		r.SendBulk(v)
+	case int64:
+		r.SendInt(v)
+	case float64:
+		r.SendDouble(v)
+	case *big.Int:
+		r.SendBigNumber(v)
+	case bool:
+		r.SendBool(v)
+	case error:
+		r.SendError(v)
+	case []interface{}:
+		r.sendArrayLen(len(v))
+
+		for _, item := range v {
+			r.SendReply(item)
+		}
+	case map[interface{}]interface{}:
+		r.sendMapLen(len(v))
 
-		if err != nil {
-			log.Error().Msgf("Cound not send a aresponse: %v", err)
+		for key, value := range v {
+			r.SendReply(key)
+			r.SendReply(value)
 		}
+	default:
+		r.SendBulk(fmt.Sprint(v))
 	}
 }
+
+func (r *Responser) sendArrayLen(n int) {
+	r.writeInt('*', int64(n))
+}
+
+// sendMapLen starts a map of n pairs, a flat array of keys and values in RESP2
+func (r *Responser) sendMapLen(n int) {
+	if r.protocol == 3 {
+		r.writeInt('%', int64(n))
+		return
+	}
+
+	r.sendArrayLen(n * 2)
+}
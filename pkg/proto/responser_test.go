@@ -3,6 +3,8 @@ package proto
 import (
 	"bytes"
 	"errors"
+	"math"
+	"math/big"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -22,6 +24,7 @@ func TestResponserSendError(t *testing.T) {
 		responser := NewResponser(buf)
 
 		responser.SendError(tc.value)
+		responser.Flush()
 
 		assert.Equal(t, buf.String(), tc.want, "they should be equal")
 	}
@@ -39,6 +42,7 @@ func TestSendPong(t *testing.T) {
 		responser := NewResponser(buf)
 
 		responser.SendPong()
+		responser.Flush()
 
 		assert.Equal(t, buf.String(), tc.want, "they should be equal")
 	}
@@ -60,6 +64,7 @@ func TestResponserSendInt(t *testing.T) {
 		responser := NewResponser(buf)
 
 		responser.SendInt(tc.value)
+		responser.Flush()
 
 		assert.Equal(t, buf.String(), tc.want, "they should be equal")
 	}
@@ -81,6 +86,7 @@ func TestResponserSendStr(t *testing.T) {
 		responser := NewResponser(buf)
 
 		responser.SendStr(tc.value)
+		responser.Flush()
 
 		assert.Equal(t, buf.String(), tc.want, "they should be equal")
 	}
@@ -102,7 +108,160 @@ func TestResponserSendArr(t *testing.T) {
 		responser := NewResponser(buf)
 
 		responser.SendArr(tc.value)
+		responser.Flush()
 
 		assert.Equal(t, buf.String(), tc.want, "they should be equal")
 	}
 }
+
+func TestResponserSendBulk(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "foo", want: "$3\r\nfoo\r\n"},
+		{value: "", want: "$0\r\n\r\n"},
+		{value: "multi\r\nline", want: "$11\r\nmulti\r\nline\r\n"},
+		{value: "zero\x00byte", want: "$9\r\nzero\x00byte\r\n"},
+		{value: "\xff\xfe\x00\r\n", want: "$5\r\n\xff\xfe\x00\r\n\r\n"},
+	}
+
+	for _, tc := range tests {
+		buf := new(bytes.Buffer)
+		responser := NewResponser(buf)
+
+		responser.SendBulk(tc.value)
+		responser.Flush()
+
+		assert.Equal(t, buf.String(), tc.want, "they should be equal")
+	}
+}
+
+func TestResponserSendReply(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{value: nil, want: "$-1\r\n"},
+		{value: "foo", want: "$3\r\nfoo\r\n"},
+		{value: int64(-2), want: ":-2\r\n"},
+		{value: 3.25, want: "$4\r\n3.25\r\n"},
+		{value: true, want: ":1\r\n"},
+		{value: false, want: ":0\r\n"},
+		{value: []interface{}{}, want: "*0\r\n"},
+		{value: []interface{}{"a", nil, int64(1)}, want: "*3\r\n$1\r\na\r\n$-1\r\n:1\r\n"},
+		{value: []interface{}{[]interface{}{"a"}}, want: "*1\r\n*1\r\n$1\r\na\r\n"},
+		{value: map[interface{}]interface{}{"k": int64(1)}, want: "*2\r\n$1\r\nk\r\n:1\r\n"},
+		{value: errors.New("Not found"), want: "-ERR Not found\r\n"},
+	}
+
+	for _, tc := range tests {
+		buf := new(bytes.Buffer)
+		responser := NewResponser(buf)
+
+		responser.SendReply(tc.value)
+		responser.Flush()
+
+		assert.Equal(t, tc.want, buf.String(), "they should be equal")
+	}
+}
+
+func TestResponserRESP3(t *testing.T) {
+	tests := []struct {
+		send  func(r *Responser)
+		resp2 string
+		resp3 string
+	}{
+		{send: func(r *Responser) { r.SendNull() }, resp2: "$-1\r\n", resp3: "_\r\n"},
+		{send: func(r *Responser) { r.SendBool(true) }, resp2: ":1\r\n", resp3: "#t\r\n"},
+		{send: func(r *Responser) { r.SendBool(false) }, resp2: ":0\r\n", resp3: "#f\r\n"},
+		{send: func(r *Responser) { r.SendDouble(1.5) }, resp2: "$3\r\n1.5\r\n", resp3: ",1.5\r\n"},
+		{send: func(r *Responser) { r.SendDouble(math.Inf(-1)) }, resp2: "$4\r\n-inf\r\n", resp3: ",-inf\r\n"},
+		{
+			send:  func(r *Responser) { r.SendBigNumber(big.NewInt(1234567890)) },
+			resp2: "$10\r\n1234567890\r\n",
+			resp3: "(1234567890\r\n",
+		},
+		{
+			send:  func(r *Responser) { r.SendVerbatim("txt", "Some string") },
+			resp2: "$11\r\nSome string\r\n",
+			resp3: "=15\r\ntxt:Some string\r\n",
+		},
+		{
+			send:  func(r *Responser) { r.SendSet([]interface{}{"a", "b"}) },
+			resp2: "*2\r\n$1\r\na\r\n$1\r\nb\r\n",
+			resp3: "~2\r\n$1\r\na\r\n$1\r\nb\r\n",
+		},
+		{
+			send:  func(r *Responser) { r.SendReply(map[interface{}]interface{}{"f": nil}) },
+			resp2: "*2\r\n$1\r\nf\r\n$-1\r\n",
+			resp3: "%1\r\n$1\r\nf\r\n_\r\n",
+		},
+	}
+
+	for _, tc := range tests {
+		buf := new(bytes.Buffer)
+		responser := NewResponser(buf)
+
+		tc.send(responser)
+		responser.Flush()
+		assert.Equal(t, tc.resp2, buf.String(), "RESP2")
+
+		buf.Reset()
+		responser.SetProtocol(3)
+
+		tc.send(responser)
+		responser.Flush()
+		assert.Equal(t, tc.resp3, buf.String(), "RESP3")
+	}
+}
+
+// countingWriter counts the writes reaching the connection and fails once
+// failAfter of them have been made
+type countingWriter struct {
+	writes    int
+	failAfter int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	if w.failAfter > 0 && w.writes >= w.failAfter {
+		return 0, errors.New("write: broken pipe")
+	}
+
+	w.writes++
+
+	return len(b), nil
+}
+
+func TestResponserFlush(t *testing.T) {
+	conn := &countingWriter{}
+	responser := NewResponser(conn)
+
+	values := make([]string, 1000)
+	for i := range values {
+		values[i] = "value"
+	}
+
+	responser.SendPong()
+	assert.Equal(t, 0, conn.writes, "nothing is written before a flush")
+
+	// about 11KB of reply goes out in buffer sized chunks, not per fragment
+	responser.SendArr(values)
+	assert.Equal(t, nil, responser.Flush())
+	assert.Equal(t, 3, conn.writes)
+}
+
+func TestResponserWriteError(t *testing.T) {
+	conn := &countingWriter{failAfter: 1}
+	responser := NewResponser(conn)
+
+	responser.SendPong()
+	assert.Equal(t, nil, responser.Flush())
+
+	responser.SendPong()
+	assert.EqualError(t, responser.Flush(), "write: broken pipe")
+
+	// the error sticks, the connection is done
+	responser.SendPong()
+	assert.EqualError(t, responser.Flush(), "write: broken pipe")
+}
@@ -0,0 +1,130 @@
+package proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// scanNodeBits is the number of low bits of a SCAN cursor holding the index
+// of the node being scanned, the cursor of the node is kept in the others
+const scanNodeBits = 10
+
+// maxScanNodes is the number of nodes a composite cursor can address
+const maxScanNodes = 1 << scanNodeBits
+
+var (
+	errInvalidCursor = errors.New("invalid cursor")
+	errSyntax        = errors.New("syntax error")
+	errNotInteger    = errors.New("value is not an integer or out of range")
+)
+
+// Scan runs one SCAN step over the nodes, which are scanned one after the
+// other in the order of their names. The cursor combines the index of the node
+// being scanned with the cursor of that node, so it is opaque to clients like
+// the one of Redis and 0 once every node is done. The options, like MATCH,
+// COUNT and TYPE, are sent to the nodes as they are.
+//
+// Nodes added, removed, ejected or readmitted in the middle of a scan shift
+// the indexes, so like a rehashing Redis a scan may return keys twice or miss
+// the keys that moved.
+func (c *RedisProxy) Scan(ctx context.Context, cursor uint64, options ...interface{}) *redis.ScanCmd {
+	t := c.topology.Load()
+	nodes := c.scanNodes(t)
+
+	if len(nodes) > maxScanNodes {
+		return redis.NewScanCmdResult(nil, 0, fmt.Errorf("can't scan more than %d nodes", maxScanNodes))
+	}
+
+	index := int(cursor & (maxScanNodes - 1))
+	nodeCursor := cursor >> scanNodeBits
+
+	if index >= len(nodes) {
+		return redis.NewScanCmdResult(nil, 0, errInvalidCursor)
+	}
+
+	args := append([]interface{}{"SCAN", strconv.FormatUint(nodeCursor, 10)}, options...)
+
+	reply, err := t.clients[nodes[index]].Do(ctx, args...).Slice()
+	if err != nil {
+		return redis.NewScanCmdResult(nil, 0, err)
+	}
+
+	next, keys, err := parseScanReply(reply)
+	if err != nil {
+		return redis.NewScanCmdResult(nil, 0, err)
+	}
+
+	if next>>(64-scanNodeBits) != 0 {
+		return redis.NewScanCmdResult(nil, 0, fmt.Errorf("cursor %d of node %s is too large to be combined", next, nodes[index]))
+	}
+
+	switch {
+	case next != 0:
+		next = next<<scanNodeBits | uint64(index)
+	case index+1 < len(nodes):
+		// the next node starts from its first key
+		next = uint64(index + 1)
+	}
+
+	return redis.NewScanCmdResult(keys, next, nil)
+}
+
+// scanNodes returns the names of the nodes to scan sorted, while resharding
+// they include the nodes keys are moved from. Like locate, it leaves out the
+// ejected nodes unless they all are.
+func (c *RedisProxy) scanNodes(t *topology) []string {
+	ejected := c.ejected.Load()
+	nodes := make([]string, 0, len(t.clients))
+
+	for node := range t.clients {
+		if ejected == nil || !ejected.nodes[node] {
+			nodes = append(nodes, node)
+		}
+	}
+
+	if len(nodes) == 0 {
+		for node := range t.clients {
+			nodes = append(nodes, node)
+		}
+	}
+
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// parseScanOptions checks the MATCH, COUNT and TYPE options of a SCAN
+func parseScanOptions(args []string) ([]interface{}, error) {
+	options := make([]interface{}, 0, len(args))
+
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return nil, errSyntax
+		}
+
+		switch strings.ToUpper(args[i]) {
+		case "MATCH", "TYPE":
+		case "COUNT":
+			count, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return nil, errNotInteger
+			}
+
+			if count < 1 {
+				return nil, errSyntax
+			}
+		default:
+			return nil, errSyntax
+		}
+
+		options = append(options, args[i], args[i+1])
+	}
+
+	return options, nil
+}
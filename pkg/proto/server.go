@@ -1,66 +1,105 @@
 package proto
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"runtime/debug"
 	"sync"
 
-	"github.com/ansrivas/fiberprometheus/v2"
-	"github.com/gofiber/fiber/v2"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/rs/zerolog/log"
 )
 
+// DefaultPoolName is the name of the pool of a server made with NewServer
+const DefaultPoolName = "default"
+
+var errPanic = errors.New("recovered from panic")
+
 type Server struct {
+	// Name is the name of the pool served
+	Name        string
 	TCPListener *net.TCPListener
 	quit        chan any
 	redis       *RedisProxy
 	Port        int
 	wg          sync.WaitGroup
 
-	router  *fiber.App
-	Metrics *PrometheusMetrics
+	// Passthrough makes connections forward the single-shard commands that
+	// have a handler too and relay their backend replies verbatim.
+	Passthrough bool
+	// MaxBulkLen and MaxMultibulkLen limit the size of client requests,
+	// the parser defaults are used when they are not set
+	MaxBulkLen      int64
+	MaxMultibulkLen int64
+
+	// MetricsAddr is the address the metrics and the admin API are served on
+	// by a server made with NewServer, the servers of a MetricsServer leave
+	// serving them to it
+	MetricsAddr string
+	// AdminToken enables the admin changes, PROXY AUTH with it lets a
+	// connection run them. It is the token of the admin API of a server made
+	// with NewServer too.
+	AdminToken string
+
+	metricsServer *MetricsServer
+	Metrics       *PrometheusMetrics
 }
 
 func NewServer(redis *RedisProxy, port int) *Server {
-	router := fiber.New()
+	return NewServerWithAddr(redis, fmt.Sprintf(":%d", port))
+}
+
+// NewServerWithAddr listens on an address like "127.0.0.1:46379" or ":46379"
+// and serves its own metrics and admin API
+func NewServerWithAddr(redis *RedisProxy, addr string) *Server {
+	metricsServer := NewMetricsServer(":9090")
 
-	registry := prometheus.NewRegistry()
+	metrics, err := metricsServer.AddPool(DefaultPoolName, redis)
+	checkError(err)
+
+	server := NewPoolServer(DefaultPoolName, redis, addr, metrics)
+	server.MetricsAddr = metricsServer.Addr
+	server.metricsServer = metricsServer
 
-	prom := fiberprometheus.NewWithRegistry(
-		registry, "redproxy", "redproxy", "redproxy", map[string]string{},
-	)
-	prom.RegisterAt(router, "/metrics")
-	router.Use(prom.Middleware)
-	registry.Register(collectors.NewGoCollector())
+	return server
+}
 
+// NewPoolServer listens on an address for the clients of a pool, its metrics
+// are registered on a MetricsServer with MetricsServer.AddPool
+func NewPoolServer(name string, redis *RedisProxy, addr string, metrics *PrometheusMetrics) *Server {
 	server := &Server{
+		Name:    name,
 		redis:   redis,
-		Port:    port,
 		quit:    make(chan interface{}),
-		Metrics: NewPrometheusMetrics(registry, "redproxy", "redproxy"),
-		router:  router,
+		Metrics: metrics,
 	}
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf(":%d", server.Port))
+	tcpAddr, err := net.ResolveTCPAddr("tcp4", addr)
 	checkError(err)
 	server.TCPListener, err = net.ListenTCP("tcp", tcpAddr)
 	checkError(err)
 
+	server.Port = server.TCPListener.Addr().(*net.TCPAddr).Port
+
 	return server
 }
 
 func (srv *Server) ListenAndServe() {
-	go func() {
-		err := srv.router.Listen(":9090")
-		if err != nil {
-			log.Error().Msgf("Fatal error: %s", err.Error())
-		}
-	}()
+	if srv.metricsServer != nil {
+		srv.metricsServer.Addr = srv.MetricsAddr
+		srv.metricsServer.AdminToken = srv.AdminToken
+
+		go func() {
+			err := srv.metricsServer.ListenAndServe()
+			if err != nil {
+				log.Error().Msgf("Fatal error: %s", err.Error())
+			}
+		}()
+	}
 
-	log.Info().Msgf("Listening on port: %d", srv.Port)
+	log.Info().Msgf("Pool %s listening on port: %d", srv.Name, srv.Port)
 	defer srv.wg.Done()
 
 	for {
@@ -93,10 +132,21 @@ func (srv *Server) Stop() {
 
 func (srv *Server) handleClient(conn io.ReadWriteCloser) {
 	redisProto := NewProto(srv.Metrics, srv.redis, conn, conn)
+	redisProto.passthrough = srv.Passthrough
+	redisProto.adminToken = srv.AdminToken
+
+	if srv.MaxBulkLen > 0 {
+		redisProto.parser.MaxBulkLen = srv.MaxBulkLen
+	}
+
+	if srv.MaxMultibulkLen > 0 {
+		redisProto.parser.MaxMultibulkLen = srv.MaxMultibulkLen
+	}
+
 	defer conn.Close()
 
 	for {
-		err := redisProto.HandleRequest()
+		err := srv.handleRequest(redisProto)
 		if err != nil {
 			if err == io.EOF {
 				log.Debug().Msg("Client has been disconnected")
@@ -106,10 +156,27 @@ func (srv *Server) handleClient(conn io.ReadWriteCloser) {
 			}
 			return
 		}
-		srv.Metrics.CommandsProxiedTotal.With(prometheus.Labels{}).Inc()
 	}
 }
 
+// handleRequest runs a single request and turns a panic into an error reply,
+// so a bug in a command handler closes one connection instead of the process.
+func (srv *Server) handleRequest(redisProto *Proto) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().Msgf("Recovered from panic: %v\n%s", r, debug.Stack())
+			srv.Metrics.PanicsTotal.With(prometheus.Labels{}).Inc()
+
+			redisProto.responser.SendError(fmt.Errorf("internal error: %v", r))
+			redisProto.responser.Flush()
+
+			err = errPanic
+		}
+	}()
+
+	return redisProto.HandleRequest()
+}
+
 func checkError(err error) {
 	if err != nil {
 		log.Fatal().Msgf("Fatal error: %s", err.Error())
@@ -1,14 +1,18 @@
 package proto
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"net"
 	"sort"
 	"testing"
 	"time"
 
 	"github.com/go-redis/redis/v9"
 	"github.com/kgantsov/redproxy/pkg/consistent_hashing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -362,3 +366,32 @@ func TestServerExpire(t *testing.T) {
 
 	server.Stop()
 }
+
+func TestServerRecoversFromPanic(t *testing.T) {
+	clients := setupFakeClients(3)
+	setCannedReply(clients, "LPUSH", fakePanic("boom"))
+
+	srv := &Server{
+		redis:   NewRedisProxy(clients),
+		Metrics: NewPrometheusMetrics(prometheus.NewRegistry(), "redproxy", "redproxy"),
+	}
+
+	server, client := net.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		srv.handleClient(server)
+		close(done)
+	}()
+
+	_, err := client.Write([]byte(encodeCommand("LPUSH", "list", "item")))
+	assert.Equal(t, nil, err)
+
+	reply, err := bufio.NewReader(client).ReadString('\n')
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "-ERR internal error: boom\r\n", reply)
+
+	<-done
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(srv.Metrics.PanicsTotal))
+}